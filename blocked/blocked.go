@@ -0,0 +1,289 @@
+// Package blocked implements a cache-line blocked bloomfilter.
+//
+// The bit array is split in blocks of 512 bits (64 bytes, a cache line) and all the k bits of an element
+// are set in a single block, so every lookup touches just one cache line. The uneven load of the blocks
+// increases the false positive probability, so the filter is sized with the corrected formula:
+// https://www.cs.amherst.edu/~ccmcgeoch/cs34/papers/cacheefficientbloomfilters-jea.pdf
+//
+// The price of the faster lookups is memory: the lower the false positive probability, the bigger the
+// filter compared to a classic one (around 1.1x for 0.001 and 1.9x for 1e-9).
+package blocked
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+)
+
+const (
+	// BlockBits is the number of bits of every block
+	BlockBits = 1 << blockShift
+
+	blockShift = 9
+	blockWords = BlockBits / 64
+)
+
+// Bloomfilter is a cache-line blocked bloomfilter
+type Bloomfilter struct {
+	words  []uint64
+	blocks uint
+	k      uint
+	h      []bloomfilter.Hash
+	h128   bloomfilter.Hash128
+	cfg    bloomfilter.Config
+}
+
+// Build validates the config before creating a new blocked bloomfilter
+func Build(cfg bloomfilter.Config) (*Bloomfilter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return New(cfg), nil
+}
+
+// New creates a new blocked bloomfilter from a given config. It panics if the config has an unknown
+// hash name, use Build to get an error instead
+func New(cfg bloomfilter.Config) *Bloomfilter {
+	blocks, k := Size(cfg.N, cfg.P)
+	b := &Bloomfilter{
+		words:  make([]uint64, blocks*blockWords),
+		blocks: blocks,
+		k:      k,
+		cfg:    cfg,
+	}
+	if err := b.setHashers(); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Size computes the number of blocks and hash functions required to store n elements with a false
+// positive probability p. It starts with the size of a classic bloomfilter and grows it until the
+// corrected false positive probability with the best number of hash functions is good enough
+func Size(n uint, p float64) (uint, uint) {
+	blocks := (bloomfilter.M(n, p) + BlockBits - 1) / BlockBits
+	if blocks == 0 {
+		blocks = 1
+	}
+	for {
+		if k, fp := bestK(blocks, n); fp <= p {
+			return blocks, k
+		}
+		blocks += blocks/32 + 1
+	}
+}
+
+// bestK returns the number of hash functions minimizing the corrected false positive probability of a
+// blocked bloomfilter and that probability. The uneven load of the blocks makes it lower than the one
+// of a classic bloomfilter of the same size
+func bestK(blocks, n uint) (uint, float64) {
+	k, fp := uint(1), P(blocks, n, 1)
+	for k < BlockBits/2 {
+		next := P(blocks, n, k+1)
+		if next >= fp {
+			break
+		}
+		k, fp = k+1, next
+	}
+	return k, fp
+}
+
+// P computes the false positive probability of a blocked bloomfilter with the given number of blocks and
+// hash functions storing n elements. The number of elements per block follows a Poisson distribution,
+// so the classic formula is weighted by the probability of every block load
+func P(blocks, n, k uint) float64 {
+	if blocks == 0 {
+		return 1
+	}
+	if n == 0 {
+		return 0
+	}
+	lambda := float64(n) / float64(blocks)
+	max := int(lambda + 10*math.Sqrt(lambda) + 10)
+	p := 0.0
+	for i := 0; i <= max; i++ {
+		lg, _ := math.Lgamma(float64(i) + 1)
+		poisson := math.Exp(float64(i)*math.Log(lambda) - lambda - lg)
+		p += poisson * bloomfilter.P(BlockBits, uint(i), k)
+	}
+	return p
+}
+
+func (b *Bloomfilter) setHashers() error {
+	h, err := bloomfilter.SeededHashes(b.cfg.HashName, 2, b.cfg.Seed)
+	if err != nil {
+		return err
+	}
+	b.h = h
+	b.h128, _, _ = bloomfilter.Hash128ByName(b.cfg.HashName)
+	return nil
+}
+
+func (b *Bloomfilter) digest(elem []byte) (uint64, uint64) {
+	if b.h128 != nil {
+		return b.h128(elem, b.cfg.Seed)
+	}
+	out := b.h[0](elem)
+	if len(out) > 1 {
+		return uint64(out[0]), uint64(out[1])
+	}
+	return uint64(out[0]), bloomfilter.XXHash64(elem, uint64(out[0]))
+}
+
+// locate returns the block of an element and the seed of its bit positions in it. Both words of the
+// digest are mixed into the block, since some hashers do not spread the changes of the element over
+// all the bits of the digest
+func (b *Bloomfilter) locate(elem []byte) (*[blockWords]uint64, uint64) {
+	h1, h2 := b.digest(elem)
+	h1 = mix(h1 ^ mix(h2))
+	h2 = mix(h2 ^ h1)
+	block, _ := bits.Mul64(h1, uint64(b.blocks))
+	return (*[blockWords]uint64)(b.words[block*blockWords:]), h2
+}
+
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// next returns the position inside the block encoded in the top bits of the state and advances it.
+// Double hashing in such a small space repeats too many patterns, so the positions are taken from a
+// 64 bit LCG instead, whose top bits are well distributed
+func next(state *uint64) uint64 {
+	pos := *state >> (64 - blockShift)
+	*state = *state*6364136223846793005 + 1442695040888963407
+	return pos
+}
+
+// Add an element to the blocked bloomfilter
+func (b *Bloomfilter) Add(elem []byte) {
+	block, state := b.locate(elem)
+	for i := uint(0); i < b.k; i++ {
+		pos := next(&state)
+		block[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// Check if an element is in the blocked bloomfilter
+func (b *Bloomfilter) Check(elem []byte) bool {
+	block, state := b.locate(elem)
+	for i := uint(0); i < b.k; i++ {
+		pos := next(&state)
+		if block[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Union of two blocked bloomfilters
+func (b *Bloomfilter) Union(that interface{}) (float64, error) {
+	other, ok := that.(*Bloomfilter)
+	if !ok {
+		return b.Capacity(), bloomfilter.ErrImpossibleToTreat
+	}
+
+	if b.blocks != other.blocks {
+		return b.Capacity(), fmt.Errorf("blocks1(%d) != blocks2(%d)", b.blocks, other.blocks)
+	}
+
+	if b.k != other.k {
+		return b.Capacity(), fmt.Errorf("k1(%d) != k2(%d)", b.k, other.k)
+	}
+
+	if b.cfg.HashName != other.cfg.HashName {
+		return b.Capacity(), fmt.Errorf("different hashers: %s is not %s", other.cfg.HashName, b.cfg.HashName)
+	}
+
+	if b.cfg.Seed != other.cfg.Seed {
+		return b.Capacity(), bbloomfilter.ErrDifferentSeeds
+	}
+
+	for i, w := range other.words {
+		b.words[i] |= w
+	}
+
+	return b.Capacity(), nil
+}
+
+// K returns the number of bits set per element
+func (b *Bloomfilter) K() uint {
+	return b.k
+}
+
+// M returns the number of bits of the blocked bloomfilter
+func (b *Bloomfilter) M() uint {
+	return b.blocks * BlockBits
+}
+
+// Capacity returns the fill degree of the blocked bloomfilter
+func (b *Bloomfilter) Capacity() float64 {
+	count := 0
+	for _, w := range b.words {
+		count += bits.OnesCount64(w)
+	}
+	return float64(count) / float64(b.M())
+}
+
+// SerializibleBloomfilter used when (de)serializing a blocked bloomfilter
+type SerializibleBloomfilter struct {
+	Words  []uint64
+	Blocks uint
+	K      uint
+	Cfg    bloomfilter.Config
+}
+
+// MarshalBinary serializes a blocked bloomfilter
+func (b *Bloomfilter) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(&SerializibleBloomfilter{
+		Words:  b.words,
+		Blocks: b.blocks,
+		K:      b.k,
+		Cfg:    b.cfg,
+	})
+
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary deserializes a blocked bloomfilter
+func (b *Bloomfilter) UnmarshalBinary(data []byte) error {
+	target := SerializibleBloomfilter{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&target); err != nil {
+		return err
+	}
+
+	if err := target.Cfg.Validate(); err != nil {
+		return err
+	}
+	if target.Blocks == 0 || target.K == 0 || target.K > BlockBits {
+		return fmt.Errorf("invalid number of blocks (%d) or k (%d)", target.Blocks, target.K)
+	}
+	if target.Blocks > math.MaxUint/blockWords {
+		return fmt.Errorf("too many blocks: %d", target.Blocks)
+	}
+	if blocks, k := Size(target.Cfg.N, target.Cfg.P); target.Blocks != blocks || target.K != k {
+		return fmt.Errorf("the number of blocks (%d) or k (%d) does not match the config (%d, %d)", target.Blocks, target.K, blocks, k)
+	}
+	if uint(len(target.Words)) != target.Blocks*blockWords {
+		return fmt.Errorf("%d words do not match %d blocks", len(target.Words), target.Blocks)
+	}
+
+	*b = Bloomfilter{
+		words:  target.Words,
+		blocks: target.Blocks,
+		k:      target.K,
+		cfg:    target.Cfg,
+	}
+
+	return b.setHashers()
+}
@@ -0,0 +1,209 @@
+package blocked
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestBloomfilter(t *testing.T) {
+	testutils.CallSet(t, New(testutils.TestCfg))
+	testutils.CallSet(t, New(testutils.TestCfg2))
+	testutils.CallSet(t, New(testutils.TestCfg3))
+}
+
+func TestBloomfilter_falsePositives(t *testing.T) {
+	for _, hashName := range []string{bloomfilter.HASHER_OPTIMAL, bloomfilter.HASHER_XXHASH64, bloomfilter.HASHER_DEFAULT} {
+		cfg := bloomfilter.Config{N: 10000, P: 0.001, HashName: hashName}
+		b := New(cfg)
+		for i := 0; i < int(cfg.N); i++ {
+			b.Add([]byte(fmt.Sprintf("elem-%d", i)))
+		}
+		for i := 0; i < int(cfg.N); i++ {
+			if elem := []byte(fmt.Sprintf("elem-%d", i)); !b.Check(elem) {
+				t.Errorf("%s: %s not found", hashName, elem)
+				break
+			}
+		}
+		falsePositives := 0
+		for i := 0; i < 100000; i++ {
+			if b.Check([]byte(fmt.Sprintf("other-%d", i))) {
+				falsePositives++
+			}
+		}
+		if p := float64(falsePositives) / 100000; p > 2*cfg.P {
+			t.Errorf("%s: unexpected false positive rate: %f", hashName, p)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	for _, tc := range []struct {
+		n uint
+		p float64
+	}{
+		{100, 0.001},
+		{10000, 0.01},
+		{1000000, 1e-6},
+	} {
+		blocks, k := Size(tc.n, tc.p)
+		if got := P(blocks, tc.n, k); got > tc.p {
+			t.Errorf("Size(%d, %g): unexpected false positive probability %g", tc.n, tc.p, got)
+		}
+		if blocks*BlockBits < bloomfilter.M(tc.n, tc.p) {
+			t.Errorf("Size(%d, %g): %d blocks are smaller than a classic bloomfilter", tc.n, tc.p, blocks)
+		}
+	}
+}
+
+func TestP(t *testing.T) {
+	if P(0, 10, 3) != 1 {
+		t.Error("an empty filter should always give false positives")
+	}
+	if P(10, 0, 3) != 0 {
+		t.Error("a filter without elements should never give false positives")
+	}
+	if blocks, k := Size(0, 0.01); blocks != 1 || k == 0 {
+		t.Errorf("unexpected size of a filter without elements: %d blocks, %d hashes", blocks, k)
+	}
+	if classic, corrected := bloomfilter.P(100*BlockBits, 5000, 7), P(100, 5000, 7); corrected <= classic {
+		t.Errorf("the corrected probability %g should be greater than the classic one %g", corrected, classic)
+	}
+}
+
+func TestBloomfilter_Union_ok(t *testing.T) {
+	set1 := New(testutils.TestCfg)
+	set2 := New(testutils.TestCfg)
+
+	testutils.CallSetUnion(t, set1, set2)
+}
+
+func TestBloomfilter_Union_ko(t *testing.T) {
+	set1 := New(testutils.TestCfg)
+
+	if _, err := set1.Union(24); err != bloomfilter.ErrImpossibleToTreat {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(testutils.TestCfg2)); err == nil || !strings.Contains(err.Error(), "blocks1") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(testutils.TestCfg3)); err == nil || !strings.Contains(err.Error(), "different hashers") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	cfg := testutils.TestCfg
+	cfg.Seed = 42
+	if _, err := set1.Union(New(cfg)); err != bbloomfilter.ErrDifferentSeeds {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestBloomfilter_binary(t *testing.T) {
+	b1 := New(testutils.TestCfg)
+	for i := 0; i < 100; i++ {
+		b1.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+
+	data, err := b1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	b2 := new(Bloomfilter)
+	if err := b2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if b2.K() != b1.K() || b2.M() != b1.M() {
+		t.Errorf("unexpected size: k %d, m %d", b2.K(), b2.M())
+	}
+	for i := 0; i < 100; i++ {
+		if elem := []byte(fmt.Sprintf("elem-%d", i)); !b2.Check(elem) {
+			t.Errorf("%s not found", elem)
+		}
+	}
+
+	if err := b2.UnmarshalBinary([]byte{}); err == nil {
+		t.Error("should have given error")
+	}
+}
+
+func TestBloomfilter_UnmarshalBinary_forged(t *testing.T) {
+	blocks, k := Size(testutils.TestCfg.N, testutils.TestCfg.P)
+	for name, target := range map[string]SerializibleBloomfilter{
+		"overflowing blocks": {Blocks: 1 << 61, K: k, Cfg: testutils.TestCfg},
+		"blocks mismatch":    {Blocks: blocks + 1, K: k, Words: make([]uint64, (blocks+1)*blockWords), Cfg: testutils.TestCfg},
+		"k mismatch":         {Blocks: blocks, K: k + 1, Words: make([]uint64, blocks*blockWords), Cfg: testutils.TestCfg},
+	} {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&target); err != nil {
+			t.Errorf("%s: unexpected error, %v", name, err)
+			continue
+		}
+		if err := new(Bloomfilter).UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("%s: the forged payload was accepted", name)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	if _, err := Build(bloomfilter.Config{N: 100, P: 2, HashName: bloomfilter.HASHER_OPTIMAL}); !errors.Is(err, bloomfilter.ErrInvalidP) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := Build(testutils.TestCfg); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+type set interface {
+	Add([]byte)
+	Check([]byte) bool
+}
+
+// BenchmarkCheck compares the lookups of the blocked and the classic bloomfilters. The 100M scale
+// matches the example of the README and needs a few GB of RAM, so it is skipped in short mode
+func BenchmarkCheck(b *testing.B) {
+	for _, n := range []uint{1000000, 100000000} {
+		if n > 1000000 && testing.Short() {
+			continue
+		}
+		cfg := bloomfilter.Config{N: n, P: 1e-9, HashName: bloomfilter.HASHER_XXHASH64}
+		for _, impl := range []struct {
+			name string
+			new  func() set
+		}{
+			{"bbloomfilter", func() set { return bbloomfilter.New(cfg) }},
+			{"blocked", func() set { return New(cfg) }},
+		} {
+			s := impl.new()
+			// a sample of elements is enough to touch every memory page of the filter
+			sample := make([][]byte, 1<<20)
+			for i := range sample {
+				sample[i] = []byte(fmt.Sprintf("elem-%d", i))
+				s.Add(sample[i])
+			}
+			missing := make([][]byte, len(sample))
+			for i := range missing {
+				missing[i] = []byte(fmt.Sprintf("other-%d", i))
+			}
+
+			b.Run(fmt.Sprintf("%s/%dM/present", impl.name, n/1000000), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					s.Check(sample[i&(len(sample)-1)])
+				}
+			})
+			b.Run(fmt.Sprintf("%s/%dM/missing", impl.name, n/1000000), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					s.Check(missing[i&(len(missing)-1)])
+				}
+			})
+		}
+	}
+}
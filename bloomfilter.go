@@ -5,7 +5,11 @@
 // and rpc bloomfilter implementation.
 package bloomfilter
 
-import "math"
+import (
+	"errors"
+	"fmt"
+	"math"
+)
 
 // Bloomfilter interface implemented in the different packages
 type Bloomfilter interface {
@@ -15,14 +19,53 @@ type Bloomfilter interface {
 }
 
 // Config for bloomfilter defining the parameters:
-// P - desired false positive probability, N - number of elements to be stored in the filter and
-// HashName - the name of the particular hashfunction
+// P - desired false positive probability, N - number of elements to be stored in the filter,
+// HashName - the name of the particular hashfunction and Seed - the secret keying the hashfunction
+// so the bit positions of an element can not be predicted without it
 type Config struct {
 	N        uint    `json:"n"`
 	P        float64 `json:"p"`
 	HashName string  `json:"hash_name"`
+	Seed     uint64  `json:"seed,omitempty"`
 }
 
+// Validate checks the config can be used to build a bloomfilter. The returned error is a *ConfigError
+func (c Config) Validate() error {
+	if c.N == 0 {
+		return &ConfigError{Field: "n", Err: ErrInvalidN}
+	}
+	if math.IsNaN(c.P) || c.P <= 0 || c.P >= 1 {
+		return &ConfigError{Field: "p", Err: ErrInvalidP}
+	}
+	if _, err := HashFactoryByName(c.HashName); err != nil {
+		return &ConfigError{Field: "hash_name", Err: err}
+	}
+	return nil
+}
+
+// ConfigError describes the invalid parameter of a config
+type ConfigError struct {
+	Field string
+	Err   error
+}
+
+// Error implements the error interface
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid bloomfilter config, %s: %s", e.Field, e.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// ErrInvalidN is returned when the number of elements is zero
+	ErrInvalidN = errors.New("the number of elements must be greater than 0")
+	// ErrInvalidP is returned when the false positive probability is not in the (0, 1) interval
+	ErrInvalidP = errors.New("the false positive probability must be greater than 0 and lower than 1")
+)
+
 // EmptyConfig configuration used for first empty `previous` bloomfilter in the sliding three bloomfilters
 var EmptyConfig = Config{
 	N: 2,
@@ -39,6 +82,29 @@ func K(m, n uint) uint {
 	return uint(math.Ceil(math.Log(2.0) * float64(m) / float64(n)))
 }
 
+// P function computes the expected false positive probability of a bloomfilter of m bits and k hashfunctions
+// storing n elements
+func P(m, n, k uint) float64 {
+	if m == 0 {
+		return 1
+	}
+	return math.Pow(1-math.Exp(-float64(k)*float64(n)/float64(m)), float64(k))
+}
+
+// MaxN function computes the maximum number of elements a bloomfilter of the given size in bytes can store
+// keeping the false positive probability p. It returns 0 when p is not in the (0, 1) interval
+func MaxN(bytes uint, p float64) uint {
+	if math.IsNaN(p) || p <= 0 || p >= 1 {
+		return 0
+	}
+	m := bytes * 8
+	n := uint(float64(m) * math.Pow(math.Log(2.0), 2) / -math.Log(p))
+	for n > 0 && M(n, p) > m {
+		n--
+	}
+	return n
+}
+
 // EmptySet type is a synonym of int
 type EmptySet int
 
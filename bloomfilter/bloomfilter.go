@@ -4,53 +4,170 @@
 // following operations: add an element to the bloomfilter, check the existence of an element
 // in the bloomfilter, the union of two bloomfilters, along with the serialization and
 // deserialization of a bloomfilter: http://llimllib.github.io/bloomfilter-tutorial/
+//
+// The serialized bloomfilters follow a versioned binary format, readable from any language and
+// protected by a CRC32C checksum. The legacy gob payloads are still accepted when deserializing.
+//
+// Bloomfilters created with NewConcurrent can be used from several goroutines at the same time: bits
+// are set with atomic operations over 64 bit words and read with atomic loads.
 package bbloomfilter
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+	"sync/atomic"
 
 	"github.com/krakendio/bloomfilter/v2"
 	"github.com/tmthrgd/go-bitset"
 )
 
+// ErrDifferentSeeds is returned when merging filters keyed with different seeds
+var ErrDifferentSeeds = errors.New("different seeds")
+
 // Bloomfilter basic type
 type Bloomfilter struct {
-	bs  bitset.Bitset
-	m   uint
-	k   uint
-	h   []bloomfilter.Hash
-	cfg bloomfilter.Config
+	words      []uint64
+	m          uint
+	k          uint
+	h          []bloomfilter.AppendHash
+	bufs       *sync.Pool
+	h128       bloomfilter.Hash128
+	index      bloomfilter.IndexFunc
+	cfg        bloomfilter.Config
+	concurrent bool
+}
+
+// Build validates the config before creating a new bloomfilter
+func Build(cfg bloomfilter.Config) (*Bloomfilter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return New(cfg), nil
 }
 
-// New creates a new bloomfilter from a given config
+// New creates a new bloomfilter from a given config. It panics if the config has an unknown hash name,
+// use Build to get an error instead
 func New(cfg bloomfilter.Config) *Bloomfilter {
 	m := bloomfilter.M(cfg.N, cfg.P)
 	k := bloomfilter.K(m, cfg.N)
-	return &Bloomfilter{
-		m:   m,
-		k:   k,
-		h:   bloomfilter.HashFactoryNames[cfg.HashName](k),
-		bs:  bitset.New(m),
-		cfg: cfg,
+	b := &Bloomfilter{
+		m:     m,
+		k:     k,
+		words: make([]uint64, (m+63)/64),
+		cfg:   cfg,
+	}
+	if err := b.setHashers(); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// BuildConcurrent validates the config before creating a new concurrent-safe bloomfilter
+func BuildConcurrent(cfg bloomfilter.Config) (*Bloomfilter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return NewConcurrent(cfg), nil
+}
+
+// NewConcurrent creates a new bloomfilter safe for concurrent use without any lock. It panics if the
+// config has an unknown hash name, use BuildConcurrent to get an error instead
+func NewConcurrent(cfg bloomfilter.Config) *Bloomfilter {
+	b := New(cfg)
+	b.concurrent = true
+	return b
+}
+
+// Concurrent returns true if the bloomfilter is safe for concurrent use
+func (b *Bloomfilter) Concurrent() bool {
+	return b.concurrent
+}
+
+func (b *Bloomfilter) set(i uint) {
+	w, mask := &b.words[i/64], uint64(1)<<(i%64)
+	if !b.concurrent {
+		*w |= mask
+		return
+	}
+	orUint64(w, mask)
+}
+
+func (b *Bloomfilter) isSet(i uint) bool {
+	mask := uint64(1) << (i % 64)
+	if !b.concurrent {
+		return b.words[i/64]&mask != 0
+	}
+	return atomic.LoadUint64(&b.words[i/64])&mask != 0
+}
+
+// orUint64 atomically sets the bits of the mask in the word. The CAS is skipped when the bits are
+// already set, which is the common case in a loaded filter
+func orUint64(w *uint64, mask uint64) {
+	for {
+		old := atomic.LoadUint64(w)
+		if old&mask == mask || atomic.CompareAndSwapUint64(w, old, old|mask) {
+			return
+		}
+	}
+}
+
+func (b *Bloomfilter) setHashers() error {
+	h, err := bloomfilter.SeededAppendHashes(b.cfg.HashName, b.k, b.cfg.Seed)
+	if err != nil {
+		return err
+	}
+	b.h = h
+	b.bufs = &sync.Pool{
+		New: func() interface{} { return new([]uint) },
 	}
+	b.h128, b.index, _ = bloomfilter.Hash128ByName(b.cfg.HashName)
+	return nil
 }
 
 // Add an element to bloomfilter
-func (b Bloomfilter) Add(elem []byte) {
+func (b *Bloomfilter) Add(elem []byte) {
+	if b.h128 != nil {
+		h1, h2 := b.h128(elem, b.cfg.Seed)
+		for i := uint(0); i < b.k; i++ {
+			b.set(b.index(h1, h2, i) % b.m)
+		}
+		return
+	}
+
+	buf := b.bufs.Get().(*[]uint)
 	for _, h := range b.h {
-		for _, x := range h(elem) {
-			b.bs.Set(x % b.m)
+		*buf = h((*buf)[:0], elem)
+		for _, x := range *buf {
+			b.set(x % b.m)
 		}
 	}
+	b.bufs.Put(buf)
 }
 
 // Check if an element is in the bloomfilter
-func (b Bloomfilter) Check(elem []byte) bool {
+func (b *Bloomfilter) Check(elem []byte) bool {
+	if b.h128 != nil {
+		h1, h2 := b.h128(elem, b.cfg.Seed)
+		for i := uint(0); i < b.k; i++ {
+			if !b.isSet(b.index(h1, h2, i) % b.m) {
+				return false
+			}
+		}
+		return true
+	}
+
+	buf := b.bufs.Get().(*[]uint)
+	defer b.bufs.Put(buf)
 	for _, h := range b.h {
-		for _, x := range h(elem) {
-			if !b.bs.IsSet(x % b.m) {
+		*buf = h((*buf)[:0], elem)
+		for _, x := range *buf {
+			if !b.isSet(x % b.m) {
 				return false
 			}
 		}
@@ -58,7 +175,8 @@ func (b Bloomfilter) Check(elem []byte) bool {
 	return true
 }
 
-// Union of two bloomfilters
+// Union of two bloomfilters. When any of them is concurrent-safe, the words are read and merged with
+// atomic operations, so it can run along with other adds and checks
 func (b *Bloomfilter) Union(that interface{}) (float64, error) {
 	other, ok := that.(*Bloomfilter)
 	if !ok {
@@ -77,60 +195,176 @@ func (b *Bloomfilter) Union(that interface{}) (float64, error) {
 		return b.Capacity(), fmt.Errorf("different hashers: %s is not %s", other.cfg.HashName, b.cfg.HashName)
 	}
 
-	b.bs.Union(b.bs, other.bs)
+	if b.cfg.Seed != other.cfg.Seed {
+		return b.Capacity(), ErrDifferentSeeds
+	}
+
+	if !b.concurrent && !other.concurrent {
+		for i, w := range other.words {
+			b.words[i] |= w
+		}
+		return b.Capacity(), nil
+	}
+
+	for i := range other.words {
+		if w := other.load(i); w != 0 {
+			if b.concurrent {
+				orUint64(&b.words[i], w)
+			} else {
+				b.words[i] |= w
+			}
+		}
+	}
 
 	return b.Capacity(), nil
 }
 
-// SerializibleBloomfilter used when (de)serializing a bloomfilter
+func (b *Bloomfilter) load(i int) uint64 {
+	if !b.concurrent {
+		return b.words[i]
+	}
+	return atomic.LoadUint64(&b.words[i])
+}
+
+// SerializibleBloomfilter is the legacy gob representation of a bloomfilter. MarshalBinary does not
+// use it anymore, but UnmarshalBinary still accepts it so the stored snapshots can be restored
 type SerializibleBloomfilter struct {
-	BS       bitset.Bitset
-	M        uint
-	K        uint
-	HashName string
-	Cfg      bloomfilter.Config
+	BS         bitset.Bitset
+	M          uint
+	K          uint
+	HashName   string
+	Cfg        bloomfilter.Config
+	Concurrent bool
 }
 
-// MarshalBinary serializes a bloomfilter
+// MarshalBinary serializes a bloomfilter in the versioned binary format described in this package
 func (b *Bloomfilter) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := gob.NewEncoder(buf).Encode(&SerializibleBloomfilter{
-		BS:       b.bs,
-		M:        b.m,
-		K:        b.k,
-		HashName: b.cfg.HashName,
-		Cfg:      b.cfg,
-	})
-	//zip buf.Bytes
+	buf := bytes.NewBuffer(make([]byte, 0, b.BinarySize()))
+	err := b.encode(buf)
 
 	return buf.Bytes(), err
 }
 
-// UnmarshalBinary deserializes a bloomfilter
+// UnmarshalBinary deserializes a bloomfilter, either in the binary format or in the legacy gob one. The
+// checksum and the parameters of the bloomfilter are verified, so a corrupted payload returns an error
+// instead of a bloomfilter failing on its first use
 func (b *Bloomfilter) UnmarshalBinary(data []byte) error {
-	//unzip data
-	buf := bytes.NewBuffer(data)
-	target := SerializibleBloomfilter{}
+	if !isFormat(data) {
+		return b.unmarshalGob(data)
+	}
 
-	if err := gob.NewDecoder(buf).Decode(&target); err != nil {
+	r := bytes.NewReader(data)
+	if err := b.decode(r); err != nil {
 		return err
 	}
+	if r.Len() > 0 {
+		return fmt.Errorf("%d bytes of trailing data", r.Len())
+	}
+	return nil
+}
+
+// WriteTo streams the bloomfilter to w in the binary format, without building the whole payload in memory
+func (b *Bloomfilter) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := b.encode(cw)
+	return cw.n, err
+}
+
+// ReadFrom reads a bloomfilter from r, consuming just the bytes of the serialized bloomfilter. Payloads
+// in the legacy gob format are read until the end of r
+func (b *Bloomfilter) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	magic := make([]byte, len(formatMagic))
+	if _, err := io.ReadFull(cr, magic); err != nil {
+		return cr.n, unexpectedEOF(err)
+	}
+	if !isFormat(magic) {
+		data, err := io.ReadAll(cr)
+		if err != nil {
+			return cr.n, err
+		}
+		return cr.n, b.unmarshalGob(append(magic, data...))
+	}
+
+	err := b.decode(io.MultiReader(bytes.NewReader(magic), cr))
+	return cr.n, err
+}
+
+// BinarySize returns the size in bytes of the serialized bloomfilter
+func (b *Bloomfilter) BinarySize() int {
+	return binarySize(uint64(len(b.words)), b.cfg.HashName)
+}
+
+// ConfigBinarySize returns the size in bytes of a serialized bloomfilter built with the config
+func ConfigBinarySize(cfg bloomfilter.Config) int {
+	return binarySize((uint64(bloomfilter.M(cfg.N, cfg.P))+63)/64, cfg.HashName)
+}
+
+func binarySize(words uint64, hashName string) int {
+	size := formatHeaderSize + 8*int(words) + 4
+	if _, ok := HashID(hashName); !ok {
+		size += 2 + len(hashName)
+	}
+	return size
+}
+
+func (b *Bloomfilter) unmarshalGob(data []byte) error {
+	target := SerializibleBloomfilter{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&target); err != nil {
+		return err
+	}
+	if uint(len(target.BS)) != (target.M+7)/8 {
+		return fmt.Errorf("%w: %d bytes do not match m (%d)", ErrInvalidPayload, len(target.BS), target.M)
+	}
+
+	words := make([]uint64, (target.M+63)/64)
+	var word [8]byte
+	for i := range words {
+		word = [8]byte{}
+		copy(word[:], target.BS[i*8:])
+		words[i] = binary.LittleEndian.Uint64(word[:])
+	}
+
 	*b = Bloomfilter{
-		bs:  target.BS,
-		m:   target.M,
-		k:   target.K,
-		h:   bloomfilter.HashFactoryNames[target.HashName](target.K),
-		cfg: target.Cfg,
+		words:      words,
+		m:          target.M,
+		k:          target.K,
+		cfg:        target.Cfg,
+		concurrent: target.Concurrent,
 	}
 
-	return nil
+	return b.restore()
 }
 
-// Capacity returns the fill degree of the bloomfilter
-func (b *Bloomfilter) Capacity() float64 {
-	return float64(b.bs.Count()) / float64(b.m)
+// K returns the number of bit positions actually computed for every element. It matches the k derived
+// from the config unless the hash factory yields a different number of indices, like the default one
+func (b *Bloomfilter) K() uint {
+	if b.h128 != nil {
+		return b.k
+	}
+
+	k := uint(0)
+	for _, h := range b.h {
+		k += uint(len(h(nil, nil)))
+	}
+	return k
+}
+
+// Config returns the config the bloomfilter was created with
+func (b *Bloomfilter) Config() bloomfilter.Config {
+	return b.cfg
 }
 
-func (b *Bloomfilter) hashFactoryNameK(hashName string) []bloomfilter.Hash {
-	return bloomfilter.HashFactoryNames[hashName](b.k)
+// M returns the number of bits of the bloomfilter
+func (b *Bloomfilter) M() uint {
+	return b.m
+}
+
+// Capacity returns the fill degree of the bloomfilter
+func (b *Bloomfilter) Capacity() float64 {
+	count := 0
+	for i := range b.words {
+		count += bits.OnesCount64(b.load(i))
+	}
+	return float64(count) / float64(b.m)
 }
@@ -2,18 +2,413 @@ package bbloomfilter
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/krakendio/bloomfilter/v2"
 	"github.com/krakendio/bloomfilter/v2/testutils"
+	"github.com/tmthrgd/go-bitset"
 )
 
 func TestBloomfilter(t *testing.T) {
 	testutils.CallSet(t, New(testutils.TestCfg))
 }
 
+func TestBloomfilter_concurrentAdd(t *testing.T) {
+	for _, name := range []string{
+		bloomfilter.HASHER_DEFAULT,
+		bloomfilter.HASHER_OPTIMAL,
+		bloomfilter.HASHER_ENHANCED,
+	} {
+		for _, seed := range []uint64{0, 42} {
+			cfg := testutils.TestCfg
+			cfg.N = 2000
+			cfg.HashName = name
+			cfg.Seed = seed
+			testutils.CallConcurrentAdd(t, NewConcurrent(cfg))
+		}
+	}
+}
+
+func TestBloomfilter_concurrentUnion(t *testing.T) {
+	set1 := NewConcurrent(testutils.TestCfg)
+	set2 := NewConcurrent(testutils.TestCfg)
+	set2.Add([]byte{1, 2, 3})
+
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				set1.Add([]byte(fmt.Sprintf("elem-%d-%d", g, i)))
+				set1.Check([]byte{1, 2, 3})
+				set2.Add([]byte(fmt.Sprintf("other-%d-%d", g, i)))
+			}
+		}(g)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := set1.Union(set2); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+		}
+	}
+	wg.Wait()
+
+	if !set1.Check([]byte{1, 2, 3}) {
+		t.Error("failed check after the union")
+	}
+}
+
+func TestBloomfilter_legacyBitset(t *testing.T) {
+	set1 := New(testutils.TestCfg)
+	bs := bitset.New(set1.m)
+	for _, i := range []uint{0, 7, 8, 63, 64, 100, set1.m - 1} {
+		bs.Set(i)
+		set1.set(i)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(&SerializibleBloomfilter{BS: bs, M: set1.m, K: set1.k, Cfg: set1.cfg}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	set2 := new(Bloomfilter)
+	if err := set2.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !reflect.DeepEqual(set1.words, set2.words) || set2.Concurrent() {
+		t.Error("the bitset was not decoded properly")
+	}
+}
+
+func TestBloomfilter_binaryFormat(t *testing.T) {
+	cfg := testutils.TestCfg
+	cfg.Seed = 42
+	set1 := NewConcurrent(cfg)
+	for _, i := range []uint{0, 65, set1.m - 1} {
+		set1.set(i)
+	}
+
+	data, err := set1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if len(data) != formatHeaderSize+8*len(set1.words)+4 {
+		t.Errorf("unexpected size %d", len(data))
+	}
+	if string(data[:4]) != "KBF1" || data[4] != FormatVersion || data[5] != flagConcurrent || data[6] != 2 {
+		t.Errorf("unexpected header % x", data[:8])
+	}
+	if m := binary.LittleEndian.Uint64(data[8:]); m != uint64(set1.m) {
+		t.Errorf("unexpected m %d", m)
+	}
+	if seed := binary.LittleEndian.Uint64(data[24:]); seed != 42 {
+		t.Errorf("unexpected seed %d", seed)
+	}
+	if w := binary.LittleEndian.Uint64(data[formatHeaderSize+8:]); w != 2 {
+		t.Errorf("unexpected second word %x", w)
+	}
+	if sum := crc32.Checksum(data[:len(data)-4], crc32.MakeTable(crc32.Castagnoli)); sum != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		t.Error("unexpected checksum")
+	}
+
+	set2 := new(Bloomfilter)
+	if err := set2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !reflect.DeepEqual(set1.words, set2.words) || set2.m != set1.m || set2.k != set1.k || set2.cfg != set1.cfg || !set2.Concurrent() {
+		t.Error("the bloomfilter was not decoded properly")
+	}
+}
+
+// customHashes numbers the hashes registered by the tests, as the registry can not be cleaned from this
+// package and the tests can run many times in the same process
+var customHashes uint32
+
+func TestBloomfilter_binaryFormat_customHash(t *testing.T) {
+	name := fmt.Sprintf("binary-format-test-%d", atomic.AddUint32(&customHashes, 1))
+	if err := bloomfilter.RegisterHash128(name, bloomfilter.XXHash64Sum); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	cfg := testutils.TestCfg
+	cfg.HashName = name
+	set1 := New(cfg)
+	set1.Add([]byte{1, 2, 3})
+
+	data, err := set1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if data[6] != 0 || string(data[formatHeaderSize+2:formatHeaderSize+2+len(name)]) != name {
+		t.Errorf("the hash name was not stored: % x", data[:formatHeaderSize+2+len(name)])
+	}
+
+	set2 := new(Bloomfilter)
+	if err := set2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if set2.cfg.HashName != name || !set2.Check([]byte{1, 2, 3}) {
+		t.Error("the bloomfilter was not decoded properly")
+	}
+}
+
+func TestBloomfilter_binaryFormat_ko(t *testing.T) {
+	set1 := New(testutils.TestCfg)
+	set1.Add([]byte{1, 2, 3})
+	data, err := set1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[formatHeaderSize] ^= 1
+	if err := new(Bloomfilter).UnmarshalBinary(corrupted); err != ErrBadChecksum {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	version := append([]byte{}, data...)
+	version[4] = FormatVersion + 1
+	if err := new(Bloomfilter).UnmarshalBinary(version); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	if err := new(Bloomfilter).UnmarshalBinary(data[:len(data)-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	if err := new(Bloomfilter).UnmarshalBinary(append(data, 0)); err == nil || !strings.Contains(err.Error(), "trailing data") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestBloomfilter_UnmarshalBinary_invalid(t *testing.T) {
+	set1 := New(testutils.TestCfg)
+	data, err := set1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	for name, corrupt := range map[string]func([]byte){
+		"k is 0":              func(d []byte) { binary.LittleEndian.PutUint64(d[16:], 0) },
+		"k out of range":      func(d []byte) { binary.LittleEndian.PutUint64(d[16:], 1<<20) },
+		"unknown hash":        func(d []byte) { d[6] = 200 },
+		"invalid p":           func(d []byte) { binary.LittleEndian.PutUint64(d[40:], math.Float64bits(2)) },
+		"bits set beyond m":   func(d []byte) { d[len(d)-5] = 0xff },
+		"invalid n":           func(d []byte) { binary.LittleEndian.PutUint64(d[32:], 0) },
+		"unsupported version": func(d []byte) { d[4] = 0 },
+	} {
+		payload := append([]byte{}, data...)
+		corrupt(payload)
+		binary.LittleEndian.PutUint32(payload[len(payload)-4:], crc32.Checksum(payload[:len(payload)-4], crc32.MakeTable(crc32.Castagnoli)))
+		if err := new(Bloomfilter).UnmarshalBinary(payload); err == nil {
+			t.Errorf("%s: should have given error", name)
+		}
+	}
+
+	// the header is checked before reading the words, so a forged m does not allocate them
+	for name, corrupt := range map[string]func([]byte){
+		"huge m":     func(d []byte) { binary.LittleEndian.PutUint64(d[8:], 1<<50) },
+		"m mismatch": func(d []byte) { binary.LittleEndian.PutUint64(d[8:], uint64(set1.m)+64) },
+		"k mismatch": func(d []byte) { binary.LittleEndian.PutUint64(d[16:], uint64(set1.k)+1) },
+		"huge n":     func(d []byte) { binary.LittleEndian.PutUint64(d[32:], 1<<50) },
+	} {
+		header := append([]byte{}, data[:formatHeaderSize]...)
+		corrupt(header)
+		if err := new(Bloomfilter).UnmarshalBinary(header); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: unexpected error, %v", name, err)
+		}
+	}
+
+	for name, target := range map[string]SerializibleBloomfilter{
+		"m mismatch":   {BS: bitset.New(set1.m), M: set1.m + 8, K: set1.k, Cfg: set1.cfg},
+		"k mismatch":   {BS: bitset.New(set1.m), M: set1.m, K: set1.k + 1, Cfg: set1.cfg},
+		"k is 0":       {BS: bitset.New(set1.m), M: set1.m, Cfg: set1.cfg},
+		"unknown hash": {BS: bitset.New(set1.m), M: set1.m, K: set1.k, Cfg: bloomfilter.Config{N: 100, P: 0.01, HashName: "unknown"}},
+	} {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&target); err != nil {
+			t.Errorf("%s: unexpected error, %v", name, err)
+			continue
+		}
+		if err := new(Bloomfilter).UnmarshalBinary(buf.Bytes()); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: unexpected error, %v", name, err)
+		}
+	}
+}
+
+func FuzzBloomfilter_UnmarshalBinary(f *testing.F) {
+	for _, cfg := range []bloomfilter.Config{testutils.TestCfg, testutils.TestCfg3} {
+		set := New(cfg)
+		set.Add([]byte{1, 2, 3})
+		data, err := set.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&SerializibleBloomfilter{BS: bitset.New(set.m), M: set.m, K: set.k, Cfg: cfg}); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		set := new(Bloomfilter)
+		if err := set.UnmarshalBinary(data); err != nil {
+			return
+		}
+		set.Add([]byte{1, 2, 3})
+		if !set.Check([]byte{1, 2, 3}) {
+			t.Error("failed check after decoding")
+		}
+		if _, err := set.MarshalBinary(); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+		}
+	})
+}
+
+func TestBloomfilter_WriteTo(t *testing.T) {
+	set1 := New(testutils.TestCfg)
+	set1.Add([]byte{1, 2, 3})
+	set2 := NewConcurrent(testutils.TestCfg3)
+	set2.Add([]byte{4, 5, 6})
+
+	buf := new(bytes.Buffer)
+	for _, set := range []*Bloomfilter{set1, set2} {
+		n, err := set.WriteTo(buf)
+		if err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+		if n != int64(set.BinarySize()) {
+			t.Errorf("unexpected size %d, want %d", n, set.BinarySize())
+		}
+	}
+	total := int64(buf.Len())
+
+	set3, set4 := new(Bloomfilter), new(Bloomfilter)
+	n3, err := set3.ReadFrom(buf)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	n4, err := set4.ReadFrom(buf)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if n3+n4 != total || buf.Len() != 0 {
+		t.Errorf("unexpected bytes read: %d + %d of %d", n3, n4, total)
+	}
+	if !set3.Check([]byte{1, 2, 3}) || !set4.Check([]byte{4, 5, 6}) || set3.Concurrent() || !set4.Concurrent() {
+		t.Error("the bloomfilters were not streamed properly")
+	}
+
+	legacy := new(bytes.Buffer)
+	if err := gob.NewEncoder(legacy).Encode(&SerializibleBloomfilter{BS: bitset.New(set1.m), M: set1.m, K: set1.k, Cfg: set1.cfg}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if _, err := new(Bloomfilter).ReadFrom(legacy); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestBloomfilter_hashers(t *testing.T) {
+	for _, name := range []string{
+		bloomfilter.HASHER_DEFAULT,
+		bloomfilter.HASHER_OPTIMAL,
+		bloomfilter.HASHER_XXHASH64,
+		bloomfilter.HASHER_MURMUR3,
+		bloomfilter.HASHER_SIPHASH,
+		bloomfilter.HASHER_ENHANCED,
+	} {
+		cfg := testutils.TestCfg
+		cfg.HashName = name
+		testutils.CallSet(t, New(cfg))
+	}
+}
+
+func TestBloomfilter_concurrentCheck(t *testing.T) {
+	for _, name := range []string{
+		bloomfilter.HASHER_DEFAULT,
+		bloomfilter.HASHER_OPTIMAL,
+		bloomfilter.HASHER_XXHASH64,
+	} {
+		cfg := testutils.TestCfg
+		cfg.HashName = name
+		testutils.CallConcurrentCheck(t, New(cfg))
+	}
+}
+
+func TestBloomfilter_Check_allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the allocations are not counted with the race detector")
+	}
+	for _, name := range []string{
+		bloomfilter.HASHER_DEFAULT,
+		bloomfilter.HASHER_OPTIMAL,
+		bloomfilter.HASHER_ENHANCED,
+	} {
+		for _, seed := range []uint64{0, 42} {
+			cfg := testutils.TestCfg
+			cfg.HashName = name
+			cfg.Seed = seed
+			bf := NewConcurrent(cfg)
+			elem := []byte("casa")
+			bf.Add(elem)
+			if n := testing.AllocsPerRun(100, func() { bf.Add(elem) }); n != 0 {
+				t.Errorf("%s (seed %d): %v allocations per add", name, seed, n)
+			}
+			if n := testing.AllocsPerRun(100, func() { bf.Check(elem) }); n != 0 {
+				t.Errorf("%s (seed %d): %v allocations per check", name, seed, n)
+			}
+		}
+	}
+}
+
+func BenchmarkBloomfilter_Add(b *testing.B) {
+	for _, name := range []string{
+		bloomfilter.HASHER_DEFAULT,
+		bloomfilter.HASHER_OPTIMAL,
+		bloomfilter.HASHER_ENHANCED,
+	} {
+		b.Run(name, func(b *testing.B) {
+			cfg := testutils.TestCfg
+			cfg.HashName = name
+			bf := NewConcurrent(cfg)
+			elem := []byte("casa")
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					bf.Add(elem)
+					bf.Check(elem)
+				}
+			})
+		})
+	}
+}
+
 func TestBloomfilter_Union_ok(t *testing.T) {
 	set1 := New(testutils.TestCfg)
 	set2 := New(testutils.TestCfg)
@@ -81,3 +476,75 @@ func TestUnmarshalBinary_ko(t *testing.T) {
 		t.Error("should have given error")
 	}
 }
+
+func TestBloomfilter_seed(t *testing.T) {
+	for _, name := range []string{bloomfilter.HASHER_DEFAULT, bloomfilter.HASHER_OPTIMAL, bloomfilter.HASHER_SIPHASH} {
+		cfg := testutils.TestCfg
+		cfg.HashName = name
+		cfg.Seed = 42
+		set1 := New(cfg)
+		testutils.CallSet(t, set1)
+
+		cfg.Seed = 43
+		set2 := New(cfg)
+		set2.Add([]byte{1, 2, 3})
+		if reflect.DeepEqual(set1.words, set2.words) {
+			t.Errorf("%s: the seed does not change the bit positions", name)
+		}
+
+		if _, err := set1.Union(set2); err != ErrDifferentSeeds {
+			t.Errorf("%s: unexpected error, %v", name, err)
+		}
+
+		data, err := set1.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: unexpected error, %v", name, err)
+			continue
+		}
+		set3 := new(Bloomfilter)
+		if err := set3.UnmarshalBinary(data); err != nil {
+			t.Errorf("%s: unexpected error, %v", name, err)
+			continue
+		}
+		if set3.cfg.Seed != 42 || !set3.Check([]byte{1, 2, 3}) {
+			t.Errorf("%s: seed not restored", name)
+		}
+	}
+}
+
+func TestBloomfilter_K(t *testing.T) {
+	cfg := bloomfilter.Config{N: 100, P: 1e-7, HashName: bloomfilter.HASHER_DEFAULT}
+	bf := New(cfg)
+	// md5 (2) + crc64 (1) + sha1 (2) + fnv64 (1) + fnv128 (2)
+	if k := bf.K(); k != 8 {
+		t.Errorf("unexpected effective k for the default hasher: %d", k)
+	}
+
+	cfg.HashName = bloomfilter.HASHER_ENHANCED
+	bf = New(cfg)
+	if want := bloomfilter.K(bf.M(), cfg.N); bf.K() != want {
+		t.Errorf("unexpected effective k for the enhanced hasher: got %d, want %d", bf.K(), want)
+	}
+	bf.Add([]byte{1, 2, 3})
+	if count := uint(math.Round(bf.Capacity() * float64(bf.M()))); count > bf.K() || count < bf.K()-1 {
+		t.Errorf("unexpected number of bits set: %d", count)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	if _, err := Build(testutils.TestCfg); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	cfg := testutils.TestCfg
+	cfg.N = 0
+	if _, err := Build(cfg); !errors.Is(err, bloomfilter.ErrInvalidN) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cfg = testutils.TestCfg
+	cfg.HashName = "unknown"
+	if _, err := Build(cfg); !errors.Is(err, bloomfilter.ErrUnknownHashFactory) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
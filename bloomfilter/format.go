@@ -0,0 +1,298 @@
+package bbloomfilter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/krakendio/bloomfilter/v2"
+)
+
+// The binary format of a bloomfilter is language neutral. All the integers are little endian:
+//
+//	offset  size  field
+//	0       4     magic "KBF1"
+//	4       1     version, currently 1
+//	5       1     flags, bit 0 set for concurrent-safe filters
+//	6       1     hash id, see HashID. 0 for a hash registered by the user
+//	7       1     reserved, 0
+//	8       8     m, number of bits
+//	16      8     k, number of hash functions
+//	24      8     seed
+//	32      8     n, from the config
+//	40      8     p, from the config, as IEEE 754 binary64
+//	48      2     length l of the hash name, only present when the hash id is 0
+//	50      l     hash name, only present when the hash id is 0
+//	...     8*w   the w = ceil(m/64) words of the bit array. Bit i is the bit i%64 of the word i/64
+//	...     4     CRC32C (Castagnoli) of all the previous bytes
+const (
+	// FormatVersion is the version of the binary format written by MarshalBinary
+	FormatVersion = 1
+
+	formatMagic      = "KBF1"
+	formatHeaderSize = 48
+	flagConcurrent   = 1 << 0
+
+	// maxK bounds the number of hash functions of a deserialized bloomfilter, since every index is
+	// computed on each add and check
+	maxK = 1 << 10
+	// maxPrealloc is the max number of words allocated before reading them (64 MB)
+	maxPrealloc = 8 << 20
+)
+
+var (
+	// ErrBadChecksum is returned when the checksum of a serialized bloomfilter does not match its content
+	ErrBadChecksum = errors.New("bad checksum")
+	// ErrUnsupportedVersion is returned when decoding a format version unknown to this package
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+	// ErrInvalidPayload is returned when a serialized bloomfilter is well formed but describes an unusable one
+	ErrInvalidPayload = errors.New("invalid serialized bloomfilter")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+	hashIDs = map[string]uint8{
+		bloomfilter.HASHER_DEFAULT:  1,
+		bloomfilter.HASHER_OPTIMAL:  2,
+		bloomfilter.HASHER_XXHASH64: 3,
+		bloomfilter.HASHER_MURMUR3:  4,
+		bloomfilter.HASHER_SIPHASH:  5,
+		bloomfilter.HASHER_ENHANCED: 6,
+	}
+	hashNames = func() map[uint8]string {
+		names := make(map[uint8]string, len(hashIDs))
+		for name, id := range hashIDs {
+			names[id] = name
+		}
+		return names
+	}()
+)
+
+// HashID returns the id identifying the named hash in the binary format. Hashes registered by the user
+// have no id and are stored by name
+func HashID(name string) (uint8, bool) {
+	id, ok := hashIDs[name]
+	return id, ok
+}
+
+func isFormat(data []byte) bool {
+	return len(data) >= len(formatMagic) && string(data[:len(formatMagic)]) == formatMagic
+}
+
+// encode writes the bloomfilter to w in the binary format
+func (b *Bloomfilter) encode(w io.Writer) error {
+	crc := crc32.New(crc32c)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	header := make([]byte, formatHeaderSize, formatHeaderSize+2+len(b.cfg.HashName))
+	copy(header, formatMagic)
+	header[4] = FormatVersion
+	if b.concurrent {
+		header[5] |= flagConcurrent
+	}
+	id, ok := HashID(b.cfg.HashName)
+	header[6] = id
+	binary.LittleEndian.PutUint64(header[8:], uint64(b.m))
+	binary.LittleEndian.PutUint64(header[16:], uint64(b.k))
+	binary.LittleEndian.PutUint64(header[24:], b.cfg.Seed)
+	binary.LittleEndian.PutUint64(header[32:], uint64(b.cfg.N))
+	binary.LittleEndian.PutUint64(header[40:], math.Float64bits(b.cfg.P))
+	if !ok {
+		if len(b.cfg.HashName) > math.MaxUint16 {
+			return fmt.Errorf("hash name too long: %d bytes", len(b.cfg.HashName))
+		}
+		header = binary.LittleEndian.AppendUint16(header, uint16(len(b.cfg.HashName)))
+		header = append(header, b.cfg.HashName...)
+	}
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	var word [8]byte
+	for i := range b.words {
+		binary.LittleEndian.PutUint64(word[:], b.load(i))
+		if _, err := bw.Write(word[:]); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// decode reads a bloomfilter in the binary format from r
+func (b *Bloomfilter) decode(r io.Reader) error {
+	crc := crc32.New(crc32c)
+	tr := io.TeeReader(r, crc)
+
+	header := make([]byte, formatHeaderSize)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return unexpectedEOF(err)
+	}
+	if string(header[:len(formatMagic)]) != formatMagic {
+		return errors.New("not a bloomfilter")
+	}
+	if header[4] != FormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[4])
+	}
+
+	m := binary.LittleEndian.Uint64(header[8:])
+	cfg := bloomfilter.Config{
+		N:    uint(binary.LittleEndian.Uint64(header[32:])),
+		P:    math.Float64frombits(binary.LittleEndian.Uint64(header[40:])),
+		Seed: binary.LittleEndian.Uint64(header[24:]),
+	}
+	if id := header[6]; id != 0 {
+		name, ok := hashNames[id]
+		if !ok {
+			return fmt.Errorf("unknown hash id %d", id)
+		}
+		cfg.HashName = name
+	} else {
+		var l [2]byte
+		if _, err := io.ReadFull(tr, l[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		name := make([]byte, binary.LittleEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(tr, name); err != nil {
+			return unexpectedEOF(err)
+		}
+		cfg.HashName = string(name)
+	}
+	if m == 0 || m > math.MaxInt64-63 || uint64(uint(m)) != m {
+		return fmt.Errorf("invalid m (%d)", m)
+	}
+	k := binary.LittleEndian.Uint64(header[16:])
+	if uint64(uint(k)) != k {
+		return fmt.Errorf("%w: k (%d) out of range", ErrInvalidPayload, k)
+	}
+	// the header is not covered by the checksum until the words are read, so it is checked before
+	// allocating them
+	if err := validateParams(uint(m), uint(k), cfg); err != nil {
+		return err
+	}
+
+	words, err := readWords(tr, (m+63)/64)
+	if err != nil {
+		return err
+	}
+
+	sum := crc.Sum32()
+	var trailer [4]byte
+	if _, err := io.ReadFull(r, trailer[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if binary.LittleEndian.Uint32(trailer[:]) != sum {
+		return ErrBadChecksum
+	}
+
+	*b = Bloomfilter{
+		words:      words,
+		m:          uint(m),
+		k:          uint(k),
+		cfg:        cfg,
+		concurrent: header[5]&flagConcurrent != 0,
+	}
+	return b.restore()
+}
+
+// restore validates a deserialized bloomfilter and sets its hashers
+func (b *Bloomfilter) restore() error {
+	if err := b.validate(); err != nil {
+		return err
+	}
+	if err := b.setHashers(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPayload, err.Error())
+	}
+	return nil
+}
+
+func (b *Bloomfilter) validate() error {
+	if b.m == 0 {
+		return fmt.Errorf("%w: m is 0", ErrInvalidPayload)
+	}
+	if uint(len(b.words)) != (b.m+63)/64 {
+		return fmt.Errorf("%w: %d words do not match m (%d)", ErrInvalidPayload, len(b.words), b.m)
+	}
+	if b.m%64 != 0 && b.words[len(b.words)-1]>>(b.m%64) != 0 {
+		return fmt.Errorf("%w: bits set beyond m (%d)", ErrInvalidPayload, b.m)
+	}
+	return validateParams(b.m, b.k, b.cfg)
+}
+
+// validateParams checks the config and that m and k are the ones derived from it
+func validateParams(m, k uint, cfg bloomfilter.Config) error {
+	if k == 0 || k > maxK {
+		return fmt.Errorf("%w: k (%d) out of range", ErrInvalidPayload, k)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPayload, err.Error())
+	}
+	if want := bloomfilter.M(cfg.N, cfg.P); m != want {
+		return fmt.Errorf("%w: m (%d) does not match the config (%d)", ErrInvalidPayload, m, want)
+	}
+	if want := bloomfilter.K(m, cfg.N); k != want {
+		return fmt.Errorf("%w: k (%d) does not match the config (%d)", ErrInvalidPayload, k, want)
+	}
+	return nil
+}
+
+// readWords reads n little endian words in chunks. The words are preallocated up to maxPrealloc, so a
+// forged config can not force a huge allocation before the data backing it is actually read
+func readWords(r io.Reader, n uint64) ([]uint64, error) {
+	const chunk = 512
+	buf := make([]byte, 8*chunk)
+	words := make([]uint64, 0, minUint64(n, maxPrealloc))
+	for uint64(len(words)) < n {
+		c := minUint64(n-uint64(len(words)), chunk)
+		if _, err := io.ReadFull(r, buf[:8*c]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		for i := uint64(0); i < c; i++ {
+			words = append(words, binary.LittleEndian.Uint64(buf[8*i:]))
+		}
+	}
+	return words, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
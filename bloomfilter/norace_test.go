@@ -0,0 +1,5 @@
+//go:build !race
+
+package bbloomfilter
+
+const raceEnabled = false
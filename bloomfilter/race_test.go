@@ -0,0 +1,6 @@
+//go:build race
+
+package bbloomfilter
+
+// the race detector drops pooled items at random, so the allocations can not be counted with it
+const raceEnabled = true
@@ -0,0 +1,72 @@
+package bloomfilter
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   Config
+		field string
+		err   error
+	}{
+		{Config{N: 0, P: 0.01, HashName: HASHER_OPTIMAL}, "n", ErrInvalidN},
+		{Config{N: 10, P: 0, HashName: HASHER_OPTIMAL}, "p", ErrInvalidP},
+		{Config{N: 10, P: -0.5, HashName: HASHER_OPTIMAL}, "p", ErrInvalidP},
+		{Config{N: 10, P: 1, HashName: HASHER_OPTIMAL}, "p", ErrInvalidP},
+		{Config{N: 10, P: math.NaN(), HashName: HASHER_OPTIMAL}, "p", ErrInvalidP},
+		{Config{N: 10, P: 0.01, HashName: "unknown"}, "hash_name", ErrUnknownHashFactory},
+		{Config{N: 10, P: 0.01}, "hash_name", ErrUnknownHashFactory},
+	} {
+		err := tc.cfg.Validate()
+		var cfgErr *ConfigError
+		if !errors.As(err, &cfgErr) {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+			continue
+		}
+		if cfgErr.Field != tc.field || !errors.Is(err, tc.err) {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+	}
+
+	if err := (Config{N: 10, P: 0.01, HashName: HASHER_OPTIMAL}).Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestP(t *testing.T) {
+	n, p := uint(100000000), 1e-9
+	m := M(n, p)
+	k := K(m, n)
+	if got := P(m, n, k); got > p*1.1 {
+		t.Errorf("unexpected false positive probability: %g", got)
+	}
+	if got := P(m, 2*n, k); got <= p {
+		t.Errorf("the false positive probability should grow with n: %g", got)
+	}
+	if got := P(0, n, k); got != 1 {
+		t.Errorf("unexpected false positive probability for an empty bitset: %g", got)
+	}
+}
+
+func TestMaxN(t *testing.T) {
+	p := 1e-9
+	bytes := uint(512 * 1024 * 1024)
+	n := MaxN(bytes, p)
+	if M(n, p) > bytes*8 {
+		t.Errorf("%d elements do not fit in %d bytes", n, bytes)
+	}
+	if M(n+1000, p) <= bytes*8 {
+		t.Errorf("%d is not the max number of elements for %d bytes", n, bytes)
+	}
+	if n := MaxN(0, p); n != 0 {
+		t.Errorf("unexpected number of elements for an empty budget: %d", n)
+	}
+	for _, p := range []float64{0, -0.5, 1, 2, math.NaN()} {
+		if n := MaxN(bytes, p); n != 0 {
+			t.Errorf("unexpected number of elements for p %g: %d", p, n)
+		}
+	}
+}
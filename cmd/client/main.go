@@ -8,6 +8,8 @@
 // add data1
 //
 // check data1
+//
+// list
 package main
 
 import (
@@ -17,19 +19,39 @@ import (
 	"os"
 	"strings"
 
+	"github.com/krakendio/bloomfilter/v2/rpc"
 	"github.com/krakendio/bloomfilter/v2/rpc/client"
 )
 
 func main() {
 	server := flag.String("server", "127.0.0.1:1234", "ip:port of the remote bloomfilter to connect to")
+	filter := flag.String("filter", "", "name of the remote bloomfilter, the default one when empty")
+	codec := flag.String("codec", "gob", "codec of the rpc connection: gob or jsonrpc")
+	useTLS := flag.Bool("tls", false, "secure the connection with TLS")
+	tlsCA := flag.String("tls-ca", "", "the PEM file of the CAs of the server cert, the system ones when empty")
+	tlsCert := flag.String("tls-cert", "", "the PEM file of the client cert, for mutual TLS")
+	tlsKey := flag.String("tls-key", "", "the PEM file of the client key, for mutual TLS")
+	tlsServerName := flag.String("tls-server-name", "", "the name in the server cert, the host of the server when empty")
+	token := flag.String("token", "", "the token authorizing the calls")
 	flag.Parse()
 
-	c, err := client.New(*server)
+	opts := []client.Option{client.WithCodec(*codec), client.WithToken(*token)}
+	if *useTLS {
+		opts = append(opts, client.WithTLSFiles(rpc.ClientTLSConfig{
+			CAFile:     *tlsCA,
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+			ServerName: *tlsServerName,
+		}))
+	}
+
+	c, err := client.New(*server, opts...)
 	if err != nil {
 		log.Println("unable to create the rpc client:", err.Error())
 		return
 	}
 	defer c.Close()
+	c = c.Named(*filter)
 
 	in := bufio.NewReader(os.Stdin)
 	for {
@@ -55,6 +77,13 @@ func main() {
 				continue
 			}
 			log.Printf("%v", ok)
+		case "list":
+			names, err := c.List(strings.Join(parts[1:], " "))
+			if err != nil {
+				log.Printf("error processing the cmd: %s", err.Error())
+				continue
+			}
+			log.Printf("%v", names)
 		default:
 			log.Println("unknown command")
 		}
@@ -1,4 +1,4 @@
-// Server application that registers a bloomfilter by means of an rpc.
+// Server application that registers a bloomfilter by means of an rpc and/or an HTTP/JSON API.
 package main
 
 import (
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,6 +19,19 @@ import (
 
 func main() {
 	port := flag.Int("p", 1234, "the port to listen on")
+	api := flag.String("api", "rpc", "the api to serve: rpc, http or both")
+	httpPort := flag.Int("http-port", 8080, "the port of the HTTP/JSON api, when serving both")
+	codec := flag.String("codec", "gob", "codec of the rpc connections: gob, jsonrpc or auto")
+	tlsCert := flag.String("tls-cert", "", "the PEM file of the server cert, enabling TLS")
+	tlsKey := flag.String("tls-key", "", "the PEM file of the server key")
+	tlsClientCA := flag.String("tls-client-ca", "", "the PEM file of the CAs of the client certs, enabling mutual TLS")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "the min TLS version: 1.0, 1.1, 1.2 or 1.3")
+	tlsAllowed := flag.String("tls-allowed-names", "", "comma separated common or alternative names of the allowed client certs")
+	checkpointDir := flag.String("checkpoint-dir", "", "the dir where the bloomfilter is persisted and restored from")
+	checkpointInterval := flag.Uint("checkpoint-interval", 60, "the seconds between checkpoints")
+	walDir := flag.String("wal-dir", "", "the dir of the write-ahead log of the added elements")
+	walSync := flag.String("wal-sync", rotate.WALSyncInterval, "when the write-ahead log is synced: always, interval or never")
+	aligned := flag.Bool("aligned", false, "rotate at the multiples of the ttl since the unix epoch")
 	flag.Parse()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -33,21 +47,73 @@ func main() {
 				P:        0.0000001,
 				HashName: "optimal",
 			},
-			TTL: 1000,
+			TTL:     1000,
+			Aligned: *aligned,
+			Checkpoint: rotate.CheckpointConfig{
+				Dir:      *checkpointDir,
+				Interval: *checkpointInterval,
+			},
+			WAL: rotate.WALConfig{
+				Dir:  *walDir,
+				Sync: *walSync,
+			},
 		},
-		Port: *port,
+		Port:  *port,
+		Codec: *codec,
+	}
+	if *tlsCert != "" {
+		cfg.TLS = &rpc.TLSConfig{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			ClientCAFile: *tlsClientCA,
+			MinVersion:   *tlsMinVersion,
+		}
+		if *tlsAllowed != "" {
+			cfg.TLS.AllowedNames = strings.Split(*tlsAllowed, ",")
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Println("invalid config:", err.Error())
+		return
+	}
+	switch *api {
+	case "rpc", "http", "both":
+	default:
+		log.Println("unable to start the server: unknown api:", *api)
+		return
+	}
+	opts := []server.Option{server.WithCodec(cfg.Codec)}
+	if cfg.TLS != nil {
+		opts = append(opts, server.WithTLSFiles(*cfg.TLS))
+	}
+
+	// the servers share the bloomfilter, closed only here, and report their listen and serve errors
+	errs := make(chan error, 2)
+	bf := rpc.New(ctx, cfg, rpc.OnError(func(err error) { log.Println("bloomfilter:", err.Error()) }))
+	defer bf.Close()
+
+	switch *api {
+	case "rpc":
+		go func() { errs <- server.Serve(ctx, cfg.Port, bf, opts...) }()
+	case "http":
+		go func() { errs <- server.ServeHTTP(ctx, cfg.Port, bf, opts...) }()
+	case "both":
+		go func() { errs <- server.Serve(ctx, cfg.Port, bf, opts...) }()
+		go func() { errs <- server.ServeHTTP(ctx, *httpPort, bf, opts...) }()
 	}
-	bf := server.New(ctx, cfg)
 	for {
 		select {
+		case err := <-errs:
+			if err != nil {
+				log.Println("unable to serve:", err.Error())
+			}
+			return
 		case sig := <-sigs:
 			log.Println("Signal intercepted:", sig)
 			cancel()
 			return
-		case <-ctx.Done():
 		case <-time.After(5 * time.Second):
-			d, _ := bf.Bloomfilter().MarshalBinary()
-			log.Println("Current size of the marshalled BF:", len(d))
+			log.Println("Estimated size of the marshalled BF:", bf.Bloomfilter().EstimatedSize())
 		}
 	}
 }
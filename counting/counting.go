@@ -0,0 +1,274 @@
+// Package counting implements a counting bloomfilter: every position of the filter is a small counter
+// instead of a single bit, so elements can be removed.
+//
+// Counters saturate at their max value and, once saturated, they are never decremented, so removing
+// an element never introduces false negatives for the rest of the elements sharing its counters.
+package counting
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+)
+
+// DefaultWidth is the number of bits of every counter when the config does not define it
+const DefaultWidth = 4
+
+// ErrInvalidWidth is returned when the width of the counters is not supported
+var ErrInvalidWidth = errors.New("the width of the counters must be 2, 4, 8 or 16 bits")
+
+// Config contains a bloomfilter config and the width in bits of the counters
+type Config struct {
+	bloomfilter.Config
+	Width uint `json:"width"`
+}
+
+// Validate checks the config can be used to build a counting bloomfilter
+func (c Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	switch c.Width {
+	case 0, 2, 4, 8, 16:
+		return nil
+	default:
+		return &bloomfilter.ConfigError{Field: "width", Err: ErrInvalidWidth}
+	}
+}
+
+// Bloomfilter is a counting bloomfilter
+type Bloomfilter struct {
+	counters []uint64
+	m        uint
+	k        uint
+	width    uint
+	h        []bloomfilter.Hash
+	h128     bloomfilter.Hash128
+	index    bloomfilter.IndexFunc
+	cfg      Config
+}
+
+// Build validates the config before creating a new counting bloomfilter
+func Build(cfg Config) (*Bloomfilter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return New(cfg), nil
+}
+
+// New creates a new counting bloomfilter from a given config. It panics if the config has an unknown
+// hash name, use Build to get an error instead
+func New(cfg Config) *Bloomfilter {
+	if cfg.Width == 0 {
+		cfg.Width = DefaultWidth
+	}
+	m := bloomfilter.M(cfg.N, cfg.P)
+	b := &Bloomfilter{
+		counters: make([]uint64, words(m, cfg.Width)),
+		m:        m,
+		k:        bloomfilter.K(m, cfg.N),
+		width:    cfg.Width,
+		cfg:      cfg,
+	}
+	if err := b.setHashers(); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func words(m, width uint) uint {
+	perWord := 64 / width
+	return (m + perWord - 1) / perWord
+}
+
+func (b *Bloomfilter) setHashers() error {
+	h, err := bloomfilter.SeededHashes(b.cfg.HashName, b.k, b.cfg.Seed)
+	if err != nil {
+		return err
+	}
+	b.h = h
+	b.h128, b.index, _ = bloomfilter.Hash128ByName(b.cfg.HashName)
+	return nil
+}
+
+// each calls f with every counter position of the element until it returns false
+func (b *Bloomfilter) each(elem []byte, f func(uint) bool) {
+	if b.h128 != nil {
+		h1, h2 := b.h128(elem, b.cfg.Seed)
+		for i := uint(0); i < b.k; i++ {
+			if !f(b.index(h1, h2, i) % b.m) {
+				return
+			}
+		}
+		return
+	}
+
+	for _, h := range b.h {
+		for _, x := range h(elem) {
+			if !f(x % b.m) {
+				return
+			}
+		}
+	}
+}
+
+func (b *Bloomfilter) max() uint64 {
+	return 1<<b.width - 1
+}
+
+func (b *Bloomfilter) get(i uint) uint64 {
+	perWord := 64 / b.width
+	return (b.counters[i/perWord] >> ((i % perWord) * b.width)) & b.max()
+}
+
+func (b *Bloomfilter) set(i uint, v uint64) {
+	perWord := 64 / b.width
+	shift := (i % perWord) * b.width
+	w := &b.counters[i/perWord]
+	*w = *w&^(b.max()<<shift) | v<<shift
+}
+
+// Add an element to the counting bloomfilter
+func (b *Bloomfilter) Add(elem []byte) {
+	b.each(elem, func(i uint) bool {
+		if v := b.get(i); v < b.max() {
+			b.set(i, v+1)
+		}
+		return true
+	})
+}
+
+// Check if an element is in the counting bloomfilter
+func (b *Bloomfilter) Check(elem []byte) bool {
+	found := true
+	b.each(elem, func(i uint) bool {
+		found = b.get(i) > 0
+		return found
+	})
+	return found
+}
+
+// Remove an element from the counting bloomfilter. It returns false, without touching any counter,
+// if the element is not in the filter
+func (b *Bloomfilter) Remove(elem []byte) bool {
+	if !b.Check(elem) {
+		return false
+	}
+	b.each(elem, func(i uint) bool {
+		if v := b.get(i); v > 0 && v < b.max() {
+			b.set(i, v-1)
+		}
+		return true
+	})
+	return true
+}
+
+// Union adds the counters of another counting bloomfilter, saturating them at their max value
+func (b *Bloomfilter) Union(that interface{}) (float64, error) {
+	other, ok := that.(*Bloomfilter)
+	if !ok {
+		return b.Capacity(), bloomfilter.ErrImpossibleToTreat
+	}
+
+	if b.m != other.m {
+		return b.Capacity(), fmt.Errorf("m1(%d) != m2(%d)", b.m, other.m)
+	}
+
+	if b.k != other.k {
+		return b.Capacity(), fmt.Errorf("k1(%d) != k2(%d)", b.k, other.k)
+	}
+
+	if b.width != other.width {
+		return b.Capacity(), fmt.Errorf("width1(%d) != width2(%d)", b.width, other.width)
+	}
+
+	if b.cfg.HashName != other.cfg.HashName {
+		return b.Capacity(), fmt.Errorf("different hashers: %s is not %s", other.cfg.HashName, b.cfg.HashName)
+	}
+
+	if b.cfg.Seed != other.cfg.Seed {
+		return b.Capacity(), bbloomfilter.ErrDifferentSeeds
+	}
+
+	for i := uint(0); i < b.m; i++ {
+		v := b.get(i) + other.get(i)
+		if v > b.max() {
+			v = b.max()
+		}
+		b.set(i, v)
+	}
+
+	return b.Capacity(), nil
+}
+
+// Capacity returns the ratio of non zero counters of the counting bloomfilter
+func (b *Bloomfilter) Capacity() float64 {
+	count := 0
+	for i := uint(0); i < b.m; i++ {
+		if b.get(i) > 0 {
+			count++
+		}
+	}
+	return float64(count) / float64(b.m)
+}
+
+// SerializibleBloomfilter used when (de)serializing a counting bloomfilter
+type SerializibleBloomfilter struct {
+	Counters []uint64
+	M        uint
+	K        uint
+	Width    uint
+	Cfg      Config
+}
+
+// MarshalBinary serializes a counting bloomfilter
+func (b *Bloomfilter) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(&SerializibleBloomfilter{
+		Counters: b.counters,
+		M:        b.m,
+		K:        b.k,
+		Width:    b.width,
+		Cfg:      b.cfg,
+	})
+
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary deserializes a counting bloomfilter
+func (b *Bloomfilter) UnmarshalBinary(data []byte) error {
+	target := SerializibleBloomfilter{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&target); err != nil {
+		return err
+	}
+
+	if err := target.Cfg.Validate(); err != nil {
+		return err
+	}
+	if target.Width == 0 || target.Width != target.Cfg.Width {
+		return fmt.Errorf("unexpected width %d", target.Width)
+	}
+	if want := bloomfilter.M(target.Cfg.N, target.Cfg.P); target.M != want {
+		return fmt.Errorf("m (%d) does not match the config (%d)", target.M, want)
+	}
+	if want := bloomfilter.K(target.M, target.Cfg.N); target.K != want {
+		return fmt.Errorf("k (%d) does not match the config (%d)", target.K, want)
+	}
+	if uint(len(target.Counters)) != words(target.M, target.Width) {
+		return fmt.Errorf("%d counter words do not match m (%d)", len(target.Counters), target.M)
+	}
+
+	*b = Bloomfilter{
+		counters: target.Counters,
+		m:        target.M,
+		k:        target.K,
+		width:    target.Width,
+		cfg:      target.Cfg,
+	}
+
+	return b.setHashers()
+}
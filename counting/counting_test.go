@@ -0,0 +1,147 @@
+package counting
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestBloomfilter(t *testing.T) {
+	testutils.CallSet(t, New(Config{Config: testutils.TestCfg}))
+}
+
+func TestBloomfilter_Remove(t *testing.T) {
+	for _, width := range []uint{2, 4, 8, 16} {
+		for _, cfg := range []bloomfilter.Config{testutils.TestCfg, testutils.TestCfg3} {
+			bf := New(Config{cfg, width})
+			elem1, elem2 := []byte("casa"), []byte("grrrrr")
+
+			bf.Add(elem1)
+			bf.Add(elem2)
+			bf.Add(elem2)
+
+			if !bf.Remove(elem1) {
+				t.Errorf("width %d: unable to remove elem1", width)
+			}
+			if bf.Check(elem1) {
+				t.Errorf("width %d: elem1 still present", width)
+			}
+			if bf.Remove(elem1) {
+				t.Errorf("width %d: elem1 removed twice", width)
+			}
+
+			if !bf.Remove(elem2) || !bf.Check(elem2) {
+				t.Errorf("width %d: elem2 should be present after removing it once", width)
+			}
+			if !bf.Remove(elem2) || bf.Check(elem2) {
+				t.Errorf("width %d: elem2 should not be present after removing it twice", width)
+			}
+			if c := bf.Capacity(); c != 0 {
+				t.Errorf("width %d: unexpected capacity %f", width, c)
+			}
+		}
+	}
+}
+
+func TestBloomfilter_saturation(t *testing.T) {
+	bf := New(Config{testutils.TestCfg, 2})
+	elem := []byte("casa")
+	for i := 0; i < 10; i++ {
+		bf.Add(elem)
+	}
+	for i := 0; i < 10; i++ {
+		bf.Remove(elem)
+	}
+	if !bf.Check(elem) {
+		t.Error("saturated counters should never be decremented")
+	}
+}
+
+func TestBloomfilter_Union_ok(t *testing.T) {
+	set1 := New(Config{Config: testutils.TestCfg})
+	set2 := New(Config{Config: testutils.TestCfg})
+
+	testutils.CallSetUnion(t, set1, set2)
+
+	elem := []byte{1, 2, 3}
+	set2.Add(elem)
+	if !set2.Remove(elem) || !set2.Check(elem) {
+		t.Error("the union should add the counters")
+	}
+}
+
+func TestBloomfilter_Union_ko(t *testing.T) {
+	set1 := New(Config{Config: testutils.TestCfg})
+
+	if _, err := set1.Union(24); err != bloomfilter.ErrImpossibleToTreat {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(Config{testutils.TestCfg, 8})); err == nil || !strings.Contains(err.Error(), "width") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(Config{Config: testutils.TestCfg2})); err == nil || !strings.Contains(err.Error(), "!= m2") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	cfg := testutils.TestCfg
+	cfg.Seed = 42
+	if _, err := set1.Union(New(Config{Config: cfg})); err != bbloomfilter.ErrDifferentSeeds {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestBloomfilter_binary(t *testing.T) {
+	bf1 := New(Config{testutils.TestCfg, 8})
+	bf1.Add([]byte("casa"))
+	bf1.Add([]byte("casa"))
+
+	data, err := bf1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	bf2 := new(Bloomfilter)
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !bf2.Remove([]byte("casa")) || !bf2.Check([]byte("casa")) {
+		t.Error("counters not restored")
+	}
+
+	if err := bf2.UnmarshalBinary([]byte{}); err == nil {
+		t.Error("should have given error")
+	}
+}
+
+func TestBloomfilter_UnmarshalBinary_forged(t *testing.T) {
+	bf := New(Config{testutils.TestCfg, 8})
+	for name, target := range map[string]SerializibleBloomfilter{
+		"huge k":     {Counters: bf.counters, M: bf.m, K: 1 << 60, Width: 8, Cfg: bf.cfg},
+		"m mismatch": {Counters: make([]uint64, words(2*bf.m, 8)), M: 2 * bf.m, K: bf.k, Width: 8, Cfg: bf.cfg},
+	} {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&target); err != nil {
+			t.Errorf("%s: unexpected error, %v", name, err)
+			continue
+		}
+		if err := new(Bloomfilter).UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("%s: the forged payload was accepted", name)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	if _, err := Build(Config{testutils.TestCfg, 3}); !errors.Is(err, ErrInvalidWidth) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := Build(Config{Config: testutils.TestCfg}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
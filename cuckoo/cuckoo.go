@@ -0,0 +1,494 @@
+// Package cuckoo implements a cuckoo filter: a set of buckets storing small fingerprints of the elements.
+//
+// Every element can be stored in two candidate buckets: the one selected by its hash and the one obtained
+// by xoring it with the hash of its fingerprint, so elements can be relocated (kicked) to their alternate
+// bucket when both are full and deleted without affecting the rest of the elements:
+// https://www.cs.cmu.edu/~dga/papers/cuckoo-conext2014.pdf
+package cuckoo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+)
+
+const (
+	// DefaultBucketSize is the number of fingerprints per bucket when the config does not define it
+	DefaultBucketSize = 4
+	// MaxKicks is the number of relocations tried before considering the filter full
+	MaxKicks = 500
+
+	loadFactor = 0.95
+)
+
+var (
+	// ErrInvalidFingerprintSize is returned when the size of the fingerprints is not supported
+	ErrInvalidFingerprintSize = errors.New("the fingerprint size must be between 2 and 32 bits")
+	// ErrInvalidBucketSize is returned when the size of the buckets is not supported
+	ErrInvalidBucketSize = errors.New("the bucket size must be between 1 and 8")
+	// ErrFull is returned when the cuckoo filter can not store an element or the fingerprints of an union
+	ErrFull = errors.New("the cuckoo filter is full")
+)
+
+// Config contains a bloomfilter config along with the size in bits of the fingerprints and the number
+// of fingerprints per bucket. When not defined, the fingerprint size is derived from P
+type Config struct {
+	bloomfilter.Config
+	FingerprintSize uint `json:"fingerprint_size"`
+	BucketSize      uint `json:"bucket_size"`
+}
+
+// Validate checks the config can be used to build a cuckoo filter
+func (c Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.FingerprintSize != 0 && (c.FingerprintSize < 2 || c.FingerprintSize > 32) {
+		return &bloomfilter.ConfigError{Field: "fingerprint_size", Err: ErrInvalidFingerprintSize}
+	}
+	if c.BucketSize > 8 {
+		return &bloomfilter.ConfigError{Field: "bucket_size", Err: ErrInvalidBucketSize}
+	}
+	return nil
+}
+
+func (c Config) withDefaults() Config {
+	if c.BucketSize == 0 {
+		c.BucketSize = DefaultBucketSize
+	}
+	if c.FingerprintSize == 0 {
+		c.FingerprintSize = FingerprintSize(c.P, c.BucketSize)
+	}
+	return c
+}
+
+// FingerprintSize computes the number of bits of the fingerprints required to get a false positive
+// probability p with buckets of b fingerprints
+func FingerprintSize(p float64, b uint) uint {
+	f := uint(math.Ceil(math.Log2(2 * float64(b) / p)))
+	if f < 2 {
+		return 2
+	}
+	if f > 32 {
+		return 32
+	}
+	return f
+}
+
+// Filter is a cuckoo filter
+type Filter struct {
+	slots      []uint64
+	buckets    uint
+	bucketSize uint
+	fpSize     uint
+	count      uint
+	victim     victim
+	rnd        uint64
+	err        error
+	h          []bloomfilter.Hash
+	h128       bloomfilter.Hash128
+	cfg        Config
+}
+
+type victim struct {
+	index uint
+	fp    uint32
+	used  bool
+}
+
+// Build validates the config before creating a new cuckoo filter
+func Build(cfg Config) (*Filter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return New(cfg), nil
+}
+
+// New creates a new cuckoo filter able to store N elements. It panics if the config has an unknown
+// hash name, use Build to get an error instead
+func New(cfg Config) *Filter {
+	cfg = cfg.withDefaults()
+	buckets := bucketCount(cfg)
+	f := &Filter{
+		slots:      make([]uint64, words(buckets*cfg.BucketSize, cfg.FingerprintSize)),
+		buckets:    buckets,
+		bucketSize: cfg.BucketSize,
+		fpSize:     cfg.FingerprintSize,
+		rnd:        cfg.Seed | 1,
+		cfg:        cfg,
+	}
+	if err := f.setHashers(); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// bucketCount returns the number of buckets of a filter built with the config, a power of 2
+func bucketCount(cfg Config) uint {
+	if n := uint(math.Ceil(float64(cfg.N) / float64(cfg.BucketSize) / loadFactor)); n > 1 {
+		return 1 << bits.Len(n-1)
+	}
+	return 1
+}
+
+func words(slots, fpSize uint) uint {
+	return (slots*fpSize + 63) / 64
+}
+
+func (f *Filter) setHashers() error {
+	h, err := bloomfilter.SeededHashes(f.cfg.HashName, 2, f.cfg.Seed)
+	if err != nil {
+		return err
+	}
+	f.h = h
+	f.h128, _, _ = bloomfilter.Hash128ByName(f.cfg.HashName)
+	return nil
+}
+
+func (f *Filter) digest(elem []byte) (uint64, uint64) {
+	if f.h128 != nil {
+		return f.h128(elem, f.cfg.Seed)
+	}
+	out := f.h[0](elem)
+	if len(out) > 1 {
+		return uint64(out[0]), uint64(out[1])
+	}
+	return uint64(out[0]), bloomfilter.XXHash64(elem, uint64(out[0]))
+}
+
+// locate returns the primary bucket and the fingerprint of an element. Both words of the digest are
+// mixed into each of them, since they only take a few bits and some hashers do not spread the changes
+// of the element over all the bits of the digest (FNV-1 leaves the first word untouched by the last byte)
+func (f *Filter) locate(elem []byte) (uint, uint32) {
+	h1, h2 := f.digest(elem)
+	h1 = mix(h1 ^ mix(h2))
+	h2 = mix(h2 ^ h1)
+	fp := uint32(h2 & (1<<f.fpSize - 1))
+	if fp == 0 {
+		// zero marks the empty slots
+		fp = 1
+	}
+	return uint(h1) & (f.buckets - 1), fp
+}
+
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// alt returns the alternate bucket of a fingerprint stored in the bucket i
+func (f *Filter) alt(i uint, fp uint32) uint {
+	return (i ^ uint(fp*0x5bd1e995)) & (f.buckets - 1)
+}
+
+func (f *Filter) get(slot uint) uint32 {
+	offset := slot * f.fpSize
+	w, shift := offset/64, offset%64
+	v := f.slots[w] >> shift
+	if shift+f.fpSize > 64 {
+		v |= f.slots[w+1] << (64 - shift)
+	}
+	return uint32(v & (1<<f.fpSize - 1))
+}
+
+func (f *Filter) set(slot uint, fp uint32) {
+	offset := slot * f.fpSize
+	w, shift := offset/64, offset%64
+	mask := uint64(1)<<f.fpSize - 1
+	f.slots[w] = f.slots[w]&^(mask<<shift) | uint64(fp)<<shift
+	if shift+f.fpSize > 64 {
+		f.slots[w+1] = f.slots[w+1]&^(mask>>(64-shift)) | uint64(fp)>>(64-shift)
+	}
+}
+
+func (f *Filter) insertInBucket(i uint, fp uint32) bool {
+	for s := i * f.bucketSize; s < (i+1)*f.bucketSize; s++ {
+		if f.get(s) == 0 {
+			f.set(s, fp)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) inBucket(i uint, fp uint32) bool {
+	for s := i * f.bucketSize; s < (i+1)*f.bucketSize; s++ {
+		if f.get(s) == fp {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) deleteFromBucket(i uint, fp uint32) bool {
+	for s := i * f.bucketSize; s < (i+1)*f.bucketSize; s++ {
+		if f.get(s) == fp {
+			f.set(s, 0)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) random() uint64 {
+	f.rnd ^= f.rnd << 13
+	f.rnd ^= f.rnd >> 7
+	f.rnd ^= f.rnd << 17
+	return f.rnd
+}
+
+func (f *Filter) insert(i uint, fp uint32) bool {
+	if f.victim.used {
+		return false
+	}
+	if f.insertInBucket(i, fp) || f.insertInBucket(f.alt(i, fp), fp) {
+		f.count++
+		return true
+	}
+
+	if f.random()&1 == 0 {
+		i = f.alt(i, fp)
+	}
+	for n := 0; n < MaxKicks; n++ {
+		s := i*f.bucketSize + uint(f.random()%uint64(f.bucketSize))
+		kicked := f.get(s)
+		f.set(s, fp)
+		fp = kicked
+		i = f.alt(i, fp)
+		if f.insertInBucket(i, fp) {
+			f.count++
+			return true
+		}
+	}
+
+	// keep the last kicked out fingerprint, so no element is lost
+	f.victim = victim{index: i, fp: fp, used: true}
+	f.count++
+	return true
+}
+
+// Insert an element into the cuckoo filter. It returns false if the filter is full
+func (f *Filter) Insert(elem []byte) bool {
+	return f.insert(f.locate(elem))
+}
+
+// Add an element to the cuckoo filter. If the filter is full, the element is dropped and Err returns
+// ErrFull from then on. Use Insert to know about every element
+func (f *Filter) Add(elem []byte) {
+	if !f.Insert(elem) {
+		f.err = ErrFull
+	}
+}
+
+// Err returns ErrFull if Add dropped any element
+func (f *Filter) Err() error {
+	return f.err
+}
+
+// Check if an element is in the cuckoo filter
+func (f *Filter) Check(elem []byte) bool {
+	i, fp := f.locate(elem)
+	j := f.alt(i, fp)
+	if f.victim.used && f.victim.fp == fp && (f.victim.index == i || f.victim.index == j) {
+		return true
+	}
+	return f.inBucket(i, fp) || f.inBucket(j, fp)
+}
+
+// Delete an element from the cuckoo filter. It returns false if the element was not found. Deleting
+// elements never added may delete other elements sharing the same fingerprint and buckets
+func (f *Filter) Delete(elem []byte) bool {
+	i, fp := f.locate(elem)
+	j := f.alt(i, fp)
+
+	switch {
+	case f.deleteFromBucket(i, fp), f.deleteFromBucket(j, fp):
+	case f.victim.used && f.victim.fp == fp && (f.victim.index == i || f.victim.index == j):
+		f.victim = victim{}
+		f.count--
+		return true
+	default:
+		return false
+	}
+	f.count--
+
+	if f.victim.used {
+		v := f.victim
+		f.victim = victim{}
+		f.count--
+		f.insert(v.index, v.fp)
+	}
+	return true
+}
+
+// Count returns the number of elements stored in the cuckoo filter
+func (f *Filter) Count() uint {
+	return f.count
+}
+
+// Union inserts the fingerprints of another cuckoo filter with the same geometry and hasher. Every
+// fingerprint is stored as many times as in the filter holding more copies of it, so the elements of
+// both filters can still be deleted once. The filter is left untouched when it can not store all of them
+func (f *Filter) Union(that interface{}) (float64, error) {
+	other, ok := that.(*Filter)
+	if !ok {
+		return f.Capacity(), bloomfilter.ErrImpossibleToTreat
+	}
+
+	if f.buckets != other.buckets {
+		return f.Capacity(), fmt.Errorf("buckets1(%d) != buckets2(%d)", f.buckets, other.buckets)
+	}
+
+	if f.bucketSize != other.bucketSize {
+		return f.Capacity(), fmt.Errorf("bucket size1(%d) != bucket size2(%d)", f.bucketSize, other.bucketSize)
+	}
+
+	if f.fpSize != other.fpSize {
+		return f.Capacity(), fmt.Errorf("fingerprint size1(%d) != fingerprint size2(%d)", f.fpSize, other.fpSize)
+	}
+
+	if f.cfg.HashName != other.cfg.HashName {
+		return f.Capacity(), fmt.Errorf("different hashers: %s is not %s", other.cfg.HashName, f.cfg.HashName)
+	}
+
+	if f.cfg.Seed != other.cfg.Seed {
+		return f.Capacity(), bbloomfilter.ErrDifferentSeeds
+	}
+
+	have := f.fingerprints()
+	merged := f.clone()
+	for e, n := range other.fingerprints() {
+		for ; n > have[e]; n-- {
+			if !merged.insert(e.bucket, e.fp) {
+				return f.Capacity(), ErrFull
+			}
+		}
+	}
+	*f = *merged
+
+	return f.Capacity(), nil
+}
+
+// entry identifies a fingerprint by its value and the lowest of its two candidate buckets
+type entry struct {
+	bucket uint
+	fp     uint32
+}
+
+func (f *Filter) entry(i uint, fp uint32) entry {
+	if j := f.alt(i, fp); j < i {
+		i = j
+	}
+	return entry{bucket: i, fp: fp}
+}
+
+// fingerprints returns the number of copies of every stored fingerprint
+func (f *Filter) fingerprints() map[entry]uint {
+	res := map[entry]uint{}
+	for s := uint(0); s < f.buckets*f.bucketSize; s++ {
+		if fp := f.get(s); fp != 0 {
+			res[f.entry(s/f.bucketSize, fp)]++
+		}
+	}
+	if f.victim.used {
+		res[f.entry(f.victim.index, f.victim.fp)]++
+	}
+	return res
+}
+
+func (f *Filter) clone() *Filter {
+	c := *f
+	c.slots = make([]uint64, len(f.slots))
+	copy(c.slots, f.slots)
+	return &c
+}
+
+// Capacity returns the load factor of the cuckoo filter
+func (f *Filter) Capacity() float64 {
+	return float64(f.count) / float64(f.buckets*f.bucketSize)
+}
+
+// SerializibleFilter used when (de)serializing a cuckoo filter
+type SerializibleFilter struct {
+	Slots      []uint64
+	Buckets    uint
+	BucketSize uint
+	FpSize     uint
+	Count      uint
+	// the fingerprint that could not be placed in any bucket, if any
+	VictimIndex       uint
+	VictimFingerprint uint32
+	VictimUsed        bool
+	Cfg               Config
+}
+
+// MarshalBinary serializes a cuckoo filter
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(&SerializibleFilter{
+		Slots:             f.slots,
+		Buckets:           f.buckets,
+		BucketSize:        f.bucketSize,
+		FpSize:            f.fpSize,
+		Count:             f.count,
+		VictimIndex:       f.victim.index,
+		VictimFingerprint: f.victim.fp,
+		VictimUsed:        f.victim.used,
+		Cfg:               f.cfg,
+	})
+
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary deserializes a cuckoo filter
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	target := SerializibleFilter{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&target); err != nil {
+		return err
+	}
+
+	if err := target.Cfg.Validate(); err != nil {
+		return err
+	}
+	if target.BucketSize == 0 || target.BucketSize != target.Cfg.BucketSize || target.FpSize != target.Cfg.FingerprintSize {
+		return fmt.Errorf("unexpected bucket size (%d) or fingerprint size (%d)", target.BucketSize, target.FpSize)
+	}
+	if target.FpSize < 2 || target.FpSize > 32 {
+		return ErrInvalidFingerprintSize
+	}
+	if want := bucketCount(target.Cfg); target.Buckets != want {
+		return fmt.Errorf("the number of buckets (%d) does not match the config (%d)", target.Buckets, want)
+	}
+	if target.Buckets > math.MaxUint/target.BucketSize/target.FpSize {
+		return fmt.Errorf("too many buckets: %d", target.Buckets)
+	}
+	if uint(len(target.Slots)) != words(target.Buckets*target.BucketSize, target.FpSize) {
+		return fmt.Errorf("%d slot words do not match %d buckets", len(target.Slots), target.Buckets)
+	}
+	if target.VictimUsed && target.VictimIndex >= target.Buckets {
+		return fmt.Errorf("victim bucket %d out of range", target.VictimIndex)
+	}
+
+	*f = Filter{
+		slots:      target.Slots,
+		buckets:    target.Buckets,
+		bucketSize: target.BucketSize,
+		fpSize:     target.FpSize,
+		count:      target.Count,
+		victim:     victim{index: target.VictimIndex, fp: target.VictimFingerprint, used: target.VictimUsed},
+		rnd:        target.Cfg.Seed | 1,
+		cfg:        target.Cfg,
+	}
+
+	return f.setHashers()
+}
@@ -0,0 +1,249 @@
+package cuckoo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestFilter(t *testing.T) {
+	testutils.CallSet(t, New(Config{Config: testutils.TestCfg}))
+	testutils.CallSet(t, New(Config{Config: testutils.TestCfg3}))
+}
+
+func TestFilter_fill(t *testing.T) {
+	for _, fpSize := range []uint{7, 12, 16, 27, 32} {
+		cfg := Config{Config: bloomfilter.Config{N: 10000, P: 0.001, HashName: bloomfilter.HASHER_MURMUR3}, FingerprintSize: fpSize}
+		f := New(cfg)
+		for i := 0; i < int(cfg.N); i++ {
+			if elem := []byte(fmt.Sprintf("elem-%d", i)); !f.Insert(elem) {
+				t.Errorf("fp size %d: unable to insert %s", fpSize, elem)
+				break
+			}
+		}
+		if f.Count() != cfg.N {
+			t.Errorf("fp size %d: unexpected count %d", fpSize, f.Count())
+		}
+		for i := 0; i < int(cfg.N); i++ {
+			if elem := []byte(fmt.Sprintf("elem-%d", i)); !f.Check(elem) {
+				t.Errorf("fp size %d: %s not found", fpSize, elem)
+				break
+			}
+		}
+	}
+}
+
+func TestFilter_full(t *testing.T) {
+	f := New(Config{Config: bloomfilter.Config{N: 10, P: 0.001, HashName: bloomfilter.HASHER_MURMUR3}})
+	inserted := 0
+	for i := 0; i < 1000; i++ {
+		if f.Insert([]byte(fmt.Sprintf("elem-%d", i))) {
+			inserted++
+		}
+	}
+	if f.Err() != nil {
+		t.Errorf("Unexpected error, %v", f.Err())
+	}
+	f.Add([]byte("dropped"))
+	if f.Err() != ErrFull {
+		t.Errorf("Unexpected error, %v", f.Err())
+	}
+	// all the slots plus the victim
+	if total := f.buckets*f.bucketSize + 1; uint(inserted) > total || float64(inserted) < 0.9*float64(total) {
+		t.Errorf("unexpected number of inserted elements: %d out of %d", inserted, total)
+	}
+	for i := 0; i < inserted; i++ {
+		if elem := []byte(fmt.Sprintf("elem-%d", i)); !f.Check(elem) {
+			t.Errorf("%s not found", elem)
+		}
+	}
+}
+
+func TestFilter_Delete(t *testing.T) {
+	f := New(Config{Config: testutils.TestCfg})
+	elem := []byte("casa")
+
+	if f.Delete(elem) {
+		t.Error("unexpected deletion of a missing element")
+	}
+	f.Add(elem)
+	f.Add(elem)
+	if !f.Delete(elem) || !f.Check(elem) {
+		t.Error("the element should be present after deleting one of its copies")
+	}
+	if !f.Delete(elem) || f.Check(elem) {
+		t.Error("the element should not be present after deleting all its copies")
+	}
+	if f.Count() != 0 {
+		t.Errorf("unexpected count %d", f.Count())
+	}
+}
+
+func TestFilter_falsePositives(t *testing.T) {
+	cfg := Config{Config: bloomfilter.Config{N: 10000, P: 0.001, HashName: bloomfilter.HASHER_XXHASH64}}
+	f := New(cfg)
+	for i := 0; i < int(cfg.N); i++ {
+		f.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+	falsePositives := 0
+	for i := 0; i < 100000; i++ {
+		if f.Check([]byte(fmt.Sprintf("other-%d", i))) {
+			falsePositives++
+		}
+	}
+	if p := float64(falsePositives) / 100000; p > 2*cfg.P {
+		t.Errorf("unexpected false positive rate: %f", p)
+	}
+}
+
+func TestFilter_Union_ok(t *testing.T) {
+	set1 := New(Config{Config: testutils.TestCfg})
+	set2 := New(Config{Config: testutils.TestCfg})
+
+	testutils.CallSetUnion(t, set1, set2)
+}
+
+func TestFilter_Union_ko(t *testing.T) {
+	set1 := New(Config{Config: testutils.TestCfg})
+
+	if _, err := set1.Union(24); err != bloomfilter.ErrImpossibleToTreat {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(Config{Config: testutils.TestCfg2})); err == nil || !strings.Contains(err.Error(), "fingerprint size") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(Config{Config: testutils.TestCfg3})); err == nil || !strings.Contains(err.Error(), "different hashers") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	cfg := testutils.TestCfg
+	cfg.Seed = 42
+	if _, err := set1.Union(New(Config{Config: cfg})); err != bbloomfilter.ErrDifferentSeeds {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	set2 := New(Config{Config: testutils.TestCfg})
+	for i := 0; i < 1000; i++ {
+		set1.Add([]byte(fmt.Sprintf("elem-%d", i)))
+		set2.Add([]byte(fmt.Sprintf("other-%d", i)))
+	}
+	if set1.Err() != ErrFull {
+		t.Errorf("Unexpected error, %v", set1.Err())
+	}
+	count, slots := set1.Count(), append([]uint64{}, set1.slots...)
+	if _, err := set1.Union(set2); err != ErrFull {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if set1.Count() != count || !reflect.DeepEqual(set1.slots, slots) {
+		t.Error("the failed union modified the filter")
+	}
+}
+
+func TestFilter_Union_shared(t *testing.T) {
+	set1 := New(Config{Config: testutils.TestCfg})
+	set2 := New(Config{Config: testutils.TestCfg})
+	shared, twice := []byte("casa"), []byte("twice")
+	set1.Add(shared)
+	set2.Add(shared)
+	set2.Add(twice)
+	set2.Add(twice)
+
+	if _, err := set1.Union(set2); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if set1.Count() != 3 {
+		t.Errorf("unexpected count %d", set1.Count())
+	}
+	if !set1.Delete(shared) || set1.Check(shared) {
+		t.Error("the shared element should not be present after deleting it once")
+	}
+	if !set1.Delete(twice) || !set1.Check(twice) || !set1.Delete(twice) || set1.Check(twice) {
+		t.Error("the element added twice should be present until deleted twice")
+	}
+}
+
+func TestFilter_binary(t *testing.T) {
+	f1 := New(Config{Config: testutils.TestCfg})
+	for i := 0; i < 100; i++ {
+		f1.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+
+	data, err := f1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	f2 := new(Filter)
+	if err := f2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if f2.Count() != f1.Count() {
+		t.Errorf("unexpected count %d", f2.Count())
+	}
+	for i := 0; i < 100; i++ {
+		if elem := []byte(fmt.Sprintf("elem-%d", i)); !f2.Check(elem) {
+			t.Errorf("%s not found", elem)
+		}
+	}
+
+	if err := f2.UnmarshalBinary([]byte{}); err == nil {
+		t.Error("should have given error")
+	}
+}
+
+func TestFilter_UnmarshalBinary_forged(t *testing.T) {
+	cfg := New(Config{Config: testutils.TestCfg}).cfg
+	for name, target := range map[string]SerializibleFilter{
+		"overflowing buckets": {Buckets: 1 << 63, BucketSize: cfg.BucketSize, FpSize: cfg.FingerprintSize, Cfg: cfg},
+		"buckets mismatch":    {Buckets: 2, BucketSize: cfg.BucketSize, FpSize: cfg.FingerprintSize, Slots: make([]uint64, 1), Cfg: cfg},
+		"no fingerprint size": {Buckets: bucketCount(cfg), BucketSize: cfg.BucketSize, Cfg: Config{Config: cfg.Config, BucketSize: cfg.BucketSize}},
+	} {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&target); err != nil {
+			t.Errorf("%s: unexpected error, %v", name, err)
+			continue
+		}
+		if err := new(Filter).UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("%s: the forged payload was accepted", name)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	if _, err := Build(Config{Config: testutils.TestCfg, FingerprintSize: 40}); !errors.Is(err, ErrInvalidFingerprintSize) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := Build(Config{Config: testutils.TestCfg, BucketSize: 9}); !errors.Is(err, ErrInvalidBucketSize) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := Build(Config{Config: testutils.TestCfg}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestFingerprintSize(t *testing.T) {
+	for _, tc := range []struct {
+		p    float64
+		b    uint
+		want uint
+	}{
+		{0.5, 1, 2},
+		{0.001, 4, 13},
+		{1e-7, 4, 27},
+		{1e-12, 8, 32},
+	} {
+		if got := FingerprintSize(tc.p, tc.b); got != tc.want {
+			t.Errorf("FingerprintSize(%g, %d): got %d, want %d", tc.p, tc.b, got, tc.want)
+		}
+	}
+}
@@ -8,14 +8,36 @@ import (
 	"hash"
 	"hash/crc64"
 	"hash/fnv"
+	"math/bits"
+	"sort"
+	"sync"
 )
 
+// Hash returns the bit indices of an element. The returned slice belongs to the caller
 type Hash func([]byte) []uint
+
+// AppendHash appends the bit indices of an element to dst and returns the extended slice, like the
+// append builtin, so a caller reusing dst does not allocate. Implementations must be safe for concurrent use
+type AppendHash func(dst []uint, elem []byte) []uint
+
+// HashFactory returns the set of Hash to use for a filter with k hash functions
 type HashFactory func(uint) []Hash
 
+// Hash128 returns a 128 bit digest of an element as two 64 bit words. The seed selects a member of
+// the hash family. Implementations must be safe for concurrent use and should not allocate, so the
+// filters can derive their bit indices from the digest without any intermediate slice
+type Hash128 func(elem []byte, seed uint64) (uint64, uint64)
+
+// IndexFunc derives the i-th bit index of an element from its 128 bit digest
+type IndexFunc func(h1, h2 uint64, i uint) uint
+
 const (
-	HASHER_DEFAULT = "default"
-	HASHER_OPTIMAL = "optimal"
+	HASHER_DEFAULT  = "default"
+	HASHER_OPTIMAL  = "optimal"
+	HASHER_XXHASH64 = "xxhash64"
+	HASHER_MURMUR3  = "murmur3"
+	HASHER_SIPHASH  = "siphash"
+	HASHER_ENHANCED = "enhanced"
 )
 
 var (
@@ -26,21 +48,182 @@ var (
 		FNV64,
 		FNV128,
 	}
+	defaultAppendHashers = []AppendHash{
+		appendMD5,
+		appendCRC64,
+		appendSHA1,
+		appendFNV64,
+		appendFNV128,
+	}
 
+	hashFactories = map[string]HashFactory{
+		HASHER_DEFAULT:  DefaultHashFactory,
+		HASHER_OPTIMAL:  OptimalHashFactory,
+		HASHER_XXHASH64: XXHash64HashFactory,
+		HASHER_MURMUR3:  Murmur3HashFactory,
+		HASHER_SIPHASH:  SipHashFactory,
+		HASHER_ENHANCED: EnhancedHashFactory,
+	}
+	// HashFactoryNames maps the names of the hash factories to them. The registered factories are added to
+	// it under the lock of the registry, and the factories added straight to it are found by name too.
+	//
+	// Deprecated: use RegisterHashFactory, HashFactoryByName and RegisteredHashFactories, since accessing
+	// the map while registering hashes is racy
 	HashFactoryNames = map[string]HashFactory{
-		HASHER_DEFAULT: DefaultHashFactory,
-		HASHER_OPTIMAL: OptimalHashFactory,
+		HASHER_DEFAULT:  DefaultHashFactory,
+		HASHER_OPTIMAL:  OptimalHashFactory,
+		HASHER_XXHASH64: XXHash64HashFactory,
+		HASHER_MURMUR3:  Murmur3HashFactory,
+		HASHER_SIPHASH:  SipHashFactory,
+		HASHER_ENHANCED: EnhancedHashFactory,
+	}
+	hash128Names = map[string]hash128Entry{
+		HASHER_OPTIMAL:  {FNV128Sum, DoubleHash},
+		HASHER_XXHASH64: {XXHash64Sum, DoubleHash},
+		HASHER_MURMUR3:  {Murmur3Sum, DoubleHash},
+		HASHER_SIPHASH:  {SipHashSum, DoubleHash},
+		HASHER_ENHANCED: {Murmur3Sum, EnhancedDoubleHash},
 	}
+	hashFactoryMutex = new(sync.RWMutex)
+
+	ErrImpossibleToTreat      = fmt.Errorf("unable to union")
+	ErrDuplicateHashFactory   = fmt.Errorf("hash factory already registered")
+	ErrUnknownHashFactory     = fmt.Errorf("unknown hash factory")
+	ErrInvalidHashFactory     = fmt.Errorf("invalid hash factory")
+	ErrInvalidHashFactoryName = fmt.Errorf("invalid hash factory name")
+
+	crc64Table = crc64.MakeTable(crc64.ECMA)
 
-	ErrImpossibleToTreat = fmt.Errorf("unable to union")
+	appendMD5    = NewAppendHashWrapper(md5.New)  // skipcq: GO-S1023, GSC-G401
+	appendSHA1   = NewAppendHashWrapper(sha1.New) // skipcq: GO-S1025, GSC-G401
+	appendCRC64  = NewAppendHashWrapper(func() hash.Hash { return crc64.New(crc64Table) })
+	appendFNV64  = NewAppendHashWrapper(func() hash.Hash { return fnv.New64() })
+	appendFNV128 = NewAppendHashWrapper(fnv.New128)
 
-	MD5    = HashWrapper(md5.New())  // skipcq: GO-S1023, GSC-G401
-	SHA1   = HashWrapper(sha1.New()) // skipcq: GO-S1025, GSC-G401
-	CRC64  = HashWrapper(crc64.New(crc64.MakeTable(crc64.ECMA)))
-	FNV64  = HashWrapper(fnv.New64())
-	FNV128 = HashWrapper(fnv.New128())
+	MD5    = toHash(appendMD5)
+	SHA1   = toHash(appendSHA1)
+	CRC64  = toHash(appendCRC64)
+	FNV64  = toHash(appendFNV64)
+	FNV128 = toHash(appendFNV128)
 )
 
+// RegisterHashFactory makes a HashFactory available under the given name, so it can be selected
+// through Config.HashName. Registering a name twice returns ErrDuplicateHashFactory
+func RegisterHashFactory(name string, f HashFactory) error {
+	if name == "" {
+		return ErrInvalidHashFactoryName
+	}
+	if f == nil {
+		return ErrInvalidHashFactory
+	}
+
+	hashFactoryMutex.Lock()
+	defer hashFactoryMutex.Unlock()
+
+	if _, ok := hashFactories[name]; ok || HashFactoryNames[name] != nil {
+		return fmt.Errorf("%w: %s", ErrDuplicateHashFactory, name)
+	}
+	hashFactories[name] = f
+	HashFactoryNames[name] = f
+	return nil
+}
+
+type hash128Entry struct {
+	h     Hash128
+	index IndexFunc
+}
+
+// RegisterHash128 makes a Hash128 available under the given name, deriving the bit indices by double
+// hashing. The filters supporting it derive their bit indices straight from the digest, while the rest
+// get the HashFactory returned by Hash128Factory
+func RegisterHash128(name string, h Hash128) error {
+	return registerHash128(name, h, DoubleHash)
+}
+
+// RegisterEnhancedHash128 is like RegisterHash128 but the bit indices are derived by enhanced double hashing
+func RegisterEnhancedHash128(name string, h Hash128) error {
+	return registerHash128(name, h, EnhancedDoubleHash)
+}
+
+func registerHash128(name string, h Hash128, index IndexFunc) error {
+	if name == "" {
+		return ErrInvalidHashFactoryName
+	}
+	if h == nil {
+		return ErrInvalidHashFactory
+	}
+
+	hashFactoryMutex.Lock()
+	defer hashFactoryMutex.Unlock()
+
+	if _, ok := hashFactories[name]; ok || HashFactoryNames[name] != nil {
+		return fmt.Errorf("%w: %s", ErrDuplicateHashFactory, name)
+	}
+	hashFactories[name] = func(k uint) []Hash { return hash128Hashes(h, index, k, 0) }
+	HashFactoryNames[name] = hashFactories[name]
+	hash128Names[name] = hash128Entry{h, index}
+	return nil
+}
+
+// RegisteredHashFactories returns the sorted names of the registered hash factories
+func RegisteredHashFactories() []string {
+	hashFactoryMutex.RLock()
+	defer hashFactoryMutex.RUnlock()
+
+	names := make([]string, 0, len(hashFactories))
+	for name := range hashFactories {
+		names = append(names, name)
+	}
+	for name := range HashFactoryNames {
+		if _, ok := hashFactories[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HashFactoryByName returns the HashFactory registered under the given name
+func HashFactoryByName(name string) (HashFactory, error) {
+	hashFactoryMutex.RLock()
+	defer hashFactoryMutex.RUnlock()
+
+	f, ok := hashFactories[name]
+	if !ok {
+		f, ok = HashFactoryNames[name]
+	}
+	if !ok || f == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownHashFactory, name)
+	}
+	return f, nil
+}
+
+// Hash128ByName returns the Hash128 registered under the given name, if any, along with the
+// function deriving the bit indices from its digest
+func Hash128ByName(name string) (Hash128, IndexFunc, bool) {
+	hashFactoryMutex.RLock()
+	defer hashFactoryMutex.RUnlock()
+
+	e, ok := hash128Names[name]
+	return e.h, e.index, ok
+}
+
+// DoubleHash returns the i-th index derived from the digest (h1, h2)
+func DoubleHash(h1, h2 uint64, i uint) uint {
+	return uint(h1 + uint64(i)*h2)
+}
+
+// EnhancedDoubleHash returns the i-th index derived from the digest (h1, h2) following the enhanced
+// double hashing scheme of Kirsch and Mitzenmacher: h1 + i*h2 + (i^3-i)/6. The cubic term avoids
+// the collisions of plain double hashing when h2 is a multiple of a factor of m
+func EnhancedDoubleHash(h1, h2 uint64, i uint) uint {
+	x := uint64(i)
+	return uint(h1 + x*h2 + (x*x*x-x)/6)
+}
+
+// DefaultHashFactory returns the first k default hashers. Notice it never returns more than 5 hashers
+// and each of them yields a different number of indices, so the actual number of bits set per element
+// does not match k. Use EnhancedHashFactory when the configured false positive rate matters
 func DefaultHashFactory(k uint) []Hash {
 	if k > uint(len(defaultHashers)) {
 		k = uint(len(defaultHashers))
@@ -49,28 +232,265 @@ func DefaultHashFactory(k uint) []Hash {
 }
 
 func OptimalHashFactory(k uint) []Hash {
+	return Hash128Factory(FNV128Sum)(k)
+}
+
+// XXHash64HashFactory derives k indices by double hashing over an xxHash64 digest
+func XXHash64HashFactory(k uint) []Hash {
+	return Hash128Factory(XXHash64Sum)(k)
+}
+
+// Murmur3HashFactory derives k indices by double hashing over a 128 bit MurmurHash3 digest
+func Murmur3HashFactory(k uint) []Hash {
+	return Hash128Factory(Murmur3Sum)(k)
+}
+
+// SipHashFactory derives k indices by double hashing over a SipHash-2-4 digest
+func SipHashFactory(k uint) []Hash {
+	return Hash128Factory(SipHashSum)(k)
+}
+
+// EnhancedHashFactory derives exactly k indices by enhanced double hashing over a 128 bit MurmurHash3 digest
+func EnhancedHashFactory(k uint) []Hash {
+	return hash128Hashes(Murmur3Sum, EnhancedDoubleHash, k, 0)
+}
+
+// Hash128Factory returns a HashFactory deriving k indices by double hashing over the digest of h
+func Hash128Factory(h Hash128) HashFactory {
+	return func(k uint) []Hash {
+		return hash128Hashes(h, DoubleHash, k, 0)
+	}
+}
+
+// SeededHashes returns the k hashes registered under name, keyed with the given seed. The Hash128
+// functions are seeded natively, while the rest hash the seed before the element
+func SeededHashes(name string, k uint, seed uint64) ([]Hash, error) {
+	if h, index, ok := Hash128ByName(name); ok {
+		return hash128Hashes(h, index, k, seed), nil
+	}
+
+	f, err := HashFactoryByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return SeedHashes(f(k), seed), nil
+}
+
+// SeedHashes keys the given hashes by hashing the seed before the element. A zero seed
+// returns the hashes untouched
+func SeedHashes(hs []Hash, seed uint64) []Hash {
+	if seed == 0 {
+		return hs
+	}
+
+	out := make([]Hash, len(hs))
+	for i, h := range hs {
+		out[i] = seedHash(h, seed)
+	}
+	return out
+}
+
+// SeededAppendHashes is the AppendHash version of SeededHashes. The Hash128 and the default hashes do not
+// allocate, while the ones of the rest of the factories are adapted and still allocate their indices
+func SeededAppendHashes(name string, k uint, seed uint64) ([]AppendHash, error) {
+	if h, index, ok := Hash128ByName(name); ok {
+		return []AppendHash{appendHash128(h, index, k, seed)}, nil
+	}
+
+	var hs []AppendHash
+	if name == HASHER_DEFAULT {
+		if k > uint(len(defaultAppendHashers)) {
+			k = uint(len(defaultAppendHashers))
+		}
+		hs = defaultAppendHashers[:k]
+	} else {
+		f, err := HashFactoryByName(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range f(k) {
+			hs = append(hs, toAppendHash(h))
+		}
+	}
+
+	if seed == 0 {
+		return hs, nil
+	}
+	out := make([]AppendHash, len(hs))
+	for i, h := range hs {
+		out[i] = seedAppendHash(h, seed)
+	}
+	return out, nil
+}
+
+func seedHash(h Hash, seed uint64) Hash {
+	pool := &sync.Pool{
+		New: func() interface{} { return new([]byte) },
+	}
+	return func(elem []byte) []uint {
+		buf := pool.Get().(*[]byte)
+		*buf = binary.LittleEndian.AppendUint64((*buf)[:0], seed)
+		*buf = append(*buf, elem...)
+		out := h(*buf)
+		pool.Put(buf)
+
+		return out
+	}
+}
+
+func seedAppendHash(h AppendHash, seed uint64) AppendHash {
+	pool := &sync.Pool{
+		New: func() interface{} { return new([]byte) },
+	}
+	return func(dst []uint, elem []byte) []uint {
+		buf := pool.Get().(*[]byte)
+		*buf = binary.LittleEndian.AppendUint64((*buf)[:0], seed)
+		*buf = append(*buf, elem...)
+		dst = h(dst, *buf)
+		pool.Put(buf)
+
+		return dst
+	}
+}
+
+func hash128Hashes(h Hash128, index IndexFunc, k uint, seed uint64) []Hash {
+	a := appendHash128(h, index, k, seed)
 	return []Hash{
 		func(b []byte) []uint {
-			hs := FNV128(b)
-			out := make([]uint, k)
-
-			for i := range out {
-				out[i] = hs[0] + uint(i)*hs[1]
-			}
-			return out
+			return a(make([]uint, 0, k), b)
 		},
 	}
 }
 
+func appendHash128(h Hash128, index IndexFunc, k uint, seed uint64) AppendHash {
+	return func(dst []uint, b []byte) []uint {
+		h1, h2 := h(b, seed)
+		for i := uint(0); i < k; i++ {
+			dst = append(dst, index(h1, h2, i))
+		}
+		return dst
+	}
+}
+
+// toHash adapts an AppendHash to the Hash type, allocating the returned indices
+func toHash(h AppendHash) Hash {
+	return func(elem []byte) []uint {
+		return h(nil, elem)
+	}
+}
+
+// toAppendHash adapts a Hash to the AppendHash type. The indices are still allocated by the Hash
+func toAppendHash(h Hash) AppendHash {
+	return func(dst []uint, elem []byte) []uint {
+		return append(dst, h(elem)...)
+	}
+}
+
+// XXHash64Sum is the Hash128 version of XXHash64. The second word is derived from the first one, so the
+// digest only carries 64 bits of entropy: elements colliding in XXHash64 get the same bit indices. Use
+// Murmur3Sum or FNV128Sum when that is not enough
+func XXHash64Sum(b []byte, seed uint64) (uint64, uint64) {
+	h := XXHash64(b, seed)
+	return h, fmix64(h)
+}
+
+// Murmur3Sum is the Hash128 version of Murmur3. The lower 32 bits of the seed initialize both words of the
+// state, as in Murmur3, and the upper ones are mixed into the second word, so the whole seed keys the
+// digest while the seeds under 2^32 keep returning the Murmur3 digests
+func Murmur3Sum(b []byte, seed uint64) (uint64, uint64) {
+	lo := uint64(uint32(seed))
+	return murmur3(b, lo, lo^(seed>>32))
+}
+
+// SipHashSum is the Hash128 version of SipHash, keyed with the seed. The second word is derived from the
+// first one, so the digest only carries 64 bits of entropy, like the one of XXHash64Sum
+func SipHashSum(b []byte, seed uint64) (uint64, uint64) {
+	h := SipHash(seed, fmix64(seed), b)
+	return h, fmix64(h)
+}
+
+const (
+	fnv128OffsetHi = 0x6c62272e07bb0142
+	fnv128OffsetLo = 0x62b821756295c58d
+	fnv128PrimeHi  = 1 << 24
+	fnv128PrimeLo  = 0x13b
+)
+
+// FNV128Sum is the Hash128 version of FNV128: it returns the same words without allocating. A non zero
+// seed is hashed before the element
+func FNV128Sum(b []byte, seed uint64) (uint64, uint64) {
+	hi, lo := uint64(fnv128OffsetHi), uint64(fnv128OffsetLo)
+	if seed != 0 {
+		for i := 0; i < 8; i++ {
+			hi, lo = fnv128Round(hi, lo, byte(seed>>(8*uint(i))))
+		}
+	}
+	for _, c := range b {
+		hi, lo = fnv128Round(hi, lo, c)
+	}
+	// the digest is big endian, while the words are read as little endian from it
+	return bits.ReverseBytes64(hi), bits.ReverseBytes64(lo)
+}
+
+func fnv128Round(hi, lo uint64, c byte) (uint64, uint64) {
+	h, l := bits.Mul64(lo, fnv128PrimeLo)
+	h += hi*fnv128PrimeLo + lo*fnv128PrimeHi
+	return h, l ^ uint64(c)
+}
+
+// HashWrapper adapts a hash.Hash to the Hash type. Calls are serialized, since the wrapped hash is shared
 func HashWrapper(h hash.Hash) Hash {
+	mu := new(sync.Mutex)
 	return func(elem []byte) []uint {
+		mu.Lock()
 		h.Reset()
 		h.Write(elem)
 		result := h.Sum(nil)
-		out := make([]uint, len(result)/8)
-		for i := 0; i < len(result)/8; i++ {
-			out[i] = uint(binary.LittleEndian.Uint64(result[i*8 : (i+1)*8]))
-		}
-		return out
+		mu.Unlock()
+
+		return digestToUints(result)
+	}
+}
+
+// NewHashWrapper adapts a hash.Hash constructor to the Hash type. It keeps a pool of hashes and digest
+// buffers, so the returned Hash is safe for concurrent use and only allocates the returned indices
+func NewHashWrapper(newHash func() hash.Hash) Hash {
+	return toHash(NewAppendHashWrapper(newHash))
+}
+
+// NewAppendHashWrapper is the AppendHash version of NewHashWrapper. It does not allocate when dst has
+// room for the indices
+func NewAppendHashWrapper(newHash func() hash.Hash) AppendHash {
+	pool := &sync.Pool{
+		New: func() interface{} {
+			h := newHash()
+			return &pooledHash{h: h, digest: make([]byte, 0, h.Size())}
+		},
+	}
+	return func(dst []uint, elem []byte) []uint {
+		p := pool.Get().(*pooledHash)
+		p.h.Reset()
+		p.h.Write(elem)
+		p.digest = p.h.Sum(p.digest[:0])
+		dst = appendDigest(dst, p.digest)
+		pool.Put(p)
+
+		return dst
+	}
+}
+
+type pooledHash struct {
+	h      hash.Hash
+	digest []byte
+}
+
+func digestToUints(result []byte) []uint {
+	return appendDigest(make([]uint, 0, len(result)/8), result)
+}
+
+func appendDigest(dst []uint, result []byte) []uint {
+	for i := 0; i+8 <= len(result); i += 8 {
+		dst = append(dst, uint(binary.LittleEndian.Uint64(result[i:i+8])))
 	}
+	return dst
 }
@@ -1,8 +1,12 @@
 package bloomfilter
 
 import (
+	"crypto/md5" // skipcq: GSC-G501
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 )
 
@@ -54,3 +58,250 @@ func BenchmarkOptimalHashFactory(b *testing.B) {
 		})
 	}
 }
+
+func TestXXHash64(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	} {
+		if got := XXHash64([]byte(tc.in), 0); got != tc.want {
+			t.Errorf("xxhash64(%q): got %x, want %x", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMurmur3(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		h1, h2 uint64
+	}{
+		{"", 0, 0},
+		{"hello", 0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19},
+		{"hello, world", 0x342fac623a5ebc8e, 0x4cdcbc079642414d},
+		{"19 Jan 2038 at 3:14:07 AM", 0xb89e5988b737affc, 0x664fc2950231b2cb},
+		{"The quick brown fox jumps over the lazy dog.", 0xcd99481f9ee902c9, 0x695da1a38987b6e7},
+	} {
+		if h1, h2 := Murmur3([]byte(tc.in), 0); h1 != tc.h1 || h2 != tc.h2 {
+			t.Errorf("murmur3(%q): got %x%x, want %x%x", tc.in, h1, h2, tc.h1, tc.h2)
+		}
+	}
+}
+
+func TestMurmur3Sum_seed(t *testing.T) {
+	elem := []byte("hello")
+	for _, seed := range []uint64{0, 1, 0xffffffff} {
+		h1, h2 := Murmur3Sum(elem, seed)
+		if e1, e2 := Murmur3(elem, uint32(seed)); h1 != e1 || h2 != e2 {
+			t.Errorf("seed %x: got %x%x, want %x%x", seed, h1, h2, e1, e2)
+		}
+	}
+
+	seen := map[[2]uint64]uint64{}
+	for _, seed := range []uint64{1, 1 << 32, 1<<32 | 1, 2 << 32, 1 << 63} {
+		h1, h2 := Murmur3Sum(elem, seed)
+		if other, ok := seen[[2]uint64{h1, h2}]; ok {
+			t.Errorf("the seeds %x and %x return the same digest", seed, other)
+		}
+		seen[[2]uint64{h1, h2}] = seed
+	}
+}
+
+func TestSipHash(t *testing.T) {
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	if got := SipHash(k0, k1, nil); got != 0x726fdb47dd0e0e31 {
+		t.Errorf("siphash of the empty message: got %x", got)
+	}
+	if got := SipHash(k0, k1, msg); got != 0xa129ca6149be45e5 {
+		t.Errorf("siphash of the reference message: got %x", got)
+	}
+}
+
+func TestRegisteredHashFactories(t *testing.T) {
+	for _, name := range []string{HASHER_DEFAULT, HASHER_OPTIMAL, HASHER_XXHASH64, HASHER_MURMUR3, HASHER_SIPHASH, HASHER_ENHANCED} {
+		f, err := HashFactoryByName(name)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		for _, hash := range f(7) {
+			array1 := []byte{1, 2, 3}
+			if !reflect.DeepEqual(hash(array1), hash(array1)) {
+				t.Errorf("%s: undeterministic", name)
+			}
+		}
+	}
+}
+
+func TestRegisterHashFactory(t *testing.T) {
+	name := "test-register"
+	if err := RegisterHashFactory(name, OptimalHashFactory); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	defer func() {
+		hashFactoryMutex.Lock()
+		delete(hashFactories, name)
+		delete(HashFactoryNames, name)
+		hashFactoryMutex.Unlock()
+	}()
+
+	if err := RegisterHashFactory(name, OptimalHashFactory); !errors.Is(err, ErrDuplicateHashFactory) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := RegisterHashFactory("", OptimalHashFactory); err != ErrInvalidHashFactoryName {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := RegisterHashFactory("test-nil", nil); err != ErrInvalidHashFactory {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := HashFactoryByName(name); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if _, err := HashFactoryByName("unknown"); !errors.Is(err, ErrUnknownHashFactory) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if HashFactoryNames[name] == nil {
+		t.Errorf("%s not added to HashFactoryNames", name)
+	}
+
+	// the factories added straight to the deprecated map are still found
+	HashFactoryNames["test-legacy"] = OptimalHashFactory
+	defer delete(HashFactoryNames, "test-legacy")
+	if _, err := HashFactoryByName("test-legacy"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := RegisterHashFactory("test-legacy", OptimalHashFactory); !errors.Is(err, ErrDuplicateHashFactory) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	names := RegisteredHashFactories()
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("unsorted names: %v", names)
+	}
+	found := false
+	for _, n := range names {
+		found = found || n == name
+	}
+	if !found {
+		t.Errorf("%s not listed in %v", name, names)
+	}
+}
+
+func BenchmarkHashFactories(b *testing.B) {
+	elem := []byte("a-jwt-id-of-a-revoked-token")
+	for _, name := range []string{HASHER_DEFAULT, HASHER_OPTIMAL, HASHER_XXHASH64, HASHER_MURMUR3, HASHER_SIPHASH, HASHER_ENHANCED} {
+		hashes := hashFactories[name](23)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, hash := range hashes {
+					hash(elem)
+				}
+			}
+		})
+	}
+}
+
+func TestFNV128Sum(t *testing.T) {
+	for _, elem := range [][]byte{nil, {1, 2, 3}, []byte("a-jwt-id-of-a-revoked-token")} {
+		hs := FNV128(elem)
+		h1, h2 := FNV128Sum(elem, 0)
+		if uint(h1) != hs[0] || uint(h2) != hs[1] {
+			t.Errorf("unexpected digest for %v: %x %x", elem, h1, h2)
+		}
+	}
+}
+
+func TestHash128_allocs(t *testing.T) {
+	elem := []byte("a-jwt-id-of-a-revoked-token")
+	for name, e := range hash128Names {
+		if n := testing.AllocsPerRun(100, func() { e.h(elem, 0) }); n != 0 {
+			t.Errorf("%s: %v allocations per run", name, n)
+		}
+	}
+}
+
+func TestHashWrapper_concurrent(t *testing.T) {
+	elems := [][]byte{[]byte("casa"), []byte("grrrrr"), []byte("something")}
+	for k, hash := range append(defaultHashers, HashWrapper(md5.New())) {
+		expected := make([][]uint, len(elems))
+		for i, elem := range elems {
+			expected[i] = hash(elem)
+		}
+
+		wg := new(sync.WaitGroup)
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					j := i % len(elems)
+					if !reflect.DeepEqual(hash(elems[j]), expected[j]) {
+						t.Errorf("hasher %d: unexpected result", k)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestSeededHashes(t *testing.T) {
+	elem := []byte{1, 2, 3}
+	for _, name := range []string{HASHER_DEFAULT, HASHER_OPTIMAL, HASHER_XXHASH64, HASHER_MURMUR3, HASHER_SIPHASH, HASHER_ENHANCED} {
+		unseeded, err := SeededHashes(name, 3, 0)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(unseeded[0](elem), hashFactories[name](3)[0](elem)) {
+			t.Errorf("%s: a zero seed should not change the hashes", name)
+		}
+
+		seeded, _ := SeededHashes(name, 3, 42)
+		if reflect.DeepEqual(unseeded[0](elem), seeded[0](elem)) {
+			t.Errorf("%s: the seed does not change the hashes", name)
+		}
+		if !reflect.DeepEqual(seeded[0](elem), seeded[0](elem)) {
+			t.Errorf("%s: undeterministic", name)
+		}
+	}
+
+	if _, err := SeededHashes("unknown", 3, 42); !errors.Is(err, ErrUnknownHashFactory) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEnhancedHashFactory(t *testing.T) {
+	for _, k := range []uint{1, 5, 23, 40} {
+		hashes := EnhancedHashFactory(k)
+		if len(hashes) != 1 {
+			t.Errorf("unexpected number of hashes: %d", len(hashes))
+			continue
+		}
+		if n := len(hashes[0]([]byte{1, 2, 3})); uint(n) != k {
+			t.Errorf("unexpected number of indices: got %d, want %d", n, k)
+		}
+	}
+}
+
+func TestEnhancedDoubleHash(t *testing.T) {
+	// with h2 = 0 plain double hashing collapses every index into h1
+	seen := map[uint]struct{}{}
+	for i := uint(1); i <= 10; i++ {
+		seen[EnhancedDoubleHash(7, 0, i)%1024] = struct{}{}
+	}
+	if len(seen) != 10 {
+		t.Errorf("unexpected number of different indices: %d", len(seen))
+	}
+}
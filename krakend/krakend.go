@@ -22,7 +22,8 @@ var (
 	errWrongConfig = errors.New("invalid config for the bloomfilter")
 )
 
-// Config defines the configuration to be added to the KrakenD gateway
+// Config defines the configuration to be added to the KrakenD gateway. The rpc connections are secured
+// with the tls settings of the embedded rpc config and the calls authorized with its auth ones
 type Config struct {
 	bf_rpc.Config
 	TokenKeys []string `json:"token_keys"`
@@ -55,7 +56,30 @@ func Register(
 		return nopRejecter, err
 	}
 
-	bf := server.New(ctx, rpcConfig.Config)
+	if err := rpcConfig.Validate(); err != nil {
+		logger.Error(logPrefix, "Invalid bloomfilter configuration:", err.Error())
+		return nopRejecter, err
+	}
+
+	opts := []server.Option{server.OnError(func(err error) {
+		logger.Error(logPrefix, "Unable to restore the bloomfilter:", err.Error())
+	})}
+	// the certs are loaded once and the server gets them with the option instead of the config
+	srvConfig := rpcConfig.Config
+	if srvConfig.TLS != nil {
+		tlsCfg, err := srvConfig.TLS.ServerConfig()
+		if err != nil {
+			logger.Error(logPrefix, "Unable to load the TLS certs:", err.Error())
+			return nopRejecter, err
+		}
+		opts = append(opts, server.WithTLS(tlsCfg))
+		srvConfig.TLS = nil
+	}
+	if rpcConfig.Auth != nil {
+		opts = append(opts, server.WithAuditor(auditor(logger, logPrefix)))
+	}
+
+	bf := server.New(ctx, srvConfig, opts...)
 	register(serviceName, rpcConfig.Port)
 
 	logger.Debug(logPrefix, "Service registered successfully")
@@ -67,6 +91,17 @@ func Register(
 	}, nil
 }
 
+// auditor records the mutating calls with the logger of the gateway, when the auth is enabled
+func auditor(logger logging.Logger, logPrefix string) bf_rpc.Auditor {
+	return func(e bf_rpc.AuditEntry) {
+		if e.Err != nil {
+			logger.Warning(logPrefix, "[AUDIT]", "caller:", e.Caller, "method:", e.Method, "filter:", e.Filter, "count:", e.Count, "error:", e.Err.Error())
+			return
+		}
+		logger.Info(logPrefix, "[AUDIT]", "caller:", e.Caller, "method:", e.Method, "filter:", e.Filter, "count:", e.Count)
+	}
+}
+
 type Rejecter struct {
 	BF        bloomfilter.Bloomfilter
 	TokenKeys []string
@@ -2,6 +2,9 @@ package krakend
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/krakendio/bloomfilter/v2"
@@ -95,3 +98,83 @@ func TestRegister_koNamespace(t *testing.T) {
 	}
 
 }
+
+func TestRegister_koInvalidConfig(t *testing.T) {
+	ctx := context.Background()
+	cfgBloomFilter := Config{
+		Config: rpc.Config{
+			Config: rotate.Config{
+				Config: bloomfilter.Config{
+					N:        10000000,
+					P:        0.0000001,
+					HashName: "unknown",
+				},
+				TTL: 1500,
+			},
+			Port: 1234,
+		},
+	}
+	serviceConf := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{
+			Namespace: cfgBloomFilter,
+		},
+	}
+	logger, err := gologging.NewLogger(config.ExtraConfig{
+		gologging.Namespace: map[string]interface{}{
+			"level":  "DEBUG",
+			"stdout": true,
+		},
+	})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if _, err := Register(ctx, "bloomfilter-test", serviceConf, logger, func(name string, port int) {
+		t.Error("this error should never been called")
+	}); !errors.Is(err, bloomfilter.ErrUnknownHashFactory) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRegister_koTLS(t *testing.T) {
+	ctx := context.Background()
+	cfgBloomFilter := Config{
+		Config: rpc.Config{
+			Config: rotate.Config{
+				Config: bloomfilter.Config{
+					N:        10000000,
+					P:        0.0000001,
+					HashName: "optimal",
+				},
+				TTL: 1500,
+			},
+			Port: 1234,
+			TLS: &rpc.TLSConfig{
+				CertFile: filepath.Join(t.TempDir(), "missing.pem"),
+				KeyFile:  filepath.Join(t.TempDir(), "missing-key.pem"),
+			},
+		},
+	}
+	serviceConf := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{
+			Namespace: cfgBloomFilter,
+		},
+	}
+	logger, err := gologging.NewLogger(config.ExtraConfig{
+		gologging.Namespace: map[string]interface{}{
+			"level":  "DEBUG",
+			"stdout": true,
+		},
+	})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if _, err := Register(ctx, "bloomfilter-test", serviceConf, logger, func(name string, port int) {
+		t.Error("this error should never been called")
+	}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
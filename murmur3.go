@@ -0,0 +1,122 @@
+package bloomfilter
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	murmurC1 uint64 = 0x87c37b91114253d5
+	murmurC2 uint64 = 0x4cf5ad432745937f
+)
+
+// Murmur3 returns the 128 bit MurmurHash3 (x64 variant) digest of b using the given seed
+func Murmur3(b []byte, seed uint32) (uint64, uint64) {
+	return murmur3(b, uint64(seed), uint64(seed))
+}
+
+// murmur3 is Murmur3 with the two words of the state initialized independently
+func murmur3(b []byte, h1, h2 uint64) (uint64, uint64) {
+	n := len(b)
+
+	for ; len(b) >= 16; b = b[16:] {
+		k1 := binary.LittleEndian.Uint64(b[0:8])
+		k2 := binary.LittleEndian.Uint64(b[8:16])
+
+		h1 ^= murmurMixK1(k1)
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		h2 ^= murmurMixK2(k2)
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	var k1, k2 uint64
+	switch len(b) {
+	case 15:
+		k2 ^= uint64(b[14]) << 48
+		fallthrough
+	case 14:
+		k2 ^= uint64(b[13]) << 40
+		fallthrough
+	case 13:
+		k2 ^= uint64(b[12]) << 32
+		fallthrough
+	case 12:
+		k2 ^= uint64(b[11]) << 24
+		fallthrough
+	case 11:
+		k2 ^= uint64(b[10]) << 16
+		fallthrough
+	case 10:
+		k2 ^= uint64(b[9]) << 8
+		fallthrough
+	case 9:
+		k2 ^= uint64(b[8])
+		h2 ^= murmurMixK2(k2)
+		fallthrough
+	case 8:
+		k1 ^= uint64(b[7]) << 56
+		fallthrough
+	case 7:
+		k1 ^= uint64(b[6]) << 48
+		fallthrough
+	case 6:
+		k1 ^= uint64(b[5]) << 40
+		fallthrough
+	case 5:
+		k1 ^= uint64(b[4]) << 32
+		fallthrough
+	case 4:
+		k1 ^= uint64(b[3]) << 24
+		fallthrough
+	case 3:
+		k1 ^= uint64(b[2]) << 16
+		fallthrough
+	case 2:
+		k1 ^= uint64(b[1]) << 8
+		fallthrough
+	case 1:
+		k1 ^= uint64(b[0])
+		h1 ^= murmurMixK1(k1)
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+
+	h1 += h2
+	h2 += h1
+
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+
+	h1 += h2
+	h2 += h1
+
+	return h1, h2
+}
+
+func murmurMixK1(k uint64) uint64 {
+	k *= murmurC1
+	k = bits.RotateLeft64(k, 31)
+	return k * murmurC2
+}
+
+func murmurMixK2(k uint64) uint64 {
+	k *= murmurC2
+	k = bits.RotateLeft64(k, 33)
+	return k * murmurC1
+}
+
+// fmix64 is the MurmurHash3 finalizer. It is also used to derive a second word from 64 bit digests
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
@@ -0,0 +1,237 @@
+package rotate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CheckpointConfig enables the periodic persistence of a sliding set of bloomfilters into Dir, every
+// Interval seconds, keeping the last Retention snapshots. When Dir is empty, no checkpoint is taken
+type CheckpointConfig struct {
+	Dir       string `json:"dir,omitempty"`
+	Interval  uint   `json:"interval,omitempty"`
+	Retention uint   `json:"retention,omitempty"`
+}
+
+const (
+	// DefaultCheckpointInterval is used when the checkpoint interval is not configured
+	DefaultCheckpointInterval = time.Minute
+	// DefaultCheckpointRetention is the number of snapshots kept when the retention is not configured
+	DefaultCheckpointRetention = 3
+
+	checkpointPrefix = "checkpoint-"
+	checkpointSuffix = ".bf"
+	checkpointMagic  = "KRC1"
+)
+
+var (
+	// ErrNoCheckpointDir is returned when taking a checkpoint of a set without a checkpoint dir
+	ErrNoCheckpointDir = errors.New("no checkpoint dir configured")
+	// ErrIncompatibleCheckpoint is returned when the snapshot was taken with a different bloomfilter config
+	ErrIncompatibleCheckpoint = errors.New("incompatible checkpoint")
+)
+
+func (c CheckpointConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return DefaultCheckpointInterval
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+func (c CheckpointConfig) retention() int {
+	if c.Retention == 0 {
+		return DefaultCheckpointRetention
+	}
+	return int(c.Retention)
+}
+
+// Checkpoint persists the sliding set of bloomfilters into the configured dir. The snapshot is written into
+// a temporary file renamed once it is synced, so a crash never leaves a partial snapshot behind. Older
+// snapshots exceeding the configured retention are removed
+func (bs *Bloomfilter) Checkpoint() error {
+	cfg := bs.Config.Checkpoint
+	if cfg.Dir == "" {
+		return ErrNoCheckpointDir
+	}
+
+	bs.checkpointMutex.Lock()
+	defer bs.checkpointMutex.Unlock()
+
+	err := bs.checkpoint(cfg, bs.opts.now())
+	bs.checkpointErr = err
+	return err
+}
+
+// CheckpointError returns the error of the last checkpoint, if any
+func (bs *Bloomfilter) CheckpointError() error {
+	bs.checkpointMutex.Lock()
+	defer bs.checkpointMutex.Unlock()
+
+	return bs.checkpointErr
+}
+
+func (bs *Bloomfilter) checkpoint(cfg CheckpointConfig, now time.Time) error {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(cfg.Dir, "."+checkpointPrefix+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := bs.writeCheckpoint(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(cfg.Dir, fmt.Sprintf("%s%020d%s", checkpointPrefix, now.UnixNano(), checkpointSuffix))
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	if err := syncDir(cfg.Dir); err != nil {
+		return err
+	}
+
+	snapshots, err := listCheckpoints(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for i := cfg.retention(); i < len(snapshots); i++ {
+		if err := os.Remove(snapshots[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCheckpoint writes the magic of the checkpoints followed by the serialized set, which records the
+// time of its last rotation
+func (bs *Bloomfilter) writeCheckpoint(f io.Writer) error {
+	filters, cfg, rotatedAt := bs.snapshot()
+
+	w := bufio.NewWriter(f)
+	if _, err := w.WriteString(checkpointMagic); err != nil {
+		return err
+	}
+	zw, err := compress(w, bs.opts.compressorFor(cfg.Compression))
+	if err != nil {
+		return err
+	}
+	if err := writeStream(zw, cfg, filters, rotatedAt); err != nil {
+		zw.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func readCheckpoint(name string, fallback Compressor) (*SerializibleBloomfilter, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if string(magic) != checkpointMagic {
+		return nil, fmt.Errorf("%s is not a checkpoint", name)
+	}
+
+	return readStream(r, fallback)
+}
+
+// restoreCheckpoint loads the newest usable snapshot of the checkpoint dir, rotating it as many times as
+// TTLs elapsed since its last rotation. It returns the time left until the next rotation
+func (bs *Bloomfilter) restoreCheckpoint(now time.Time) (time.Duration, error) {
+	snapshots, err := listCheckpoints(bs.Config.Checkpoint.Dir)
+	if err != nil || len(snapshots) == 0 {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return bs.catchUp(now, now), err
+	}
+
+	var errs []string
+	for _, name := range snapshots {
+		target, err := readCheckpoint(name, bs.opts.compressorFor(bs.Config.Compression))
+		if err == nil && target.Config.Config != bs.Config.Config {
+			err = ErrIncompatibleCheckpoint
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", filepath.Base(name), err.Error()))
+			continue
+		}
+
+		bs.Previous, bs.Current, bs.Next = target.Previous, target.Current, target.Next
+		rotatedAt := target.RotatedAt
+		if rotatedAt.IsZero() {
+			rotatedAt = now
+		}
+		return bs.catchUp(rotatedAt, now), nil
+	}
+	return bs.catchUp(now, now), fmt.Errorf("unable to restore a checkpoint: %s", strings.Join(errs, ", "))
+}
+
+func (bs *Bloomfilter) keepCheckpointing(ctx context.Context) {
+	interval := bs.Config.Checkpoint.interval()
+	for {
+		select {
+		case <-bs.opts.after(interval):
+			bs.Checkpoint()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listCheckpoints returns the snapshots of the dir, the newest first
+func listCheckpoints(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && strings.HasPrefix(name, checkpointPrefix) && strings.HasSuffix(name, checkpointSuffix) {
+			names = append(names, filepath.Join(dir, name))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -1,8 +1,16 @@
 package rotate
 
 import (
+	"bufio"
+	"compress/flate"
 	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
+
+	"github.com/krakendio/bloomfilter/v2"
 )
 
 // Compressor type with new writer and reader function interface
@@ -11,11 +19,158 @@ type Compressor interface {
 	NewReader(io.Reader) (io.Reader, error)
 }
 
-var compressor Compressor = new(Gzip)
+var (
+	compressorMutex            = new(sync.RWMutex)
+	compressor      Compressor = new(Gzip)
+)
 
-// SetCompressor is a compressor setter
+// SetCompressor is a compressor setter. It sets the compressor of the sets and rings without a codec in
+// their config nor a compressor option.
+//
+// Deprecated: set the codec in the Config or use the WithCompressor option
 func SetCompressor(c Compressor) {
+	compressorMutex.Lock()
 	compressor = c
+	compressorMutex.Unlock()
+}
+
+func defaultCompressor() Compressor {
+	compressorMutex.RLock()
+	defer compressorMutex.RUnlock()
+
+	return compressor
+}
+
+// The codecs of this package record their id in an uncompressed envelope preceding the compressed payload,
+// so it can be decompressed without knowing its codec in advance:
+//
+//	offset  size  field
+//	0       3     magic "KRZ"
+//	3       1     codec id: 0 none, 1 gzip, 2 flate, 3 rle
+//	4       ...   the payload, compressed with the codec
+//
+// The payloads without envelope, written by custom compressors or by previous versions of this package,
+// are decompressed with the configured compressor, gzip by default
+const (
+	codecMagic      = "KRZ"
+	codecHeaderSize = 4
+)
+
+const (
+	codecNone byte = iota
+	codecGzip
+	codecFlate
+	codecRLE
+)
+
+// The names of the codecs for the CompressionConfig
+const (
+	CodecNone  = "none"
+	CodecGzip  = "gzip"
+	CodecFlate = "flate"
+	CodecRLE   = "rle"
+)
+
+var (
+	// ErrUnknownCodec is returned when the codec is not one of this package
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrInvalidCompressionLevel is returned when the compression level is out of range
+	ErrInvalidCompressionLevel = fmt.Errorf("the compression level must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+)
+
+// CompressionConfig selects the codec used when serializing: none, gzip (the default), flate or rle. Level
+// is the compression level of flate, as defined by compress/flate, 0 selecting the default one
+type CompressionConfig struct {
+	Codec string `json:"codec,omitempty"`
+	Level int    `json:"level,omitempty"`
+}
+
+// Validate checks the codec and its level
+func (c CompressionConfig) Validate() error {
+	if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		return ErrInvalidCompressionLevel
+	}
+	switch c.Codec {
+	case "", CodecNone, CodecGzip, CodecFlate, CodecRLE:
+		return nil
+	}
+	return ErrUnknownCodec
+}
+
+// validate wraps the error of Validate with the field of the config it comes from
+func (c CompressionConfig) validate() error {
+	err := c.Validate()
+	if err == nil {
+		return nil
+	}
+	field := "compression.codec"
+	if err == ErrInvalidCompressionLevel {
+		field = "compression.level"
+	}
+	return &bloomfilter.ConfigError{Field: field, Err: err}
+}
+
+// compressor returns the configured codec, nil when there is none
+func (c CompressionConfig) compressor() Compressor {
+	switch c.Codec {
+	case CodecNone:
+		return None{}
+	case CodecGzip:
+		return new(Gzip)
+	case CodecFlate:
+		if c.Level == 0 {
+			return Flate(flate.DefaultCompression)
+		}
+		return Flate(c.Level)
+	case CodecRLE:
+		return RLE{}
+	}
+	return nil
+}
+
+// identified is implemented by the codecs of this package
+type identified interface {
+	codecID() byte
+}
+
+// compress returns a writer compressing into w with c, preceded by the envelope when c is a codec of this
+// package
+func compress(w io.Writer, c Compressor) (io.WriteCloser, error) {
+	if id, ok := c.(identified); ok {
+		if _, err := w.Write(append([]byte(codecMagic), id.codecID())); err != nil {
+			return nil, err
+		}
+	}
+	return c.NewWriter(w), nil
+}
+
+// decompress returns a reader decompressing r with the codec named in its envelope or with fallback, when
+// there is no envelope
+func decompress(r io.Reader, fallback Compressor) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(codecHeaderSize)
+	if len(header) < codecHeaderSize || string(header[:len(codecMagic)]) != codecMagic {
+		if fallback == nil {
+			fallback = defaultCompressor()
+		}
+		return fallback.NewReader(br)
+	}
+	br.Discard(codecHeaderSize)
+
+	var c Compressor
+	switch header[3] {
+	case codecNone:
+		c = None{}
+	case codecGzip:
+		c = new(Gzip)
+	case codecFlate:
+		c = Flate(flate.DefaultCompression)
+	case codecRLE:
+		c = RLE{}
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, header[3])
+	}
+	return c.NewReader(br)
 }
 
 // Gzip type implementing the Compressor interface
@@ -30,3 +185,206 @@ func (*Gzip) NewWriter(w io.Writer) io.WriteCloser {
 func (*Gzip) NewReader(r io.Reader) (io.Reader, error) {
 	return gzip.NewReader(r)
 }
+
+func (*Gzip) codecID() byte { return codecGzip }
+
+// Flate is the Compressor using the DEFLATE format at the compression level it holds, as defined by
+// compress/flate. The level is not needed to decompress
+type Flate int
+
+// NewWriter implementation for Flate
+func (f Flate) NewWriter(w io.Writer) io.WriteCloser {
+	zw, err := flate.NewWriter(w, int(f))
+	if err != nil {
+		return errWriter{err}
+	}
+	return zw
+}
+
+// NewReader implementation for Flate
+func (Flate) NewReader(r io.Reader) (io.Reader, error) {
+	return flate.NewReader(r), nil
+}
+
+func (Flate) codecID() byte { return codecFlate }
+
+// None is the Compressor leaving the payload as it is
+type None struct{}
+
+// NewWriter implementation for None
+func (None) NewWriter(w io.Writer) io.WriteCloser {
+	return nopCloser{w}
+}
+
+// NewReader implementation for None
+func (None) NewReader(r io.Reader) (io.Reader, error) {
+	return r, nil
+}
+
+func (None) codecID() byte { return codecNone }
+
+// RLE is a run-length Compressor tuned for sparse bit arrays: the runs of zero bytes are replaced by their
+// length and the rest of the bytes are copied as they are. It is way cheaper than the general purpose
+// codecs and as effective for bloomfilters with a low fill ratio.
+//
+// The payload is a sequence of uvarints: the length of a run of zero bytes shifted left by one, or the
+// length of a literal shifted left by one with the low bit set, followed by the bytes of the literal.
+// Runs are up to 1 MB long and literals up to 64 KB
+type RLE struct{}
+
+const (
+	rleMinRun     = 8
+	rleMaxRun     = 1 << 20
+	rleMaxLiteral = 1 << 16
+)
+
+// ErrInvalidRLE is returned when decompressing a run longer than the ones written by the RLE codec
+var ErrInvalidRLE = errors.New("invalid rle payload")
+
+// NewWriter implementation for RLE
+func (RLE) NewWriter(w io.Writer) io.WriteCloser {
+	return &rleWriter{w: bufio.NewWriter(w)}
+}
+
+// NewReader implementation for RLE
+func (RLE) NewReader(r io.Reader) (io.Reader, error) {
+	return &rleReader{r: bufio.NewReader(r)}, nil
+}
+
+func (RLE) codecID() byte { return codecRLE }
+
+type rleWriter struct {
+	w     *bufio.Writer
+	lit   []byte
+	zeros int
+	err   error
+}
+
+func (z *rleWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == 0 {
+			z.zeros++
+			continue
+		}
+		if z.zeros > 0 {
+			z.flushZeros()
+		}
+		z.appendLiteral(b)
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	return len(p), nil
+}
+
+// flushZeros writes the pending run of zero bytes, keeping it in the literal when it is too short
+func (z *rleWriter) flushZeros() {
+	if z.zeros < rleMinRun {
+		for ; z.zeros > 0; z.zeros-- {
+			z.appendLiteral(0)
+		}
+		return
+	}
+	z.flushLiteral()
+	for z.zeros > 0 {
+		run := minInt(z.zeros, rleMaxRun)
+		z.token(uint64(run) << 1)
+		z.zeros -= run
+	}
+}
+
+// appendLiteral adds the byte to the pending literal, flushing it first when it is full
+func (z *rleWriter) appendLiteral(b byte) {
+	if len(z.lit) >= rleMaxLiteral {
+		z.flushLiteral()
+	}
+	z.lit = append(z.lit, b)
+}
+
+func (z *rleWriter) flushLiteral() {
+	if len(z.lit) == 0 {
+		return
+	}
+	z.token(uint64(len(z.lit))<<1 | 1)
+	if _, err := z.w.Write(z.lit); err != nil && z.err == nil {
+		z.err = err
+	}
+	z.lit = z.lit[:0]
+}
+
+func (z *rleWriter) token(t uint64) {
+	if _, err := z.w.Write(binary.AppendUvarint(nil, t)); err != nil && z.err == nil {
+		z.err = err
+	}
+}
+
+func (z *rleWriter) Close() error {
+	z.flushZeros()
+	z.flushLiteral()
+	if z.err != nil {
+		return z.err
+	}
+	return z.w.Flush()
+}
+
+type rleReader struct {
+	r          *bufio.Reader
+	zeros, lit uint64
+}
+
+func (z *rleReader) Read(p []byte) (int, error) {
+	for z.zeros == 0 && z.lit == 0 {
+		t, err := binary.ReadUvarint(z.r)
+		if err != nil {
+			return 0, err
+		}
+		if t&1 == 0 {
+			z.zeros = t >> 1
+		} else {
+			z.lit = t >> 1
+		}
+		if z.zeros > rleMaxRun || z.lit > rleMaxLiteral {
+			return 0, ErrInvalidRLE
+		}
+	}
+
+	n := uint64(len(p))
+	if z.zeros > 0 {
+		if n > z.zeros {
+			n = z.zeros
+		}
+		for i := range p[:n] {
+			p[i] = 0
+		}
+		z.zeros -= n
+		return int(n), nil
+	}
+
+	if n > z.lit {
+		n = z.lit
+	}
+	m, err := z.r.Read(p[:n])
+	z.lit -= uint64(m)
+	return m, unexpectedEOF(err)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func (w errWriter) Close() error { return w.err }
@@ -0,0 +1,304 @@
+package rotate
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestCompressor_roundTrip(t *testing.T) {
+	sparse := make([]byte, 100000)
+	for i := 0; i < len(sparse); i += 997 {
+		sparse[i] = byte(i)
+	}
+	dense := make([]byte, 10000)
+	for i := range dense {
+		dense[i] = byte(i%251) + 1
+	}
+	short := []byte{0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2, 0}
+
+	for name, c := range map[string]Compressor{
+		"none":          None{},
+		"gzip":          new(Gzip),
+		"flate":         Flate(flate.DefaultCompression),
+		"flate best":    Flate(flate.BestCompression),
+		"flate huffman": Flate(flate.HuffmanOnly),
+		"rle":           RLE{},
+	} {
+		for _, data := range [][]byte{sparse, dense, short, {}} {
+			buf := new(bytes.Buffer)
+			w, err := compress(buf, c)
+			if err != nil {
+				t.Errorf("%s: unexpected error, %v", name, err)
+				continue
+			}
+			// write it in small chunks, splitting the runs
+			for i := 0; i < len(data); i += 100 {
+				end := i + 100
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err := w.Write(data[i:end]); err != nil {
+					t.Errorf("%s: unexpected error, %v", name, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("%s: unexpected error, %v", name, err)
+				continue
+			}
+
+			// the codec is detected, whatever the fallback
+			r, err := decompress(buf, RLE{})
+			if err != nil {
+				t.Errorf("%s: unexpected error, %v", name, err)
+				continue
+			}
+			res, err := io.ReadAll(r)
+			if err != nil {
+				t.Errorf("%s: unexpected error, %v", name, err)
+				continue
+			}
+			if !bytes.Equal(res, data) {
+				t.Errorf("%s: unexpected decompressed data of %d bytes, want %d", name, len(res), len(data))
+			}
+		}
+	}
+}
+
+func TestCompressor_RLE_sparse(t *testing.T) {
+	data := make([]byte, 1<<20)
+	data[12345] = 1
+	data[654321] = 0xff
+
+	buf := new(bytes.Buffer)
+	w := RLE{}.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	if buf.Len() > 32 {
+		t.Errorf("the sparse data was not compressed: %d bytes", buf.Len())
+	}
+
+	r, _ := RLE{}.NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if _, err := io.ReadAll(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestCompressor_RLE_runs(t *testing.T) {
+	data := make([]byte, 3*rleMaxRun+1)
+	data[len(data)-1] = 1
+
+	buf := new(bytes.Buffer)
+	w := RLE{}.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	r, _ := RLE{}.NewReader(bytes.NewReader(buf.Bytes()))
+	res, err := io.ReadAll(r)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Errorf("unexpected decompressed data of %d bytes, want %d", len(res), len(data))
+	}
+
+	// dense data with short runs of zeros, crossing the limit of the literals many times
+	dense := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(dense)
+	for i := 0; i < len(dense); i += 1000 {
+		copy(dense[i:], []byte{0, 0, 0})
+	}
+	buf.Reset()
+	w = RLE{}.NewWriter(buf)
+	w.Write(dense)
+	if err := w.Close(); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	r, _ = RLE{}.NewReader(bytes.NewReader(buf.Bytes()))
+	if res, err := io.ReadAll(r); err != nil || !bytes.Equal(res, dense) {
+		t.Errorf("unexpected decompressed dense data of %d bytes: %v", len(res), err)
+	}
+
+	for _, token := range []uint64{(rleMaxRun + 1) << 1, (rleMaxLiteral+1)<<1 | 1} {
+		r, _ := RLE{}.NewReader(bytes.NewReader(binary.AppendUvarint(nil, token)))
+		if _, err := io.ReadAll(r); !errors.Is(err, ErrInvalidRLE) {
+			t.Errorf("Unexpected error, %v", err)
+		}
+	}
+}
+
+func TestRotate_UnmarshalBinary_expansion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{Config: testutils.TestCfg, TTL: 5}
+	c, _ := marshalConfig(cfg)
+	header := make([]byte, formatHeaderSize)
+	copy(header, formatMagic)
+	header[4] = FormatVersion
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(c)))
+
+	// the header is followed by 1 GB of zeros instead of the bloomfilters
+	zeros := &expandingCompressor{header: append(header, c...), zeros: 1 << 30}
+	set := New(ctx, cfg, WithCompressor(zeros))
+	if err := set.UnmarshalBinary([]byte("payload")); err == nil {
+		t.Error("the expanded payload was accepted")
+	}
+	if max := 3*set.Current.BinarySize() + 1<<16; zeros.read > max {
+		t.Errorf("%d decompressed bytes read, want at most %d", zeros.read, max)
+	}
+}
+
+// expandingCompressor decompresses any payload into its header followed by the given number of zeros
+type expandingCompressor struct {
+	None
+	header []byte
+	zeros  int
+	read   int
+}
+
+func (c *expandingCompressor) NewReader(io.Reader) (io.Reader, error) {
+	return io.MultiReader(bytes.NewReader(c.header), c), nil
+}
+
+func (c *expandingCompressor) Read(p []byte) (int, error) {
+	if c.zeros == 0 {
+		return 0, io.EOF
+	}
+	n := minInt(len(p), c.zeros)
+	for i := range p[:n] {
+		p[i] = 0
+	}
+	c.zeros -= n
+	c.read += n
+	return n, nil
+}
+
+func TestCompressor_unknownCodec(t *testing.T) {
+	if _, err := decompress(bytes.NewReader([]byte("KRZ\x09payload")), nil); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestRotate_Compression(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	elem := []byte("wwwww")
+	for _, codec := range []string{"", CodecNone, CodecGzip, CodecFlate, CodecRLE} {
+		cfg := Config{Config: testutils.TestCfg, TTL: 5, Compression: CompressionConfig{Codec: codec, Level: 9}}
+		set1, err := Build(ctx, cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error, %v", codec, err)
+			continue
+		}
+		set1.Add(elem)
+		data, err := set1.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: unexpected error, %v", codec, err)
+			continue
+		}
+
+		// the receiver detects the codec, whatever its own config
+		set2 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5, Compression: CompressionConfig{Codec: CodecRLE}})
+		if err := set2.UnmarshalBinary(data); err != nil {
+			t.Errorf("%s: unexpected error, %v", codec, err)
+			continue
+		}
+		if !set2.Check(elem) || set2.Config.Compression.Codec != CodecRLE {
+			t.Errorf("%s: the set was not restored", codec)
+		}
+
+		ring := NewRing(ctx, cfg.Ring())
+		if err := ring.UnmarshalBinary(data); err != nil || !ring.Check(elem) {
+			t.Errorf("%s: the set was not restored as a ring, %v", codec, err)
+		}
+	}
+}
+
+func TestRotate_WithCompressor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{Config: testutils.TestCfg, TTL: 5, Compression: CompressionConfig{Codec: CodecRLE}}
+	set1 := New(ctx, cfg, WithCompressor(new(Gzip)))
+	data, err := set1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !bytes.HasPrefix(data, []byte{'K', 'R', 'Z', codecGzip}) {
+		t.Errorf("unexpected envelope %v", data[:codecHeaderSize])
+	}
+
+	// custom compressors write no envelope, so the receiver needs the same one
+	set2 := New(ctx, cfg, WithCompressor(custom{}))
+	data, err = set2.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if err := New(ctx, cfg, WithCompressor(custom{})).UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if err := New(ctx, cfg).UnmarshalBinary(data); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestRotate_Compression_invalid(t *testing.T) {
+	for _, tc := range []struct {
+		cfg CompressionConfig
+		err error
+	}{
+		{CompressionConfig{Codec: "zstd"}, ErrUnknownCodec},
+		{CompressionConfig{Codec: CodecFlate, Level: 10}, ErrInvalidCompressionLevel},
+	} {
+		cfg := Config{Config: testutils.TestCfg, TTL: 5, Compression: tc.cfg}
+		if _, err := Build(context.Background(), cfg); !errors.Is(err, tc.err) {
+			t.Errorf("Unexpected error, %v", err)
+		}
+		ringCfg := RingConfig{Config: testutils.TestCfg, TTL: 5, Generations: 2, Compression: tc.cfg}
+		if _, err := BuildRing(context.Background(), ringCfg); !errors.Is(err, tc.err) {
+			t.Errorf("Unexpected error, %v", err)
+		}
+	}
+}
+
+// custom is a compressor unknown to the package, xoring the payload
+type custom struct{}
+
+func (custom) NewWriter(w io.Writer) io.WriteCloser {
+	return nopCloser{xor{w: w}}
+}
+
+func (custom) NewReader(r io.Reader) (io.Reader, error) {
+	return xor{r: r}, nil
+}
+
+type xor struct {
+	w io.Writer
+	r io.Reader
+}
+
+func (x xor) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	for i := range p {
+		b[i] = p[i] ^ 0x5a
+	}
+	return x.w.Write(b)
+}
+
+func (x xor) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0x5a
+	}
+	return n, err
+}
@@ -0,0 +1,295 @@
+package rotate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+)
+
+// Before compression, a serialized set of sliding bloomfilters contains:
+//
+//	offset  size  field
+//	0       4     magic "KRT1"
+//	4       1     version, currently 1
+//	5       3     reserved, 0
+//	8       4     length l of the config, little endian
+//	12      8     time of the last rotation in unix nanoseconds, little endian, 0 when unknown
+//	20      l     the config, json encoded
+//	...     ...   the previous, current and next bloomfilters in the binary format of the bloomfilter package
+//	...     4     CRC32C (Castagnoli) of all the previous bytes, little endian
+const (
+	// FormatVersion is the version of the format written by WriteTo and MarshalBinary
+	FormatVersion = 1
+
+	formatMagic      = "KRT1"
+	formatHeaderSize = 20
+	maxConfigSize    = 1 << 20
+)
+
+var (
+	// ErrUnsupportedVersion is returned when decoding a format version unknown to this package
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+	// ErrInvalidPayload is returned when a serialized set of sliding bloomfilters is well formed but
+	// describes an unusable one
+	ErrInvalidPayload = errors.New("invalid serialized sliding bloomfilters")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WriteTo streams the sliding set of bloomfilters to w through the compressor. The bit arrays are written
+// in chunks, so the whole payload is never held in memory. It returns the number of compressed bytes written
+func (bs *Bloomfilter) WriteTo(w io.Writer) (int64, error) {
+	filters, cfg, rotatedAt := bs.snapshot()
+
+	cw := &countingWriter{w: w}
+	zw, err := compress(cw, bs.opts.compressorFor(cfg.Compression))
+	if err != nil {
+		return cw.n, err
+	}
+	if err := writeStream(zw, cfg, filters, rotatedAt); err != nil {
+		zw.Close()
+		return cw.n, err
+	}
+	err = zw.Close()
+	return cw.n, err
+}
+
+func writeStream(zw io.Writer, cfg Config, filters []*bbloomfilter.Bloomfilter, rotatedAt time.Time) error {
+	c, err := marshalConfig(cfg)
+	if err != nil {
+		return err
+	}
+	return encodeStream(zw, formatMagic, c, filters, rotatedAt)
+}
+
+// encodeStream writes the header with the given magic, the time of the last rotation and the encoded
+// config, followed by the filters and the checksum of all of them
+func encodeStream(zw io.Writer, magic string, c []byte, filters []*bbloomfilter.Bloomfilter, rotatedAt time.Time) error {
+	crc := crc32.New(crc32c)
+	w := io.MultiWriter(zw, crc)
+
+	header := make([]byte, formatHeaderSize, formatHeaderSize+len(c))
+	copy(header, magic)
+	header[4] = FormatVersion
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(c)))
+	if !rotatedAt.IsZero() {
+		binary.LittleEndian.PutUint64(header[12:], uint64(rotatedAt.UnixNano()))
+	}
+	if _, err := w.Write(append(header, c...)); err != nil {
+		return err
+	}
+
+	for _, f := range filters {
+		if _, err := f.WriteTo(w); err != nil {
+			return err
+		}
+	}
+
+	_, err := zw.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// ReadFrom replaces the sliding set of bloomfilters with the one streamed from r, stopping the rotation
+// of the replaced one. Payloads in the legacy gob format are accepted too. It returns the number of
+// bytes read from r
+func (bs *Bloomfilter) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	target, err := readStream(cr, bs.opts.compressorFor(bs.Config.Compression))
+	if err != nil {
+		return cr.n, err
+	}
+
+	bs.restore(target)
+	return cr.n, nil
+}
+
+func readStream(r io.Reader, fallback Compressor) (*SerializibleBloomfilter, error) {
+	br, magic, err := openStream(r, fallback)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSet(br, magic)
+}
+
+// openStream decompresses r, peeking the magic of the payload. The payloads not recording their codec are
+// decompressed with fallback
+func openStream(r io.Reader, fallback Compressor) (*bufio.Reader, string, error) {
+	zr, err := decompress(r, fallback)
+	if err != nil {
+		return nil, "", err
+	}
+	br := bufio.NewReader(zr)
+	magic, _ := br.Peek(len(formatMagic))
+	return br, string(magic), nil
+}
+
+func decodeSet(br *bufio.Reader, magic string) (*SerializibleBloomfilter, error) {
+	target := &SerializibleBloomfilter{}
+	if magic != formatMagic {
+		if err := gob.NewDecoder(br).Decode(target); err != nil && err != io.EOF {
+			return nil, err
+		}
+	} else {
+		filters, rotatedAt, err := readFilters(br, func(c []byte) (int, bloomfilter.Config, error) {
+			if err := json.Unmarshal(c, &target.Config); err != nil {
+				return 0, bloomfilter.Config{}, err
+			}
+			if err := target.Config.Validate(); err != nil {
+				return 0, bloomfilter.Config{}, fmt.Errorf("%w: %s", ErrInvalidPayload, err.Error())
+			}
+			return 3, target.Config.Config, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		target.Previous, target.Current, target.Next = filters[0], filters[1], filters[2]
+		target.RotatedAt = rotatedAt
+		if _, err := br.Peek(1); err != io.EOF {
+			return nil, errors.New("trailing data after the sliding bloomfilters")
+		}
+	}
+	if err := target.validate(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for _, f := range []**bbloomfilter.Bloomfilter{&target.Previous, &target.Current, &target.Next} {
+		if *f, err = toConcurrent(target.Config.Config, *f); err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+// readFilters reads a stream written by encodeStream. The config is handed to parse, returning the number
+// of filters following it and their config. No more bytes than the ones of those filters are read, so a
+// forged payload can not expand beyond the size implied by its config. It also returns the time of the
+// last rotation, the zero time when unknown
+func readFilters(zr io.Reader, parse func([]byte) (int, bloomfilter.Config, error)) ([]*bbloomfilter.Bloomfilter, time.Time, error) {
+	crc := crc32.New(crc32c)
+	r := io.TeeReader(zr, crc)
+
+	header := make([]byte, formatHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, time.Time{}, unexpectedEOF(err)
+	}
+	if version := header[4]; version != FormatVersion {
+		return nil, time.Time{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	var rotatedAt time.Time
+	if ns := int64(binary.LittleEndian.Uint64(header[12:])); ns != 0 {
+		rotatedAt = time.Unix(0, ns)
+	}
+	l := binary.LittleEndian.Uint32(header[8:])
+	if l > maxConfigSize {
+		return nil, time.Time{}, fmt.Errorf("config too large: %d bytes", l)
+	}
+	c := make([]byte, l)
+	if _, err := io.ReadFull(r, c); err != nil {
+		return nil, time.Time{}, unexpectedEOF(err)
+	}
+	n, cfg, err := parse(c)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	lr := &io.LimitedReader{R: r, N: int64(n) * int64(bbloomfilter.ConfigBinarySize(cfg))}
+	filters := make([]*bbloomfilter.Bloomfilter, n)
+	for i := range filters {
+		filters[i] = new(bbloomfilter.Bloomfilter)
+		if _, err := filters[i].ReadFrom(lr); err != nil {
+			return nil, time.Time{}, unexpectedEOF(err)
+		}
+	}
+
+	sum := crc.Sum32()
+	var trailer [4]byte
+	if _, err := io.ReadFull(zr, trailer[:]); err != nil {
+		return nil, time.Time{}, unexpectedEOF(err)
+	}
+	if binary.LittleEndian.Uint32(trailer[:]) != sum {
+		return nil, time.Time{}, bbloomfilter.ErrBadChecksum
+	}
+	return filters, rotatedAt, nil
+}
+
+// validate checks the deserialized set of sliding bloomfilters can be used
+func (s *SerializibleBloomfilter) validate() error {
+	if err := s.Config.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPayload, err.Error())
+	}
+	for _, f := range []struct {
+		name string
+		bf   *bbloomfilter.Bloomfilter
+	}{{"previous", s.Previous}, {"current", s.Current}, {"next", s.Next}} {
+		if f.bf == nil {
+			return fmt.Errorf("%w: missing %s bloomfilter", ErrInvalidPayload, f.name)
+		}
+		if cfg := f.bf.Config(); cfg != s.Config.Config {
+			return fmt.Errorf("%w: the config of the %s bloomfilter does not match the one of the set", ErrInvalidPayload, f.name)
+		}
+	}
+	return nil
+}
+
+// EstimatedSize returns the size of the serialized sliding set of bloomfilters before compression,
+// without serializing it. The bit array of a loaded bloomfilter barely compresses, so it is also a
+// good estimation of the size of the compressed payload
+func (bs *Bloomfilter) EstimatedSize() int {
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+
+	c, _ := marshalConfig(bs.Config)
+	size := formatHeaderSize + len(c) + 4
+	for _, f := range []*bbloomfilter.Bloomfilter{bs.Previous, bs.Current, bs.Next} {
+		size += f.BinarySize()
+	}
+	return size
+}
+
+// marshalConfig encodes the config of a serialized set. The checkpoint, write-ahead log and compression
+// settings are local to the process and they are not serialized
+func marshalConfig(cfg Config) ([]byte, error) {
+	cfg.Checkpoint = CheckpointConfig{}
+	cfg.WAL = WALConfig{}
+	cfg.Compression = CompressionConfig{}
+	return json.Marshal(cfg)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package rotate
+
+import (
+	"context"
+	"time"
+
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+)
+
+// Clock tells the time and schedules the rotations. Injecting a fake one lets tests and external
+// schedulers control the rotation deterministically
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock based on the time package, used by default
+type SystemClock struct{}
+
+// Now returns the current local time
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse and then sends the current time on the returned channel
+func (SystemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RotateHook is called after every rotation with the bloomfilter evicted from the set
+type RotateHook func(evicted *bbloomfilter.Bloomfilter)
+
+// ErrorHook is called with the errors restoring a set created with New, which can not return them
+type ErrorHook func(err error)
+
+// Option customizes the rotation of a sliding set or a ring of bloomfilters
+type Option func(*options)
+
+type options struct {
+	clock        Clock
+	manual       bool
+	onRotate     []RotateHook
+	onSaturation []SaturationHook
+	onError      []ErrorHook
+	compressor   Compressor
+}
+
+// WithClock sets the clock telling the time and scheduling the rotations
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithoutTicker disables the timed rotation, so the set only rotates when calling Rotate or when its
+// current bloomfilter is saturated
+func WithoutTicker() Option {
+	return func(o *options) {
+		o.manual = true
+	}
+}
+
+// OnRotate registers a hook called after every rotation with the evicted bloomfilter
+func OnRotate(h RotateHook) Option {
+	return func(o *options) {
+		o.onRotate = append(o.onRotate, h)
+	}
+}
+
+// OnSaturation registers a hook called when the estimated false positive rate of the current bloomfilter
+// exceeds the ceiling configured in SaturationConfig
+func OnSaturation(h SaturationHook) Option {
+	return func(o *options) {
+		o.onSaturation = append(o.onSaturation, h)
+	}
+}
+
+// OnError registers a hook called with the errors restoring the checkpoint or opening the write-ahead log
+// of a set created with New. Build returns them instead
+func OnError(h ErrorHook) Option {
+	return func(o *options) {
+		o.onError = append(o.onError, h)
+	}
+}
+
+// WithCompressor sets the compressor used when serializing, taking precedence over the codec of the config.
+// The payloads are decompressed with the codec recorded in them, falling back to this compressor when they
+// do not record any
+func WithCompressor(c Compressor) Option {
+	return func(o *options) {
+		o.compressor = c
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o options) now() time.Time {
+	if o.clock == nil {
+		return time.Now()
+	}
+	return o.clock.Now()
+}
+
+func (o options) after(d time.Duration) <-chan time.Time {
+	if o.clock == nil {
+		return time.After(d)
+	}
+	return o.clock.After(d)
+}
+
+// compressorFor returns the compressor option, the codec of the config or the default compressor, in this
+// order of precedence
+func (o options) compressorFor(cfg CompressionConfig) Compressor {
+	if o.compressor != nil {
+		return o.compressor
+	}
+	if c := cfg.compressor(); c != nil {
+		return c
+	}
+	return defaultCompressor()
+}
+
+func (o options) rotated(evicted *bbloomfilter.Bloomfilter) {
+	for _, h := range o.onRotate {
+		h(evicted)
+	}
+}
+
+func (o options) saturated(s Saturation) {
+	for _, h := range o.onSaturation {
+		h(s)
+	}
+}
+
+func (o options) failed(err error) {
+	for _, h := range o.onError {
+		h(err)
+	}
+}
+
+// ticks sends the time after the given delay and then every period, until the context is done. The
+// deadlines are computed from the first one, so the ticks do not drift
+func (o options) ticks(ctx context.Context, delay, period time.Duration) <-chan time.Time {
+	c := make(chan time.Time)
+	go func() {
+		deadline := o.now().Add(delay)
+		for {
+			var now time.Time
+			select {
+			case now = <-o.after(deadline.Sub(o.now())):
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case c <- now:
+			case <-ctx.Done():
+				return
+			}
+			deadline = deadline.Add(period)
+		}
+	}()
+	return c
+}
@@ -0,0 +1,402 @@
+package rotate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+)
+
+// RingConfig contains a bloomfilter config, the minimum time TTL in sec an element is kept and the number
+// of generations the TTL is split into. Every generation is a bloomfilter created with the given config.
+// TTLDuration, when set, takes precedence over TTL
+type RingConfig struct {
+	bloomfilter.Config
+	TTL         uint              `json:"ttl"`
+	TTLDuration time.Duration     `json:"ttl_duration,omitempty"`
+	Generations uint              `json:"generations"`
+	Compression CompressionConfig `json:"compression"`
+}
+
+// MaxGenerations is the maximum number of generations of a ring
+const MaxGenerations = 1 << 10
+
+const ringMagic = "KRG1"
+
+// ErrInvalidGenerations is returned when the number of generations is out of range
+var ErrInvalidGenerations = fmt.Errorf("the generations must be between 1 and %d", MaxGenerations)
+
+// Validate checks the config can be used to build a ring of bloomfilters
+func (c RingConfig) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.ttl() <= 0 {
+		return &bloomfilter.ConfigError{Field: "ttl", Err: ErrInvalidTTL}
+	}
+	if c.Generations == 0 || c.Generations > MaxGenerations {
+		return &bloomfilter.ConfigError{Field: "generations", Err: ErrInvalidGenerations}
+	}
+	return c.Compression.validate()
+}
+
+func (c RingConfig) ttl() time.Duration {
+	if c.TTLDuration > 0 {
+		return c.TTLDuration
+	}
+	return time.Duration(c.TTL) * time.Second
+}
+
+func (c RingConfig) period() time.Duration {
+	return c.ttl() / time.Duration(c.Generations)
+}
+
+// Ring returns the config of the ring equivalent to the sliding set of 3 bloomfilters: 2 generations
+// rotated every TTL, so its elements are kept between 2 and 3 TTLs
+func (c Config) Ring() RingConfig {
+	return RingConfig{Config: c.Config, TTL: 2 * c.TTL, TTLDuration: 2 * c.TTLDuration, Generations: 2, Compression: c.Compression}
+}
+
+// Ring is a sliding bloomfilter made of a ring of G+1 bloomfilters, the generations. The elements are added
+// to the newest generation and checked against all of them, while the oldest one is replaced by an empty
+// one every TTL/G. So an element is kept between TTL and TTL*(1+1/G).
+//
+// The sliding set of 3 bloomfilters behaves like a ring of 2 generations, see Config.Ring
+type Ring struct {
+	Config RingConfig
+	gens   []*bbloomfilter.Bloomfilter
+	head   int
+	mutex  *sync.RWMutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+	opts   options
+}
+
+// NewRing creates a new ring of bloomfilters, customizing its rotation with the given options. A ring
+// without generations gets one, use BuildRing to validate the config instead
+func NewRing(ctx context.Context, cfg RingConfig, opts ...Option) *Ring {
+	if cfg.Generations == 0 {
+		cfg.Generations = 1
+	}
+	gens := make([]*bbloomfilter.Bloomfilter, cfg.Generations+1)
+	for i := range gens {
+		gens[i] = bbloomfilter.NewConcurrent(cfg.Config)
+	}
+
+	r := &Ring{
+		Config: cfg,
+		gens:   gens,
+		head:   len(gens) - 1,
+		mutex:  new(sync.RWMutex),
+		ctx:    ctx,
+		wg:     new(sync.WaitGroup),
+		opts:   newOptions(opts),
+	}
+	r.start()
+	return r
+}
+
+// BuildRing validates the config before creating a new ring of bloomfilters
+func BuildRing(ctx context.Context, cfg RingConfig, opts ...Option) (*Ring, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return NewRing(ctx, cfg, opts...), nil
+}
+
+func (r *Ring) start() {
+	localCtx, cancel := context.WithCancel(r.ctx)
+	r.cancel = cancel
+	if r.opts.manual {
+		return
+	}
+	c := r.opts.ticks(localCtx, r.Config.period(), r.Config.period())
+	wg := r.wg
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-c:
+			case <-localCtx.Done():
+				return
+			}
+
+			r.Rotate()
+		}
+	}()
+}
+
+// Rotate replaces the oldest generation by an empty one right away and calls the OnRotate hooks with the
+// evicted generation. It does not reschedule the internal rotation, so it is meant to be used along with
+// WithoutTicker
+func (r *Ring) Rotate() {
+	r.mutex.Lock()
+	evicted := r.gens[(r.head+1)%len(r.gens)]
+	r.rotate()
+	opts := r.opts
+	r.mutex.Unlock()
+
+	opts.rotated(evicted)
+}
+
+// rotate replaces the oldest generation by an empty one, which becomes the newest
+func (r *Ring) rotate() {
+	r.head = (r.head + 1) % len(r.gens)
+	r.gens[r.head] = bbloomfilter.NewConcurrent(r.Config.Config)
+}
+
+// Close the ring of bloomfilters, waiting for its rotation to stop
+func (r *Ring) Close() {
+	if r != nil && r.cancel != nil {
+		r.cancel()
+		r.wg.Wait()
+	}
+}
+
+// Generations returns the bloomfilters of the ring, the oldest first
+func (r *Ring) Generations() []*bbloomfilter.Bloomfilter {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.generations()
+}
+
+func (r *Ring) generations() []*bbloomfilter.Bloomfilter {
+	gens := make([]*bbloomfilter.Bloomfilter, 0, len(r.gens))
+	for i := 1; i <= len(r.gens); i++ {
+		gens = append(gens, r.gens[(r.head+i)%len(r.gens)])
+	}
+	return gens
+}
+
+// Add element to the newest generation
+func (r *Ring) Add(elem []byte) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	r.gens[r.head].Add(elem)
+}
+
+// Check if element in any generation
+func (r *Ring) Check(elem []byte) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, g := range r.gens {
+		if g.Check(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// Union merges every generation with the one of the same age of the other ring. A sliding set of 3
+// bloomfilters can be merged into a ring of 2 generations
+func (r *Ring) Union(that interface{}) (float64, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var (
+		gens []*bbloomfilter.Bloomfilter
+		cfg  bloomfilter.Config
+	)
+	switch other := that.(type) {
+	case *Ring:
+		if other.Config.Generations != r.Config.Generations {
+			return r.capacity(), fmt.Errorf("different generations %d vs. %d", other.Config.Generations, r.Config.Generations)
+		}
+		gens, cfg = other.Generations(), other.Config.Config
+	case *Bloomfilter:
+		if r.Config.Generations != 2 {
+			return r.capacity(), fmt.Errorf("different generations 2 vs. %d", r.Config.Generations)
+		}
+		filters, c, _ := other.snapshot()
+		gens, cfg = filters, c.Config
+	default:
+		return r.capacity(), bloomfilter.ErrImpossibleToTreat
+	}
+
+	if cfg.N != r.Config.N {
+		return r.capacity(), fmt.Errorf("different n values %d vs. %d", cfg.N, r.Config.N)
+	}
+	if cfg.P != r.Config.P {
+		return r.capacity(), fmt.Errorf("different p values %.2f vs. %.2f", cfg.P, r.Config.P)
+	}
+	if cfg.Seed != r.Config.Seed {
+		return r.capacity(), bbloomfilter.ErrDifferentSeeds
+	}
+
+	for i, g := range r.generations() {
+		if _, err := g.Union(gens[i]); err != nil {
+			return r.capacity(), err
+		}
+	}
+	return r.capacity(), nil
+}
+
+func (r *Ring) capacity() float64 {
+	c := 0.0
+	for _, g := range r.gens {
+		c += g.Capacity()
+	}
+	return c / float64(len(r.gens))
+}
+
+// MarshalBinary serializes a ring of bloomfilters
+func (r *Ring) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	_, err := r.WriteTo(buf)
+
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary deserializes a ring of bloomfilters. Serialized sliding sets of 3 bloomfilters are
+// accepted too, as rings of 2 generations
+func (r *Ring) UnmarshalBinary(data []byte) error {
+	cfg, gens, err := readRing(bytes.NewReader(data), r.opts.compressorFor(r.Config.Compression))
+	if err != nil {
+		return err
+	}
+
+	r.restore(cfg, gens)
+	return nil
+}
+
+// WriteTo streams the ring of bloomfilters to w through the compressor, the oldest generation first.
+// It follows the format of the sliding set of 3 bloomfilters, with its own magic "KRG1"
+func (r *Ring) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.RLock()
+	gens := r.generations()
+	cfg := r.Config
+	r.mutex.RUnlock()
+
+	c, err := marshalRingConfig(cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: w}
+	zw, err := compress(cw, r.opts.compressorFor(cfg.Compression))
+	if err != nil {
+		return cw.n, err
+	}
+	if err := encodeStream(zw, ringMagic, c, gens, time.Time{}); err != nil {
+		zw.Close()
+		return cw.n, err
+	}
+	err = zw.Close()
+	return cw.n, err
+}
+
+// ReadFrom replaces the ring of bloomfilters with the one streamed from r, like UnmarshalBinary. It returns
+// the number of bytes read from r
+func (r *Ring) ReadFrom(rd io.Reader) (int64, error) {
+	cr := &countingReader{r: rd}
+	cfg, gens, err := readRing(cr, r.opts.compressorFor(r.Config.Compression))
+	if err != nil {
+		return cr.n, err
+	}
+
+	r.restore(cfg, gens)
+	return cr.n, nil
+}
+
+func readRing(rd io.Reader, fallback Compressor) (RingConfig, []*bbloomfilter.Bloomfilter, error) {
+	br, magic, err := openStream(rd, fallback)
+	if err != nil {
+		return RingConfig{}, nil, err
+	}
+
+	if magic != ringMagic {
+		target, err := decodeSet(br, magic)
+		if err != nil {
+			return RingConfig{}, nil, err
+		}
+		return target.Config.Ring(), []*bbloomfilter.Bloomfilter{target.Previous, target.Current, target.Next}, nil
+	}
+
+	var cfg RingConfig
+	gens, _, err := readFilters(br, func(c []byte) (int, bloomfilter.Config, error) {
+		if err := json.Unmarshal(c, &cfg); err != nil {
+			return 0, bloomfilter.Config{}, err
+		}
+		if err := cfg.Validate(); err != nil {
+			return 0, bloomfilter.Config{}, fmt.Errorf("%w: %s", ErrInvalidPayload, err.Error())
+		}
+		return int(cfg.Generations) + 1, cfg.Config, nil
+	})
+	if err != nil {
+		return RingConfig{}, nil, err
+	}
+	if _, err := br.Peek(1); err != io.EOF {
+		return RingConfig{}, nil, errors.New("trailing data after the ring of bloomfilters")
+	}
+
+	for i, g := range gens {
+		if g.Config() != cfg.Config {
+			return RingConfig{}, nil, fmt.Errorf("%w: the config of the generation %d does not match the one of the ring", ErrInvalidPayload, i)
+		}
+		if gens[i], err = toConcurrent(cfg.Config, g); err != nil {
+			return RingConfig{}, nil, err
+		}
+	}
+	return cfg, gens, nil
+}
+
+// restore replaces the ring with the deserialized generations, the oldest first, restarting its rotation.
+// The compression settings and the options of the replaced ring are kept
+func (r *Ring) restore(cfg RingConfig, gens []*bbloomfilter.Bloomfilter) {
+	cfg.Compression = r.Config.Compression
+	if r.cancel != nil {
+		r.cancel()
+		r.wg.Wait()
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+	}
+
+	ctx := context.Background()
+	if r.ctx != nil {
+		ctx = r.ctx
+	}
+
+	*r = Ring{
+		Config: cfg,
+		gens:   gens,
+		head:   len(gens) - 1,
+		mutex:  new(sync.RWMutex),
+		ctx:    ctx,
+		wg:     new(sync.WaitGroup),
+		opts:   r.opts,
+	}
+	r.start()
+}
+
+// marshalRingConfig encodes the config of a serialized ring, without the compression settings local to the
+// process
+func marshalRingConfig(cfg RingConfig) ([]byte, error) {
+	cfg.Compression = CompressionConfig{}
+	return json.Marshal(cfg)
+}
+
+// EstimatedSize returns the size of the serialized ring before compression, without serializing it
+func (r *Ring) EstimatedSize() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	c, _ := marshalRingConfig(r.Config)
+	size := formatHeaderSize + len(c) + 4
+	for _, g := range r.gens {
+		size += g.BinarySize()
+	}
+	return size
+}
@@ -0,0 +1,229 @@
+package rotate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestRing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	testutils.CallSet(t, NewRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 5, Generations: 4}))
+	testutils.CallConcurrentCheck(t, NewRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 5, Generations: 4}))
+}
+
+func TestRing_expiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 100, Generations: 4})
+	elem := []byte("wwwww")
+	r.Add(elem)
+	for i := 0; i < 4; i++ {
+		r.rotate()
+		if !r.Check(elem) {
+			t.Errorf("elem not present after %d rotations", i+1)
+		}
+	}
+	r.rotate()
+	if r.Check(elem) {
+		t.Error("elem present after 5 rotations")
+	}
+	if gens := r.Generations(); len(gens) != 5 || gens[4] != r.gens[r.head] {
+		t.Error("unexpected generations")
+	}
+}
+
+func TestRing_Rotate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var evicted []*bbloomfilter.Bloomfilter
+	r := NewRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 1, Generations: 2}, WithoutTicker(), OnRotate(func(b *bbloomfilter.Bloomfilter) {
+		evicted = append(evicted, b)
+	}))
+	elem := []byte("wwwww")
+	r.Add(elem)
+	for i := 0; i < 3; i++ {
+		r.Rotate()
+	}
+	if r.Check(elem) {
+		t.Error("elem present after 3 rotations")
+	}
+	if len(evicted) != 3 || evicted[1].Check(elem) || !evicted[2].Check(elem) {
+		t.Error("the hooks did not receive the evicted generations")
+	}
+}
+
+func TestRing_clock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	rotated := make(chan struct{})
+	r := NewRing(ctx, RingConfig{Config: testutils.TestCfg, TTLDuration: 300 * time.Millisecond, Generations: 3}, WithClock(clock), OnRotate(func(*bbloomfilter.Bloomfilter) {
+		rotated <- struct{}{}
+	}))
+	elem := []byte("wwwww")
+	r.Add(elem)
+
+	for i := 1; i <= 4; i++ {
+		<-clock.registered
+		clock.Advance(100 * time.Millisecond)
+		<-rotated
+		if present := r.Check(elem); present != (i < 4) {
+			t.Errorf("unexpected presence after %d rotations: %v", i, present)
+		}
+	}
+}
+
+func TestRing_noGenerations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 5})
+	defer r.Close()
+
+	if r.Config.Generations != 1 || len(r.Generations()) != 2 {
+		t.Errorf("unexpected generations: %d", r.Config.Generations)
+	}
+	if _, err := BuildRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 5}); !errors.Is(err, ErrInvalidGenerations) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestRing_restoreRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := RingConfig{Config: testutils.TestCfg, TTLDuration: 2 * time.Millisecond, Generations: 2}
+	r := NewRing(ctx, cfg)
+	defer r.Close()
+
+	src := NewRing(ctx, cfg)
+	defer src.Close()
+	data, err := src.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	// the rotation of the replaced ring must be done before it is overwritten
+	for i := 0; i < 10; i++ {
+		if err := r.UnmarshalBinary(data); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRing_Union(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := RingConfig{Config: testutils.TestCfg, TTL: 10, Generations: 2}
+	testutils.CallSetUnion(t, NewRing(ctx, cfg), NewRing(ctx, cfg))
+
+	set := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	elem := []byte("wwwww")
+	set.Add(elem)
+	r := NewRing(ctx, cfg)
+	if _, err := r.Union(set); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if !r.Check(elem) {
+		t.Error("elem not present after the union with a sliding set")
+	}
+
+	other := cfg
+	other.Generations = 3
+	if _, err := r.Union(NewRing(ctx, other)); err == nil || !strings.Contains(err.Error(), "different generations") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := NewRing(ctx, other).Union(set); err == nil || !strings.Contains(err.Error(), "different generations") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	other = cfg
+	other.Config = testutils.TestCfg3
+	if _, err := r.Union(NewRing(ctx, other)); err == nil || !strings.Contains(err.Error(), "different hashers") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := r.Union(24); err != bloomfilter.ErrImpossibleToTreat {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestRing_MarshalBinary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r1 := NewRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 5, Generations: 3})
+	elem := []byte("wwwww")
+	r1.Add(elem)
+	r1.rotate()
+
+	data, err := r1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if size := r1.EstimatedSize(); size <= 0 {
+		t.Errorf("unexpected estimated size %d", size)
+	}
+
+	r2 := NewRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 5, Generations: 1})
+	if err := r2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer r2.Close()
+	if r2.Config != r1.Config || !r2.Check(elem) {
+		t.Error("the ring was not restored")
+	}
+	for i := 0; i < 3; i++ {
+		r2.rotate()
+	}
+	if r2.Check(elem) {
+		t.Error("the age of the generations was not restored")
+	}
+
+	set := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	set.Add(elem)
+	data, err = set.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	r3 := new(Ring)
+	if err := r3.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer r3.Close()
+	if r3.Config != set.Config.Ring() || !r3.Check(elem) {
+		t.Error("the sliding set was not restored as a ring")
+	}
+}
+
+func TestBuildRing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := BuildRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 5, Generations: 4}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := BuildRing(ctx, RingConfig{Config: testutils.TestCfg, TTL: 5}); !errors.Is(err, ErrInvalidGenerations) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := BuildRing(ctx, RingConfig{Config: testutils.TestCfg, Generations: 4}); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
@@ -2,15 +2,21 @@
 //
 // When adding an element, it is stored in the `current` and `next` bloomfilters.
 // When sliding (rotating), `current` passes to `previous` and `next` to `current`.
+// The bloomfilters are concurrent-safe, so adds and checks only share a read lock and the write lock
+// is reserved to the rotation.
+//
+// The Ring generalizes the sliding set to any number of generations, bounding the time an element is
+// kept as tightly as needed.
 package rotate
 
 import (
 	"bytes"
 	"context"
-	"encoding/gob"
+	"errors"
 	"fmt"
-	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/krakendio/bloomfilter/v2"
@@ -18,30 +24,167 @@ import (
 )
 
 // New creates a new sliding set of 3 bloomfilters
-// It uses a context and configuration
-func New(ctx context.Context, cfg Config) *Bloomfilter {
+// It uses a context, configuration and the options customizing its rotation. When a checkpoint dir is
+// configured, the set is restored from the newest usable snapshot in it, starting empty if there is none.
+// The errors restoring the checkpoint or opening the write-ahead log are reported to the OnError hooks,
+// use Build to get them
+func New(ctx context.Context, cfg Config, opts ...Option) *Bloomfilter {
+	o := newOptions(opts)
+	r, err := newBloomfilter(ctx, cfg, o)
+	if err != nil {
+		o.failed(err)
+	}
+	return r
+}
+
+// Build validates the config before creating a new sliding set of 3 bloomfilters. Unlike New, it
+// returns an error when the checkpoint dir has snapshots but none of them can be restored or when the
+// write-ahead log can not be replayed or opened
+func Build(ctx context.Context, cfg Config, opts ...Option) (*Bloomfilter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	r, err := newBloomfilter(ctx, cfg, newOptions(opts))
+	if err != nil {
+		r.cancel()
+		r.wg.Wait()
+		r.wal.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func newBloomfilter(ctx context.Context, cfg Config, opts options) (*Bloomfilter, error) {
 	localCtx, cancel := context.WithCancel(ctx)
 	prevCfg := bloomfilter.EmptyConfig
 	prevCfg.HashName = cfg.HashName
 	r := &Bloomfilter{
 		// Previous: bbloomfilter.New(prevCfg),
-		Previous: bbloomfilter.New(cfg.Config),
-		Current:  bbloomfilter.New(cfg.Config),
-		Next:     bbloomfilter.New(cfg.Config),
-		Config:   cfg,
-		cancel:   cancel,
-		mutex:    &sync.RWMutex{},
-		ctx:      ctx,
+		Previous:        bbloomfilter.NewConcurrent(cfg.Config),
+		Current:         bbloomfilter.NewConcurrent(cfg.Config),
+		Next:            bbloomfilter.NewConcurrent(cfg.Config),
+		Config:          cfg,
+		cancel:          cancel,
+		mutex:           &sync.RWMutex{},
+		ctx:             ctx,
+		checkpointMutex: new(sync.Mutex),
+		wg:              new(sync.WaitGroup),
+		opts:            opts,
 	}
 
-	go r.keepRotating(localCtx, time.NewTicker(time.Duration(cfg.TTL)*time.Second).C)
-	return r
+	ttl := cfg.ttl()
+	now := opts.now()
+	delay := r.catchUp(now, now)
+	var errs []string
+	if cfg.Checkpoint.Dir != "" {
+		var err error
+		if delay, err = r.restoreCheckpoint(now); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if cfg.WAL.Dir != "" {
+		// the log holds the elements added after the last checkpoint, so it is replayed even when no
+		// checkpoint could be restored
+		if err := replayWAL(cfg.WAL, ttl, now, r.replay); err != nil {
+			errs = append(errs, fmt.Sprintf("unable to replay the wal: %s", err.Error()))
+		}
+		w, err := openWAL(cfg.WAL, ttl, now)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("unable to open the wal: %s", err.Error()))
+		}
+		r.wal = w
+	}
+
+	r.startBackground(localCtx, delay)
+	if len(errs) > 0 {
+		return r, errors.New(strings.Join(errs, "; "))
+	}
+	return r, nil
 }
 
-// Config contains a bloomfilter config and the rotation frequency TTL in sec
+// startBackground starts the rotation, unless it is manual, and the periodic checkpoints, syncs of the
+// write-ahead log and saturation checks, when configured. The first rotation happens after delay
+func (bs *Bloomfilter) startBackground(ctx context.Context, delay time.Duration) {
+	if !bs.opts.manual {
+		c := bs.opts.ticks(ctx, delay, bs.Config.ttl())
+		bs.spawn(func() { bs.keepRotating(ctx, c) })
+	}
+	if bs.Config.Checkpoint.Dir != "" {
+		bs.spawn(func() { bs.keepCheckpointing(ctx) })
+	}
+	if bs.Config.Saturation.monitored() {
+		bs.spawn(func() { bs.keepMonitoring(ctx) })
+	}
+	if w := bs.wal; w != nil && w.cfg.Sync != WALSyncAlways && w.cfg.Sync != WALSyncNever {
+		bs.spawn(func() { w.keepSyncing(ctx, bs.opts.after) })
+	}
+}
+
+// spawn runs f in a goroutine tracked by the wait group of the set
+func (bs *Bloomfilter) spawn(f func()) {
+	wg := bs.wg
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f()
+	}()
+}
+
+// Config contains a bloomfilter config, the rotation frequency TTL in sec and the optional checkpoint,
+// write-ahead log, saturation and compression settings. TTLDuration, when set, takes precedence over TTL, allowing
+// sub-second rotations. Aligned sets rotate at the multiples of the TTL since the Unix epoch, so all the
+// nodes of a cluster sharing the TTL rotate at once
 type Config struct {
 	bloomfilter.Config
-	TTL uint `json:"ttl"`
+	TTL         uint              `json:"ttl"`
+	TTLDuration time.Duration     `json:"ttl_duration,omitempty"`
+	Aligned     bool              `json:"aligned,omitempty"`
+	Checkpoint  CheckpointConfig  `json:"checkpoint"`
+	WAL         WALConfig         `json:"wal"`
+	Saturation  SaturationConfig  `json:"saturation"`
+	Compression CompressionConfig `json:"compression"`
+}
+
+func (c Config) ttl() time.Duration {
+	if c.TTLDuration > 0 {
+		return c.TTLDuration
+	}
+	return time.Duration(c.TTL) * time.Second
+}
+
+var (
+	// ErrInvalidTTL is returned when the rotation frequency is zero
+	ErrInvalidTTL = errors.New("the ttl must be greater than 0")
+	// ErrMisalignedGenerations is returned when merging aligned sets whose last rotations are not a whole
+	// number of TTLs apart
+	ErrMisalignedGenerations = errors.New("misaligned generations")
+	// ErrJSONNotSupported is returned when decoding a set of sliding bloomfilters from JSON
+	ErrJSONNotSupported = errors.New("the sliding bloomfilters can not be decoded from JSON, send their snapshot instead")
+)
+
+// maxMisalignment is the fraction of the TTL two aligned sets can be off a whole number of TTLs, absorbing
+// the clock skew between nodes
+const maxMisalignment = 10
+
+// Validate checks the config can be used to build a sliding set of bloomfilters
+func (c Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.ttl() <= 0 {
+		return &bloomfilter.ConfigError{Field: "ttl", Err: ErrInvalidTTL}
+	}
+	if err := c.WAL.Validate(); err != nil {
+		return &bloomfilter.ConfigError{Field: "wal.sync", Err: err}
+	}
+	if err := c.Saturation.Validate(); err != nil {
+		field := "saturation.max_fill"
+		if err == ErrInvalidMaxFPRate {
+			field = "saturation.max_fp_rate"
+		}
+		return &bloomfilter.ConfigError{Field: field, Err: err}
+	}
+	return c.Compression.validate()
 }
 
 // Bloomfilter type defines a sliding set of 3 bloomfilters
@@ -51,24 +194,77 @@ type Bloomfilter struct {
 	mutex                   *sync.RWMutex
 	ctx                     context.Context
 	cancel                  context.CancelFunc
+	rotatedAt               time.Time
+	checkpointMutex         *sync.Mutex
+	checkpointErr           error
+	wg                      *sync.WaitGroup
+	wal                     *wal
+	opts                    options
+	currentCount, nextCount atomic.Uint64
 }
 
-// Close sliding set of bloomfilters
+// Close sliding set of bloomfilters, stopping its background goroutines before taking a last checkpoint,
+// when a checkpoint dir is configured, and closing the write-ahead log
 func (bs *Bloomfilter) Close() {
 	if bs != nil && bs.cancel != nil {
 		bs.cancel()
+		bs.wg.Wait()
+		if bs.Config.Checkpoint.Dir != "" {
+			bs.Checkpoint()
+		}
+		bs.wal.Close()
 	}
 }
 
 // Add element to sliding set of bloomfilters
 func (bs *Bloomfilter) Add(elem []byte) {
+	bs.AddBatch([][]byte{elem})
+}
+
+// AddBatch adds the elements to the sliding set of bloomfilters. When the write-ahead log is enabled,
+// the elements are logged before being added and the returned error reports if logging them failed.
+// The elements are added anyway
+func (bs *Bloomfilter) AddBatch(elems [][]byte) error {
+	now := bs.opts.now()
+	err := bs.wal.append(elems, now)
+
 	bs.mutex.RLock()
-	defer bs.mutex.RUnlock()
+	for _, elem := range elems {
+		bs.add(elem)
+	}
+	current := bs.Current
+	bs.currentCount.Add(uint64(len(elems)))
+	count := bs.nextCount.Add(uint64(len(elems)))
+	bs.mutex.RUnlock()
+
+	if max := bs.Config.Saturation.MaxCount; max > 0 && count >= max {
+		bs.rotateAt(now, current)
+	}
+	return err
+}
 
+func (bs *Bloomfilter) add(elem []byte) {
 	bs.Next.Add(elem)
 	bs.Current.Add(elem)
 }
 
+// replay adds a logged element to the bloomfilters covering the time it was added: the ones added since
+// the last rotation go to the current and next bloomfilters, the ones of the window before only to the
+// current one and the older ones are expired
+func (bs *Bloomfilter) replay(elem []byte, ts time.Time) {
+	switch {
+	case !ts.Before(bs.rotatedAt):
+		bs.add(elem)
+	case !ts.Before(bs.rotatedAt.Add(-bs.Config.ttl())):
+		bs.Current.Add(elem)
+	}
+}
+
+// WALError returns the last error writing or rolling the write-ahead log, if any
+func (bs *Bloomfilter) WALError() error {
+	return bs.wal.Err()
+}
+
 // Check if element in sliding set of bloomfilters
 func (bs *Bloomfilter) Check(elem []byte) bool {
 	bs.mutex.RLock()
@@ -80,7 +276,9 @@ func (bs *Bloomfilter) Check(elem []byte) bool {
 // Union two sliding sets of bloomfilters
 // Take care that false positive probability P,
 // number of elements being filtered N and
-// hashfunctions are the same
+// hashfunctions are the same.
+// When the last rotation of both sets is known, their bloomfilters are aligned by it, so sets rotated at
+// different times can be merged. Aligned sets must be a whole number of TTLs apart
 func (bs *Bloomfilter) Union(that interface{}) (float64, error) {
 	bs.mutex.RLock()
 	defer bs.mutex.RUnlock()
@@ -97,105 +295,261 @@ func (bs *Bloomfilter) Union(that interface{}) (float64, error) {
 		return bs.capacity(), fmt.Errorf("different p values %.2f vs. %.2f", other.Config.P, bs.Config.P)
 	}
 
-	if _, err := bs.Current.Union(other.Current); err != nil {
-		return bs.capacity(), err
+	if other.Config.Seed != bs.Config.Seed {
+		return bs.capacity(), bbloomfilter.ErrDifferentSeeds
 	}
 
-	if _, err := bs.Next.Union(other.Next); err != nil {
+	filters, cfg, rotatedAt := other.snapshot()
+	shift, err := bs.shift(cfg, rotatedAt)
+	if err != nil {
 		return bs.capacity(), err
 	}
 
-	_, err := bs.Previous.Union(other.Previous)
-	return bs.capacity(), err
+	for i, f := range []*bbloomfilter.Bloomfilter{bs.Previous, bs.Current, bs.Next} {
+		for _, o := range overlapping(filters, i, i+shift) {
+			if _, err := f.Union(o); err != nil {
+				return bs.capacity(), err
+			}
+		}
+	}
+	return bs.capacity(), nil
+}
+
+// overlapping returns the bloomfilters of the other set holding the elements of the i-th bloomfilter of this
+// set (previous, current or next), j being the index of the one of the other set started at the same time.
+// The newest bloomfilter of the other set covers the newer ones of this set and, as the previous one only
+// holds the elements added before its last rotation, the current one completes it
+func overlapping(filters []*bbloomfilter.Bloomfilter, i, j int) []*bbloomfilter.Bloomfilter {
+	switch {
+	case j >= 2:
+		return filters[2:]
+	case j == 1:
+		return filters[1:2]
+	case i == 0 && j == 0:
+		return filters[:1]
+	case i == 0:
+		return nil
+	default:
+		return filters[:2]
+	}
+}
+
+// shift returns the number of rotations the set is ahead of the other one, with the given config and last
+// rotation. Sets with an unknown last rotation are considered aligned
+func (bs *Bloomfilter) shift(cfg Config, rotatedAt time.Time) (int, error) {
+	if bs.rotatedAt.IsZero() || rotatedAt.IsZero() {
+		return 0, nil
+	}
+	ttl := bs.Config.ttl()
+	if cfg.ttl() != ttl {
+		return 0, fmt.Errorf("different ttl values %v vs. %v", cfg.ttl(), ttl)
+	}
+
+	d := bs.rotatedAt.Sub(rotatedAt)
+	shift := d / ttl
+	off := d % ttl
+	if off > ttl/2 {
+		shift, off = shift+1, off-ttl
+	} else if off < -ttl/2 {
+		shift, off = shift-1, off+ttl
+	}
+	if off < 0 {
+		off = -off
+	}
+	if bs.Config.Aligned && cfg.Aligned && off > ttl/maxMisalignment {
+		return 0, fmt.Errorf("%w: %v off", ErrMisalignedGenerations, off)
+	}
+	return int(shift), nil
 }
 
 func (bs *Bloomfilter) keepRotating(ctx context.Context, c <-chan time.Time) {
 	for {
+		var now time.Time
 		select {
-		case <-c:
+		case now = <-c:
 		case <-ctx.Done():
 			return
 		}
 
-		bs.mutex.Lock()
+		bs.rotateAt(now, nil)
+	}
+}
+
+// Rotate slides the set right away: `current` passes to `previous` and `next` to `current`. The OnRotate
+// hooks are called with the evicted `previous` bloomfilter. It does not reschedule the internal rotation,
+// so it is meant to be used along with WithoutTicker
+func (bs *Bloomfilter) Rotate() {
+	bs.rotateAt(bs.opts.now(), nil)
+}
 
-		bs.Previous = bs.Current
-		bs.Current = bs.Next
-		bs.Next = bbloomfilter.New(bloomfilter.Config{
-			N:        bs.Config.N,
-			P:        bs.Config.P,
-			HashName: bs.Config.HashName,
-		})
+// rotateAt rotates the set at the given time. When current is not nil, the set is only rotated if it is
+// still its current bloomfilter, so the saturation of a bloomfilter rotates the set once
+func (bs *Bloomfilter) rotateAt(now time.Time, current *bbloomfilter.Bloomfilter) {
+	if bs.Config.Aligned {
+		now = epochStart(now, bs.Config.ttl())
+	}
 
+	bs.mutex.Lock()
+	if current != nil && current != bs.Current {
 		bs.mutex.Unlock()
+		return
+	}
+	evicted := bs.Previous
+	bs.rotate()
+	bs.rotatedAt = now
+	w := bs.wal
+	opts := bs.opts
+	bs.mutex.Unlock()
+
+	if err := w.roll(now); err != nil {
+		w.fail(err)
+	}
+	opts.rotated(evicted)
+}
+
+func (bs *Bloomfilter) rotate() {
+	bs.currentCount.Store(bs.nextCount.Swap(0))
+	bs.Previous = bs.Current
+	bs.Current = bs.Next
+	bs.Next = bbloomfilter.NewConcurrent(bloomfilter.Config{
+		N:        bs.Config.N,
+		P:        bs.Config.P,
+		HashName: bs.Config.HashName,
+		Seed:     bs.Config.Seed,
+	})
+}
+
+// catchUp sets the last rotation of the set, rotating it as many times as TTLs elapsed between rotatedAt
+// and now. Aligned sets count the epochs started in between instead. It returns the time left until the
+// next rotation
+func (bs *Bloomfilter) catchUp(rotatedAt, now time.Time) time.Duration {
+	ttl := bs.Config.ttl()
+	if now.Before(rotatedAt) {
+		rotatedAt = now
 	}
+
+	var n time.Duration
+	if bs.Config.Aligned {
+		start := epochStart(now, ttl)
+		n = start.Sub(epochStart(rotatedAt, ttl)) / ttl
+		rotatedAt = start
+	} else {
+		n = now.Sub(rotatedAt) / ttl
+		rotatedAt = rotatedAt.Add(n * ttl)
+	}
+	// after three rotations the whole set is new, so there is no need to keep rotating
+	for i := time.Duration(0); i < n && i < 3; i++ {
+		bs.rotate()
+	}
+	bs.rotatedAt = rotatedAt
+	return ttl - now.Sub(rotatedAt)
+}
+
+// epochStart returns the start of the epoch of length ttl containing t, counting from the Unix epoch
+func epochStart(t time.Time, ttl time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns-ns%int64(ttl))
+}
+
+// snapshot returns the bloomfilters of the set along with its config and the time of the last rotation
+func (bs *Bloomfilter) snapshot() ([]*bbloomfilter.Bloomfilter, Config, time.Time) {
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+
+	return []*bbloomfilter.Bloomfilter{bs.Previous, bs.Current, bs.Next}, bs.Config, bs.rotatedAt
 }
 
 // SerializibleBloomfilter used when (de)serializing a set of sliding bloomfilters
-// It has exportable fields
+// It has exportable fields. RotatedAt is the start time of the `next` generation, the zero time when unknown
 type SerializibleBloomfilter struct {
 	Previous, Current, Next *bbloomfilter.Bloomfilter
 	Config                  Config
+	RotatedAt               time.Time
 }
 
 // MarshalBinary serializes a set of sliding bloomfilters
 func (bs *Bloomfilter) MarshalBinary() ([]byte, error) {
-	bs.mutex.RLock()
-	defer bs.mutex.RUnlock()
-
 	buf := new(bytes.Buffer)
-	w := compressor.NewWriter(buf)
-	err := gob.NewEncoder(w).Encode(SerializibleBloomfilter{
-		Previous: bs.Previous,
-		Next:     bs.Next,
-		Current:  bs.Current,
-		Config:   bs.Config,
-	})
+	_, err := bs.WriteTo(buf)
 
-	w.Close()
 	return buf.Bytes(), err
 }
 
 // MarshalBinary deserializes a set of sliding bloomfilters
 func (bs *Bloomfilter) UnmarshalBinary(data []byte) error {
-	if bs != nil && bs.cancel != nil {
-		bs.cancel()
-
-		bs.mutex.Lock()
-		defer bs.mutex.Unlock()
-	}
-
-	buf := bytes.NewBuffer(data)
-	r, err := compressor.NewReader(buf)
+	target, err := readStream(bytes.NewReader(data), bs.opts.compressorFor(bs.Config.Compression))
 	if err != nil {
 		return err
 	}
 
-	target := &SerializibleBloomfilter{}
-	if err := gob.NewDecoder(r).Decode(target); err != nil && err != io.EOF {
-		return err
+	bs.restore(target)
+	return nil
+}
+
+// UnmarshalJSON rejects the sets of sliding bloomfilters encoded as JSON, since their bloomfilters and
+// the state of their rotation can not be restored from it
+func (bs *Bloomfilter) UnmarshalJSON([]byte) error {
+	return ErrJSONNotSupported
+}
+
+// restore replaces the sliding set of bloomfilters with the deserialized one, stopping the rotation of
+// the replaced set, waiting for its goroutines, and starting a new one. The deserialized set is rotated as many times as TTLs elapsed
+// since its last rotation, when known. The checkpoint and compression settings, the write-ahead log and
+// the options of the replaced set are kept
+func (bs *Bloomfilter) restore(target *SerializibleBloomfilter) {
+	if bs.cancel != nil {
+		bs.cancel()
+		bs.wg.Wait()
+
+		bs.mutex.Lock()
+		defer bs.mutex.Unlock()
 	}
 
 	ctx := context.Background()
-	if bs != nil && bs.ctx != nil {
+	if bs.ctx != nil {
 		ctx = bs.ctx
 	}
 
 	localCtx, cancel := context.WithCancel(ctx)
+	cfg := target.Config
+	cfg.Checkpoint = bs.Config.Checkpoint
+	cfg.WAL = bs.Config.WAL
+	cfg.Compression = bs.Config.Compression
 
 	*bs = Bloomfilter{
-		Previous: target.Previous,
-		Next:     target.Next,
-		Current:  target.Current,
-		Config:   target.Config,
-		ctx:      ctx,
-		cancel:   cancel,
-		mutex:    new(sync.RWMutex),
+		Previous:        target.Previous,
+		Next:            target.Next,
+		Current:         target.Current,
+		Config:          cfg,
+		ctx:             ctx,
+		cancel:          cancel,
+		mutex:           new(sync.RWMutex),
+		checkpointMutex: new(sync.Mutex),
+		wg:              new(sync.WaitGroup),
+		wal:             bs.wal,
+		opts:            bs.opts,
 	}
 
-	go bs.keepRotating(localCtx, time.NewTicker(time.Duration(bs.Config.TTL)*time.Second).C)
+	now := bs.opts.now()
+	rotatedAt := target.RotatedAt
+	if rotatedAt.IsZero() {
+		rotatedAt = now
+	}
+	delay := bs.catchUp(rotatedAt, now)
 
-	return nil
+	bs.startBackground(localCtx, delay)
+}
+
+// toConcurrent copies the bloomfilters decoded from snapshots taken before they were concurrent-safe
+func toConcurrent(cfg bloomfilter.Config, b *bbloomfilter.Bloomfilter) (*bbloomfilter.Bloomfilter, error) {
+	if b == nil || b.Concurrent() {
+		return b, nil
+	}
+	c := bbloomfilter.NewConcurrent(cfg)
+	if _, err := c.Union(b); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 func (bs *Bloomfilter) capacity() float64 {
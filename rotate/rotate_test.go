@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -16,12 +20,29 @@ import (
 	"github.com/krakendio/bloomfilter/v2/testutils"
 )
 
+func TestBuild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := Build(ctx, Config{Config: testutils.TestCfg, TTL: 5}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := Build(ctx, Config{Config: testutils.TestCfg, TTL: 0}); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	cfg := testutils.TestCfg
+	cfg.P = 1
+	if _, err := Build(ctx, Config{Config: cfg, TTL: 5}); !errors.Is(err, bloomfilter.ErrInvalidP) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
 func TestRotate_Union_ok(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	set1 := New(ctx, Config{testutils.TestCfg, 5})
-	set2 := New(ctx, Config{testutils.TestCfg, 5})
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	set2 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
 
 	testutils.CallSetUnion(t, set1, set2)
 }
@@ -30,7 +51,7 @@ func TestRotate_Union_koIncorrectType(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	set1 := New(ctx, Config{testutils.TestCfg, 5})
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
 	set2 := 24
 
 	if _, err := set1.Union(set2); err != bloomfilter.ErrImpossibleToTreat {
@@ -42,10 +63,10 @@ func TestRotate_Union_koIncompatibleN(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	set1 := New(ctx, Config{testutils.TestCfg, 5})
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
 	cfg := testutils.TestCfg
 	cfg.N = 1
-	set2 := New(ctx, Config{cfg, 5})
+	set2 := New(ctx, Config{Config: cfg, TTL: 5})
 	if _, err := set1.Union(set2); err == nil || !strings.Contains(err.Error(), "different n values") {
 		t.Errorf("Unexpected error, %v", err)
 	}
@@ -55,10 +76,10 @@ func TestRotate_Union_koIncompatibleP(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	set1 := New(ctx, Config{testutils.TestCfg, 5})
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
 	cfg := testutils.TestCfg
 	cfg.P = 0.5
-	set2 := New(ctx, Config{cfg, 5})
+	set2 := New(ctx, Config{Config: cfg, TTL: 5})
 	if _, err := set1.Union(set2); err == nil || !strings.Contains(err.Error(), "different p values") {
 		t.Errorf("Unexpected error, %v", err)
 	}
@@ -68,8 +89,8 @@ func TestRotate_Union_koIncompatibleCurrentBFs(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	set1 := New(ctx, Config{testutils.TestCfg, 5})
-	set2 := New(ctx, Config{testutils.TestCfg2, 5})
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	set2 := New(ctx, Config{Config: testutils.TestCfg2, TTL: 5})
 	if _, err := set1.Union(set2); err == nil || !strings.Contains(err.Error(), "different p values") {
 		t.Errorf("Unexpected error, %v", err)
 	}
@@ -79,21 +100,53 @@ func TestRotate_Union_koDifferentHashFuncsBFs(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	set1 := New(ctx, Config{testutils.TestCfg, 5})
-	set2 := New(ctx, Config{testutils.TestCfg3, 5})
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	set2 := New(ctx, Config{Config: testutils.TestCfg3, TTL: 5})
 	if _, err := set1.Union(set2); err == nil || !strings.Contains(err.Error(), "different hashers") {
 		t.Errorf("Unexpected error, %v", err)
 	}
 }
 
+func TestRotate_concurrentCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, cfg := range []bloomfilter.Config{testutils.TestCfg, testutils.TestCfg3} {
+		testutils.CallConcurrentCheck(t, New(ctx, Config{Config: cfg, TTL: 5}))
+	}
+}
+
+func TestRotate_concurrentAdd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, cfg := range []bloomfilter.Config{testutils.TestCfg, testutils.TestCfg3} {
+		cfg.N = 2000
+		testutils.CallConcurrentAdd(t, New(ctx, Config{Config: cfg, TTL: 5}))
+	}
+}
+
+func TestRotate_Union_koDifferentSeeds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	cfg := testutils.TestCfg
+	cfg.Seed = 42
+	set2 := New(ctx, Config{Config: cfg, TTL: 5})
+	if _, err := set1.Union(set2); err != bbloomfilter.ErrDifferentSeeds {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
 func TestRotate_Unmarshal_ok(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	set1 := New(ctx, Config{testutils.TestCfg, 5})
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
 	elem := []byte("wwwww")
 	set1.Add(elem)
-	set2 := New(ctx, Config{testutils.TestCfg, 5})
+	set2 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
 	if set2.Check(elem) {
 		t.Errorf("Unexpected elem %s in set2", elem)
 	}
@@ -113,12 +166,910 @@ func TestRotate_UnmarshalBinary_ko(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	set1 := New(ctx, Config{testutils.TestCfg, 5})
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
 	if err := set1.UnmarshalBinary([]byte{}); err == nil {
 		t.Error("should have given error")
 	}
 }
 
+func TestRotate_WriteTo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	set1 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	elem := []byte("wwwww")
+	set1.Add(elem)
+
+	buf := new(bytes.Buffer)
+	n, err := set1.WriteTo(buf)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("unexpected size %d, want %d", n, buf.Len())
+	}
+
+	raw := new(bytes.Buffer)
+	r, err := decompress(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if _, err := raw.ReadFrom(r); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if size := set1.EstimatedSize(); size != raw.Len() {
+		t.Errorf("unexpected estimated size %d, want %d", size, raw.Len())
+	}
+
+	set2 := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	if _, err := set2.ReadFrom(buf); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !set2.Check(elem) || set2.Config != set1.Config {
+		t.Errorf("Expecting elem %s in set2", elem)
+	}
+	if !set2.Current.Concurrent() {
+		t.Error("the restored bloomfilters are not concurrent-safe")
+	}
+}
+
+func TestRotate_UnmarshalBinary_legacy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{Config: testutils.TestCfg, TTL: 5}
+	current := bbloomfilter.New(cfg.Config)
+	elem := []byte("wwwww")
+	current.Add(elem)
+
+	buf := new(bytes.Buffer)
+	w := compressor.NewWriter(buf)
+	if err := gob.NewEncoder(w).Encode(SerializibleBloomfilter{
+		Previous: bbloomfilter.New(cfg.Config),
+		Current:  current,
+		Next:     bbloomfilter.New(cfg.Config),
+		Config:   cfg,
+	}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	w.Close()
+
+	set := New(ctx, cfg)
+	if err := set.UnmarshalBinary(buf.Bytes()); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !set.Check(elem) || !set.Current.Concurrent() {
+		t.Errorf("Expecting elem %s in the restored set", elem)
+	}
+}
+
+func TestRotate_UnmarshalBinary_invalid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{Config: testutils.TestCfg, TTL: 5}
+	other := testutils.TestCfg
+	other.Seed = 42
+	for name, target := range map[string]SerializibleBloomfilter{
+		"missing filter":  {Current: bbloomfilter.New(cfg.Config), Next: bbloomfilter.New(cfg.Config), Config: cfg},
+		"invalid ttl":     {Previous: bbloomfilter.New(cfg.Config), Current: bbloomfilter.New(cfg.Config), Next: bbloomfilter.New(cfg.Config), Config: Config{Config: testutils.TestCfg, TTL: 0}},
+		"config mismatch": {Previous: bbloomfilter.New(cfg.Config), Current: bbloomfilter.New(other), Next: bbloomfilter.New(cfg.Config), Config: cfg},
+	} {
+		buf := new(bytes.Buffer)
+		w := compressor.NewWriter(buf)
+		if err := gob.NewEncoder(w).Encode(target); err != nil {
+			t.Errorf("%s: unexpected error, %v", name, err)
+			continue
+		}
+		w.Close()
+
+		set := New(ctx, cfg)
+		if err := set.UnmarshalBinary(buf.Bytes()); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: unexpected error, %v", name, err)
+		}
+	}
+
+	set := New(ctx, cfg)
+	raw := new(bytes.Buffer)
+	if err := writeStream(raw, cfg, []*bbloomfilter.Bloomfilter{set.Previous, set.Current, set.Next}, time.Now()); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	for name, tc := range map[string]struct {
+		corrupt func([]byte) []byte
+		err     error
+	}{
+		"bad checksum":  {func(d []byte) []byte { d[5] = 1; return d }, bbloomfilter.ErrBadChecksum},
+		"truncated":     {func(d []byte) []byte { return d[:len(d)-1] }, io.ErrUnexpectedEOF},
+		"trailing data": {func(d []byte) []byte { return append(d, 0) }, nil},
+		"old version":   {func(d []byte) []byte { d[4] = 3; return d }, ErrUnsupportedVersion},
+	} {
+		buf := new(bytes.Buffer)
+		w := compressor.NewWriter(buf)
+		w.Write(tc.corrupt(append([]byte{}, raw.Bytes()...)))
+		w.Close()
+		if err := set.UnmarshalBinary(buf.Bytes()); err == nil || (tc.err != nil && !errors.Is(err, tc.err)) {
+			t.Errorf("%s: unexpected error, %v", name, err)
+		}
+	}
+}
+
+func FuzzRotate_UnmarshalBinary(f *testing.F) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	set := New(ctx, Config{Config: testutils.TestCfg, TTL: 5})
+	set.Add([]byte{1, 2, 3})
+	data, err := set.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		set := new(Bloomfilter)
+		if err := set.UnmarshalBinary(data); err != nil {
+			return
+		}
+		defer set.Close()
+
+		set.Add([]byte{1, 2, 3})
+		if !set.Check([]byte{1, 2, 3}) {
+			t.Error("failed check after decoding")
+		}
+	})
+}
+
+func TestRotate_Checkpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{Config: testutils.TestCfg, TTL: 5, Checkpoint: CheckpointConfig{Dir: t.TempDir(), Retention: 2}}
+	set1 := New(ctx, cfg)
+	elem := []byte("wwwww")
+	set1.Add(elem)
+	for i := 0; i < 4; i++ {
+		if err := set1.Checkpoint(); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+	}
+	if snapshots, err := listCheckpoints(cfg.Checkpoint.Dir); err != nil || len(snapshots) != 2 {
+		t.Errorf("unexpected snapshots %v, %v", snapshots, err)
+	}
+	if err := set1.CheckpointError(); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	set2, err := Build(ctx, cfg)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer set2.Close()
+	if !set2.Check(elem) || !set2.Current.Concurrent() {
+		t.Errorf("Expecting elem %s in the restored set", elem)
+	}
+
+	if err := New(ctx, Config{Config: testutils.TestCfg, TTL: 5}).Checkpoint(); err != ErrNoCheckpointDir {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestRotate_Checkpoint_elapsed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	elem := []byte("wwwww")
+	for _, tc := range []struct {
+		elapsed time.Duration
+		present bool
+	}{
+		{4 * time.Second, true},
+		{11 * time.Second, true},
+		{16 * time.Second, false},
+		{time.Hour, false},
+	} {
+		cfg := Config{Config: testutils.TestCfg, TTL: 5, Checkpoint: CheckpointConfig{Dir: t.TempDir()}}
+		set1 := New(ctx, cfg)
+		set1.Add(elem)
+		now := time.Now()
+		set1.rotatedAt = now.Add(-tc.elapsed)
+		if err := set1.Checkpoint(); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+
+		set2 := &Bloomfilter{Config: cfg}
+		delay, err := set2.restoreCheckpoint(now)
+		if err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+		if want := 5*time.Second - tc.elapsed%(5*time.Second); delay != want {
+			t.Errorf("%s: unexpected delay %s, want %s", tc.elapsed, delay, want)
+		}
+		if (set2.Previous.Check(elem) || set2.Current.Check(elem)) != tc.present {
+			t.Errorf("%s: unexpected presence of the element", tc.elapsed)
+		}
+	}
+}
+
+func TestRotate_Checkpoint_ko(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{Config: testutils.TestCfg, TTL: 5, Checkpoint: CheckpointConfig{Dir: t.TempDir()}}
+	set1 := New(ctx, cfg)
+	elem := []byte("wwwww")
+	set1.Add(elem)
+	if err := set1.Checkpoint(); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	corrupted := filepath.Join(cfg.Checkpoint.Dir, checkpointPrefix+"99999999999999999999"+checkpointSuffix)
+	if err := os.WriteFile(corrupted, []byte("garbage"), 0o600); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	set2, err := Build(ctx, cfg)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !set2.Check(elem) {
+		t.Error("the older snapshot was not restored")
+	}
+
+	other := cfg
+	other.Seed = 42
+	if _, err := Build(ctx, other); err == nil || !strings.Contains(err.Error(), ErrIncompatibleCheckpoint.Error()) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestRotate_WAL(t *testing.T) {
+	for _, sync := range []string{WALSyncAlways, WALSyncInterval, WALSyncNever} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cfg := Config{Config: testutils.TestCfg, TTL: 5, WAL: WALConfig{Dir: t.TempDir(), Sync: sync, SyncInterval: 1}}
+		set1, err := Build(ctx, cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error, %v", sync, err)
+			cancel()
+			return
+		}
+		if err := set1.AddBatch([][]byte{[]byte("a"), []byte("b")}); err != nil {
+			t.Errorf("%s: unexpected error, %v", sync, err)
+		}
+		set1.Add([]byte("c"))
+		// the set is not closed, as if the process crashed
+		cancel()
+
+		ctx, cancel = context.WithCancel(context.Background())
+		set2, err := Build(ctx, cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error, %v", sync, err)
+			cancel()
+			return
+		}
+		for _, elem := range []string{"a", "b", "c"} {
+			if !set2.Check([]byte(elem)) {
+				t.Errorf("%s: elem %s not replayed", sync, elem)
+			}
+		}
+		set2.Close()
+		if err := set2.AddBatch([][]byte{[]byte("d")}); err != ErrWALClosed {
+			t.Errorf("%s: unexpected error, %v", sync, err)
+		}
+		cancel()
+	}
+}
+
+func TestRotate_WAL_brokenCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{
+		Config:     testutils.TestCfg,
+		TTL:        5,
+		Checkpoint: CheckpointConfig{Dir: t.TempDir()},
+		WAL:        WALConfig{Dir: t.TempDir()},
+	}
+	set1, err := Build(ctx, cfg, WithoutTicker())
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	set1.Add([]byte("logged"))
+	set1.wal.Close()
+
+	corrupted := filepath.Join(cfg.Checkpoint.Dir, checkpointPrefix+"99999999999999999999"+checkpointSuffix)
+	if err := os.WriteFile(corrupted, []byte("garbage"), 0o600); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if _, err := Build(ctx, cfg, WithoutTicker()); err == nil || !strings.Contains(err.Error(), "unable to restore a checkpoint") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	var reported []error
+	set2 := New(ctx, cfg, WithoutTicker(), OnError(func(err error) { reported = append(reported, err) }))
+	defer set2.Close()
+	if len(reported) != 1 || !strings.Contains(reported[0].Error(), "unable to restore a checkpoint") {
+		t.Errorf("unexpected reported errors: %v", reported)
+	}
+	if !set2.Check([]byte("logged")) {
+		t.Error("the wal was not replayed")
+	}
+	if set2.wal == nil {
+		t.Error("the wal was not opened")
+	}
+}
+
+func TestRotate_WAL_rotateAfterClose(t *testing.T) {
+	cfg := Config{Config: testutils.TestCfg, TTL: 5, WAL: WALConfig{Dir: t.TempDir()}}
+	set, err := Build(context.Background(), cfg, WithoutTicker())
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	set.Close()
+	before, _ := listSegments(cfg.WAL.Dir)
+	set.Rotate()
+	if after, _ := listSegments(cfg.WAL.Dir); len(after) != len(before) {
+		t.Errorf("the closed wal was rolled: %v", after)
+	}
+	if err := set.WALError(); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestRotate_WAL_replay(t *testing.T) {
+	cfg := WALConfig{Dir: t.TempDir()}
+	ttl := 5 * time.Second
+	now := time.Now()
+
+	w, err := openWAL(cfg, ttl, now.Add(-time.Hour))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	w.append([][]byte{[]byte("expired")}, now.Add(-time.Hour))
+	if err := w.roll(now.Add(-11 * time.Second)); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	w.append([][]byte{[]byte("old")}, now.Add(-11*time.Second))
+	w.append([][]byte{[]byte("recent")}, now.Add(-9*time.Second))
+	w.Close()
+
+	// a torn record at the tail of the segment is ignored
+	segments, _ := listSegments(cfg.Dir)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	f.Write([]byte{20, 0, 0, 0, 1, 2})
+	f.Close()
+
+	var replayed []string
+	if err := replayWAL(cfg, ttl, now, func(elem []byte, _ time.Time) { replayed = append(replayed, string(elem)) }); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if len(replayed) != 1 || replayed[0] != "recent" {
+		t.Errorf("unexpected replayed elements %v", replayed)
+	}
+
+	w, err = openWAL(cfg, ttl, now)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer w.Close()
+	if segments, _ := listSegments(cfg.Dir); len(segments) != 2 {
+		t.Errorf("the expired segment was not pruned: %v", segments)
+	}
+}
+
+func TestRotate_WAL_replayWindows(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	cfg := Config{Config: testutils.TestCfg, TTL: 5, WAL: WALConfig{Dir: t.TempDir(), Sync: WALSyncAlways}}
+	set1, err := Build(ctx, cfg, WithClock(clock), WithoutTicker())
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	clock.Advance(4 * time.Second)
+	set1.Add([]byte("expired"))
+	clock.Advance(4 * time.Second)
+	set1.Add([]byte("previous"))
+	clock.Advance(3 * time.Second)
+	set1.Add([]byte("recent"))
+	set1.wal.Close()
+
+	// the restarted set rotated now, so only the elements of the last TTL are still in the current one
+	set2, err := Build(ctx, cfg, WithClock(clock), WithoutTicker())
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer set2.Close()
+
+	for elem, in := range map[string][2]bool{
+		"expired":  {false, false},
+		"previous": {true, false},
+		"recent":   {true, true},
+	} {
+		if set2.Current.Check([]byte(elem)) != in[0] || set2.Next.Check([]byte(elem)) != in[1] {
+			t.Errorf("elem %s replayed in the wrong generations", elem)
+		}
+	}
+}
+
+func TestRotate_WAL_invalidSync(t *testing.T) {
+	cfg := Config{Config: testutils.TestCfg, TTL: 5, WAL: WALConfig{Dir: t.TempDir(), Sync: "sometimes"}}
+	if _, err := Build(context.Background(), cfg); !errors.Is(err, ErrInvalidWALSync) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+// fakeClock only moves when advanced, signaling every scheduled wait on registered
+type fakeClock struct {
+	mutex      sync.Mutex
+	now        time.Time
+	waiters    []fakeWaiter
+	registered chan struct{}
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0), registered: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{deadline: c.now.Add(d), c: ch})
+	c.registered <- struct{}{}
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = waiters
+}
+
+func TestRotate_Checkpoint_clock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	cfg := Config{
+		Config:     testutils.TestCfg,
+		TTL:        5,
+		Checkpoint: CheckpointConfig{Dir: t.TempDir(), Interval: 1},
+		WAL:        WALConfig{Dir: t.TempDir(), Sync: WALSyncInterval},
+	}
+	set := New(ctx, cfg, WithClock(clock), WithoutTicker())
+	defer set.Close()
+
+	// the checkpoints and the syncs of the wal wait on the clock
+	for i := 0; i < 2; i++ {
+		<-clock.registered
+	}
+	if snapshots, _ := listCheckpoints(cfg.Checkpoint.Dir); len(snapshots) != 0 {
+		t.Errorf("unexpected snapshots before advancing the clock: %v", snapshots)
+	}
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		<-clock.registered
+	}
+	if snapshots, _ := listCheckpoints(cfg.Checkpoint.Dir); len(snapshots) != 1 {
+		t.Errorf("unexpected snapshots after advancing the clock: %v", snapshots)
+	}
+}
+
+func TestRotate_restoreRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{
+		Config:      testutils.TestCfg,
+		TTLDuration: time.Millisecond,
+		Checkpoint:  CheckpointConfig{Dir: t.TempDir()},
+		Saturation:  SaturationConfig{MaxFill: 0.5, Interval: 1},
+	}
+	set := New(ctx, cfg)
+	defer set.Close()
+
+	src := New(ctx, cfg)
+	defer src.Close()
+	data, err := src.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	// the goroutines of the replaced set must be done before it is overwritten
+	for i := 0; i < 10; i++ {
+		if err := set.UnmarshalBinary(data); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRotate_Rotate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	var evicted []*bbloomfilter.Bloomfilter
+	bf := New(ctx, Config{Config: testutils.TestCfg, TTL: 1}, WithClock(clock), WithoutTicker(), OnRotate(func(b *bbloomfilter.Bloomfilter) {
+		evicted = append(evicted, b)
+	}))
+	elem := []byte("wwwww")
+	bf.Add(elem)
+
+	for i := 0; i < 2; i++ {
+		bf.Rotate()
+		if !bf.Check(elem) {
+			t.Errorf("elem not present after %d rotations", i+1)
+		}
+	}
+	bf.Rotate()
+	if bf.Check(elem) {
+		t.Error("elem present after 3 rotations")
+	}
+
+	if len(evicted) != 3 {
+		t.Errorf("unexpected number of hook calls: %d", len(evicted))
+		return
+	}
+	if evicted[0].Check(elem) || !evicted[1].Check(elem) || !evicted[2].Check(elem) {
+		t.Error("the hooks did not receive the evicted bloomfilters")
+	}
+
+	if n := len(clock.registered); n != 0 {
+		t.Errorf("%d rotations scheduled without the ticker", n)
+	}
+}
+
+func TestRotate_clock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	start := clock.Now()
+	rotated := make(chan *bbloomfilter.Bloomfilter)
+	ttl := 100 * time.Millisecond
+	bf := New(ctx, Config{Config: testutils.TestCfg, TTLDuration: ttl}, WithClock(clock), OnRotate(func(b *bbloomfilter.Bloomfilter) {
+		rotated <- b
+	}))
+	elem := []byte("wwwww")
+	bf.Add(elem)
+
+	for i := 1; i <= 3; i++ {
+		<-clock.registered
+		clock.Advance(ttl - time.Millisecond)
+		select {
+		case <-rotated:
+			t.Errorf("rotation %d before the ttl", i)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		clock.Advance(time.Millisecond)
+		<-rotated
+		if _, _, rotatedAt := bf.snapshot(); !rotatedAt.Equal(start.Add(time.Duration(i) * ttl)) {
+			t.Errorf("unexpected rotation time %v", rotatedAt)
+		}
+		if present := bf.Check(elem); present != (i < 3) {
+			t.Errorf("unexpected presence after %d rotations: %v", i, present)
+		}
+	}
+}
+
+func TestRotate_TTLDuration(t *testing.T) {
+	cfg := Config{Config: testutils.TestCfg, TTLDuration: 500 * time.Millisecond}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if ttl := cfg.ttl(); ttl != 500*time.Millisecond {
+		t.Errorf("unexpected ttl %v", ttl)
+	}
+	cfg.TTL = 5
+	if ttl := cfg.ttl(); ttl != 500*time.Millisecond {
+		t.Errorf("the ttl duration does not take precedence: %v", ttl)
+	}
+	if ring := cfg.Ring(); ring.period() != 500*time.Millisecond {
+		t.Errorf("unexpected ring period %v", ring.period())
+	}
+}
+
+func TestRotate_aligned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	clock.Advance(300 * time.Millisecond)
+	rotated := make(chan struct{})
+	bf := New(ctx, Config{Config: testutils.TestCfg, TTL: 1, Aligned: true}, WithClock(clock), OnRotate(func(*bbloomfilter.Bloomfilter) {
+		rotated <- struct{}{}
+	}))
+	epoch := time.Unix(1700000000, 0)
+	if _, _, rotatedAt := bf.snapshot(); !rotatedAt.Equal(epoch) {
+		t.Errorf("unexpected start of the generation %v", rotatedAt)
+	}
+
+	<-clock.registered
+	clock.Advance(699 * time.Millisecond)
+	select {
+	case <-rotated:
+		t.Error("rotation before the end of the epoch")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	<-rotated
+	if _, _, rotatedAt := bf.snapshot(); !rotatedAt.Equal(epoch.Add(time.Second)) {
+		t.Errorf("unexpected rotation time %v", rotatedAt)
+	}
+}
+
+func TestRotate_Union_shifted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{Config: testutils.TestCfg, TTL: 10, Aligned: true}
+	epoch := time.Unix(1700000000, 0)
+	elem := []byte("wwwww")
+	// whatever the shift, the elem added to the other set after its last rotation is kept for 3 rotations
+	for shift := time.Duration(-2); shift <= 3; shift++ {
+		set1 := New(ctx, cfg, WithoutTicker())
+		set1.rotatedAt = epoch
+		set2 := New(ctx, cfg, WithoutTicker())
+		set2.rotatedAt = epoch.Add(-shift * 10 * time.Second)
+		set2.Add(elem)
+
+		if _, err := set1.Union(set2); err != nil {
+			t.Errorf("shift %d: unexpected error, %v", shift, err)
+			continue
+		}
+		for i := 0; i < 3; i++ {
+			if !set1.Check(elem) {
+				t.Errorf("shift %d: elem not present after %d rotations", shift, i)
+			}
+			set1.Rotate()
+		}
+		if set1.Check(elem) {
+			t.Errorf("shift %d: elem present after 3 rotations", shift)
+		}
+	}
+
+	set1 := New(ctx, cfg, WithoutTicker())
+	set1.rotatedAt = epoch
+	set2 := New(ctx, cfg, WithoutTicker())
+	set2.rotatedAt = epoch.Add(-4 * time.Second)
+	if _, err := set1.Union(set2); !errors.Is(err, ErrMisalignedGenerations) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	set2.Config.TTL = 20
+	if _, err := set1.Union(set2); err == nil || !strings.Contains(err.Error(), "different ttl values") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestRotate_UnmarshalBinary_rotatedAt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	cfg := Config{Config: testutils.TestCfg, TTL: 10}
+	set1 := New(ctx, cfg, WithClock(clock), WithoutTicker())
+	elem := []byte("wwwww")
+	set1.Add(elem)
+	data, err := set1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	clock.Advance(25 * time.Second)
+	set2 := New(ctx, cfg, WithClock(clock), WithoutTicker())
+	if err := set2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if _, _, rotatedAt := set2.snapshot(); !rotatedAt.Equal(time.Unix(1700000020, 0)) {
+		t.Errorf("unexpected rotation time %v", rotatedAt)
+	}
+	if !set2.Check(elem) {
+		t.Error("elem not present after 2 rotations")
+	}
+
+	clock.Advance(10 * time.Second)
+	if err := set2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if set2.Check(elem) {
+		t.Error("elem present after 3 rotations")
+	}
+
+	// a payload with an unknown rotation time is restored as is
+	raw := new(bytes.Buffer)
+	w := compressor.NewWriter(raw)
+	if err := writeStream(w, cfg, []*bbloomfilter.Bloomfilter{set1.Previous, set1.Current, set1.Next}, time.Time{}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	w.Close()
+	if err := set2.UnmarshalBinary(raw.Bytes()); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if _, _, rotatedAt := set2.snapshot(); !set2.Check(elem) || !rotatedAt.Equal(clock.Now()) {
+		t.Error("the payload without rotation time was not restored")
+	}
+}
+
+func TestRotate_Saturation_maxCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rotations := 0
+	cfg := Config{Config: testutils.TestCfg, TTL: 10, Saturation: SaturationConfig{MaxCount: 10}}
+	bf := New(ctx, cfg, WithoutTicker(), OnRotate(func(*bbloomfilter.Bloomfilter) {
+		rotations++
+	}))
+	for i := 0; i < 9; i++ {
+		bf.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+	if rotations != 0 {
+		t.Errorf("unexpected rotations: %d", rotations)
+	}
+	bf.AddBatch([][]byte{[]byte("elem-9"), []byte("elem-10")})
+	if rotations != 1 {
+		t.Errorf("unexpected rotations: %d", rotations)
+	}
+	if s := bf.Saturation(); s.Count != 11 {
+		t.Errorf("unexpected count of the current bloomfilter: %d", s.Count)
+	}
+
+	for i := 11; i < 20; i++ {
+		bf.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+	if rotations != 1 {
+		t.Errorf("unexpected rotations: %d", rotations)
+	}
+	bf.Add([]byte("elem-20"))
+	if rotations != 2 {
+		t.Errorf("unexpected rotations: %d", rotations)
+	}
+}
+
+func TestRotate_Saturation_alarm(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	saturated := make(chan Saturation, 10)
+	rotated := make(chan struct{}, 10)
+	cfg := Config{Config: testutils.TestCfg, TTL: 10, Saturation: SaturationConfig{MaxFPRate: 0.01, Interval: 100}}
+	bf := New(ctx, cfg, WithClock(clock), WithoutTicker(), OnSaturation(func(s Saturation) {
+		saturated <- s
+	}), OnRotate(func(*bbloomfilter.Bloomfilter) {
+		rotated <- struct{}{}
+	}))
+
+	<-clock.registered
+	clock.Advance(100 * time.Millisecond)
+	<-clock.registered
+	if len(saturated) != 0 {
+		t.Error("unexpected alarm")
+	}
+
+	for i := 0; i < 300; i++ {
+		bf.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+	for i := 0; i < 2; i++ {
+		clock.Advance(100 * time.Millisecond)
+		<-clock.registered
+	}
+	if len(saturated) != 1 {
+		t.Errorf("unexpected alarms: %d", len(saturated))
+		return
+	}
+	if s := <-saturated; s.Count != 300 || s.FPRate <= 0.01 || s.Fill < 0.5 {
+		t.Errorf("unexpected saturation %+v", s)
+	}
+	if len(rotated) != 0 {
+		t.Error("the set rotated without a max fill")
+	}
+}
+
+func TestRotate_Saturation_maxFill(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	rotated := make(chan struct{}, 10)
+	cfg := Config{Config: testutils.TestCfg, TTL: 10, Saturation: SaturationConfig{MaxFill: 0.5, Interval: 100}}
+	bf := New(ctx, cfg, WithClock(clock), WithoutTicker(), OnRotate(func(*bbloomfilter.Bloomfilter) {
+		rotated <- struct{}{}
+	}))
+	for i := 0; i < 300; i++ {
+		bf.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+
+	// the next bloomfilter holds the same elements, so it is rotated too
+	for i := 0; i < 3; i++ {
+		<-clock.registered
+		clock.Advance(100 * time.Millisecond)
+	}
+	<-clock.registered
+	if len(rotated) != 2 {
+		t.Errorf("unexpected rotations: %d", len(rotated))
+	}
+	if s := bf.Saturation(); s.Count != 0 || s.Fill != 0 {
+		t.Errorf("unexpected saturation %+v", s)
+	}
+}
+
+func TestRotate_Saturation_invalid(t *testing.T) {
+	for _, tc := range []struct {
+		cfg SaturationConfig
+		err error
+	}{
+		{SaturationConfig{MaxFill: 1.5}, ErrInvalidMaxFill},
+		{SaturationConfig{MaxFill: -1}, ErrInvalidMaxFill},
+		{SaturationConfig{MaxFPRate: 1}, ErrInvalidMaxFPRate},
+	} {
+		cfg := Config{Config: testutils.TestCfg, TTL: 10, Saturation: tc.cfg}
+		if _, err := Build(context.Background(), cfg); !errors.Is(err, tc.err) {
+			t.Errorf("Unexpected error, %v", err)
+		}
+	}
+}
+
 func TestRotate_KeepRotating(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -128,7 +1079,7 @@ func TestRotate_KeepRotating(t *testing.T) {
 		Previous: bbloomfilter.New(testutils.TestCfg),
 		Current:  bbloomfilter.New(testutils.TestCfg),
 		Next:     bbloomfilter.New(testutils.TestCfg),
-		Config:   Config{testutils.TestCfg, 5},
+		Config:   Config{Config: testutils.TestCfg, TTL: 5},
 		cancel:   cancel,
 		mutex:    &sync.RWMutex{},
 		ctx:      ctx,
@@ -179,12 +1130,12 @@ func TestRotate_KeepRotating(t *testing.T) {
 func BenchmarkRotate_UnmarshalBinary_GZIP(b *testing.B) {
 	compressor = new(Gzip)
 	cfg := Config{
-		bloomfilter.Config{
+		Config: bloomfilter.Config{
 			N:        1000000,
 			P:        1e-7,
 			HashName: bloomfilter.HASHER_OPTIMAL,
 		},
-		10000,
+		TTL: 10000,
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	benchmarkRotate_UnmarshalBinary(b, New(ctx, cfg))
@@ -0,0 +1,116 @@
+package rotate
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+)
+
+// SaturationConfig bounds the load of the bloomfilters of a sliding set. When MaxCount elements are added
+// between two rotations or the fill ratio of the current bloomfilter reaches MaxFill, the set rotates early,
+// before the TTL elapses. As the current bloomfilter holds the elements of the last two rotations, MaxCount
+// is usually half of N. When the estimated false positive rate of the current bloomfilter exceeds MaxFPRate,
+// the OnSaturation hooks are called. The fill ratio and the false positive rate are checked every Interval
+// milliseconds. Zero values disable the thresholds
+type SaturationConfig struct {
+	MaxCount  uint64  `json:"max_count,omitempty"`
+	MaxFill   float64 `json:"max_fill,omitempty"`
+	MaxFPRate float64 `json:"max_fp_rate,omitempty"`
+	Interval  uint    `json:"interval,omitempty"`
+}
+
+// DefaultSaturationInterval is used when the saturation interval is not configured
+const DefaultSaturationInterval = time.Second
+
+var (
+	// ErrInvalidMaxFill is returned when the max fill ratio is out of range
+	ErrInvalidMaxFill = errors.New("the max fill must be between 0 and 1")
+	// ErrInvalidMaxFPRate is returned when the false positive rate ceiling is out of range
+	ErrInvalidMaxFPRate = errors.New("the max fp rate must be between 0 and 1")
+)
+
+// Saturation describes the load of the current bloomfilter of a sliding set: the number of elements added
+// to it, its fill ratio and its estimated false positive rate
+type Saturation struct {
+	Count  uint64
+	Fill   float64
+	FPRate float64
+}
+
+// SaturationHook is called once per generation, when the estimated false positive rate of the current
+// bloomfilter exceeds the configured ceiling
+type SaturationHook func(Saturation)
+
+// Validate checks the saturation thresholds
+func (c SaturationConfig) Validate() error {
+	if c.MaxFill < 0 || c.MaxFill > 1 {
+		return ErrInvalidMaxFill
+	}
+	if c.MaxFPRate < 0 || c.MaxFPRate >= 1 {
+		return ErrInvalidMaxFPRate
+	}
+	return nil
+}
+
+func (c SaturationConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return DefaultSaturationInterval
+	}
+	return time.Duration(c.Interval) * time.Millisecond
+}
+
+func (c SaturationConfig) monitored() bool {
+	return c.MaxFill > 0 || c.MaxFPRate > 0
+}
+
+// Saturation returns the load of the current bloomfilter. The false positive rate is estimated from its
+// fill ratio, so it takes the repeated elements into account
+func (bs *Bloomfilter) Saturation() Saturation {
+	bs.mutex.RLock()
+	current := bs.Current
+	count := bs.currentCount.Load()
+	bs.mutex.RUnlock()
+
+	return saturation(current, count)
+}
+
+func saturation(b *bbloomfilter.Bloomfilter, count uint64) Saturation {
+	fill := b.Capacity()
+	return Saturation{
+		Count:  count,
+		Fill:   fill,
+		FPRate: math.Pow(fill, float64(b.K())),
+	}
+}
+
+// keepMonitoring checks the saturation of the current bloomfilter every interval, raising the alarm once
+// per generation and rotating the set when it is too full
+func (bs *Bloomfilter) keepMonitoring(ctx context.Context) {
+	cfg := bs.Config.Saturation
+	var alarmed *bbloomfilter.Bloomfilter
+	for {
+		var now time.Time
+		select {
+		case now = <-bs.opts.after(cfg.interval()):
+		case <-ctx.Done():
+			return
+		}
+
+		bs.mutex.RLock()
+		current := bs.Current
+		count := bs.currentCount.Load()
+		bs.mutex.RUnlock()
+
+		s := saturation(current, count)
+		if cfg.MaxFPRate > 0 && s.FPRate > cfg.MaxFPRate && alarmed != current {
+			alarmed = current
+			bs.opts.saturated(s)
+		}
+		if cfg.MaxFill > 0 && s.Fill >= cfg.MaxFill {
+			bs.rotateAt(now, current)
+		}
+	}
+}
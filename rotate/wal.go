@@ -0,0 +1,327 @@
+package rotate
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WALConfig enables the write-ahead log of the added elements into Dir, so the elements added after the
+// last checkpoint survive a crash. Sync selects when the log is flushed to the disk: WALSyncAlways after
+// every add, WALSyncInterval every SyncInterval milliseconds (the default) and WALSyncNever leaves it to
+// the OS. When Dir is empty, no log is written
+type WALConfig struct {
+	Dir          string `json:"dir,omitempty"`
+	Sync         string `json:"sync,omitempty"`
+	SyncInterval uint   `json:"sync_interval,omitempty"`
+}
+
+const (
+	WALSyncAlways   = "always"
+	WALSyncInterval = "interval"
+	WALSyncNever    = "never"
+
+	// DefaultWALSyncInterval is used when the sync interval is not configured
+	DefaultWALSyncInterval = time.Second
+
+	walPrefix = "wal-"
+	walSuffix = ".log"
+	// every record is framed by the length of the payload and its checksum. The payload is the timestamp
+	// of the add in unix nanoseconds followed by the element
+	walFrameSize   = 8
+	walMaxRecord   = 1 << 26
+	walTimestampSz = 8
+)
+
+var (
+	// ErrInvalidWALSync is returned when the sync policy of the write-ahead log is unknown
+	ErrInvalidWALSync = errors.New("the wal sync must be always, interval or never")
+	// ErrWALClosed is returned when adding to a set whose write-ahead log is closed
+	ErrWALClosed = errors.New("wal closed")
+)
+
+// Validate checks the write-ahead log config
+func (c WALConfig) Validate() error {
+	switch c.Sync {
+	case "", WALSyncAlways, WALSyncInterval, WALSyncNever:
+		return nil
+	}
+	return ErrInvalidWALSync
+}
+
+func (c WALConfig) syncInterval() time.Duration {
+	if c.SyncInterval == 0 {
+		return DefaultWALSyncInterval
+	}
+	return time.Duration(c.SyncInterval) * time.Millisecond
+}
+
+// wal is a write-ahead log split in segments, rolled at every rotation of the set
+type wal struct {
+	cfg    WALConfig
+	ttl    time.Duration
+	mutex  *sync.Mutex
+	f      *os.File
+	dirty  bool
+	closed bool
+	err    error
+}
+
+func openWAL(cfg WALConfig, ttl time.Duration, now time.Time) (*wal, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	w := &wal{cfg: cfg, ttl: ttl, mutex: new(sync.Mutex)}
+	if err := w.roll(now); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// append logs the elements with a single write, syncing it when the policy is WALSyncAlways
+func (w *wal) append(elems [][]byte, now time.Time) error {
+	if w == nil {
+		return nil
+	}
+
+	size := 0
+	for _, elem := range elems {
+		if len(elem) > walMaxRecord {
+			return fmt.Errorf("element too large for the wal: %d bytes", len(elem))
+		}
+		size += walFrameSize + walTimestampSz + len(elem)
+	}
+	buf := make([]byte, 0, size)
+	ts := uint64(now.UnixNano())
+	for _, elem := range elems {
+		start := len(buf)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(walTimestampSz+len(elem)))
+		buf = append(buf, 0, 0, 0, 0)
+		buf = binary.LittleEndian.AppendUint64(buf, ts)
+		buf = append(buf, elem...)
+		binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(buf[start+walFrameSize:], crc32c))
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.f == nil {
+		return ErrWALClosed
+	}
+	if _, err := w.f.Write(buf); err != nil {
+		w.err = err
+		return err
+	}
+	w.dirty = true
+	if w.cfg.Sync == WALSyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+// sync flushes the current segment to the disk. The caller must hold the lock
+func (w *wal) sync() error {
+	if !w.dirty || w.f == nil {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		w.err = err
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// roll closes the current segment and opens a new one, removing the segments whose records are all older
+// than two TTLs. A closed log is not reopened
+func (w *wal) roll(now time.Time) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrWALClosed
+	}
+	if err := w.closeSegment(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(w.cfg.Dir, fmt.Sprintf("%s%020d%s", walPrefix, now.UnixNano(), walSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	w.f = f
+	if err := syncDir(w.cfg.Dir); err != nil {
+		return err
+	}
+
+	return w.prune(now)
+}
+
+// fail records an error of the log, so it is reported by Err. Rolling a closed log is not an error
+func (w *wal) fail(err error) {
+	if w == nil || err == ErrWALClosed {
+		return
+	}
+
+	w.mutex.Lock()
+	w.err = err
+	w.mutex.Unlock()
+}
+
+// prune removes the segments followed by a segment started more than two TTLs ago
+func (w *wal) prune(now time.Time) error {
+	segments, err := listSegments(w.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(segments); i++ {
+		if segmentTime(segments[i+1]).After(now.Add(-2 * w.ttl)) {
+			break
+		}
+		if err := os.Remove(segments[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wal) closeSegment() error {
+	if w.f == nil {
+		return nil
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Close syncs and closes the log
+func (w *wal) Close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.closed = true
+	return w.closeSegment()
+}
+
+// Err returns the last error writing or rolling the log, if any
+func (w *wal) Err() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.err
+}
+
+// keepSyncing flushes the current segment every sync interval, waiting for it with after
+func (w *wal) keepSyncing(ctx context.Context, after func(time.Duration) <-chan time.Time) {
+	interval := w.cfg.syncInterval()
+	for {
+		select {
+		case <-after(interval):
+			w.mutex.Lock()
+			w.sync()
+			w.mutex.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replayWAL calls add with the logged elements not older than two TTLs and the time they were added, in
+// the order they were added. A segment is read until its first torn or corrupted record
+func replayWAL(cfg WALConfig, ttl time.Duration, now time.Time, add func([]byte, time.Time)) error {
+	segments, err := listSegments(cfg.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	oldest := now.Add(-2 * ttl).UnixNano()
+	for _, name := range segments {
+		if err := replaySegment(name, oldest, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaySegment(name string, oldest int64, add func([]byte, time.Time)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	frame := make([]byte, walFrameSize)
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil
+		}
+		size := binary.LittleEndian.Uint32(frame)
+		if size < walTimestampSz || size > walTimestampSz+walMaxRecord {
+			return nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+		if crc32.Checksum(payload, crc32c) != binary.LittleEndian.Uint32(frame[4:]) {
+			return nil
+		}
+		if ts := int64(binary.LittleEndian.Uint64(payload)); ts >= oldest {
+			add(payload[walTimestampSz:], time.Unix(0, ts))
+		}
+	}
+}
+
+// listSegments returns the segments of the dir, the oldest first
+func listSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && strings.HasPrefix(name, walPrefix) && strings.HasSuffix(name, walSuffix) {
+			names = append(names, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func segmentTime(name string) time.Time {
+	var ns int64
+	fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), walPrefix), walSuffix), "%d", &ns)
+	return time.Unix(0, ns)
+}
@@ -0,0 +1,182 @@
+package rpc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// The permissions granted to the credentials. PermissionCheck allows the Check and List calls,
+// PermissionAdd the Add ones and PermissionUnion the Union ones. PermissionAdmin allows all of them, along
+// with the Create and Drop calls
+const (
+	PermissionCheck = "check"
+	PermissionAdd   = "add"
+	PermissionUnion = "union"
+	PermissionAdmin = "admin"
+)
+
+// MinTokenSize is the min number of chars of the tokens of the credentials
+const MinTokenSize = 16
+
+// AuthConfig lists the credentials allowed to call the server. When set, every call must carry the token
+// of one of them in its input and the mutating calls are audited with the ID of its credential
+type AuthConfig struct {
+	Credentials []Credential `json:"credentials"`
+}
+
+// Credential is a token shared with a caller, identified by ID, along with the permissions granted to it
+type Credential struct {
+	ID          string   `json:"id"`
+	Token       string   `json:"token"`
+	Permissions []string `json:"permissions"`
+}
+
+var (
+	// ErrUnauthorized is returned when the token of the call matches no credential
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned when the credential of the call is not granted the permission it requires
+	ErrForbidden = errors.New("permission denied")
+	// ErrNoCredentials is returned when the auth config has no credentials
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredential is returned when a credential has no ID, a short or repeated token, or unknown
+	// permissions
+	ErrInvalidCredential = errors.New("invalid credential")
+)
+
+// Validate checks the credentials
+func (c AuthConfig) Validate() error {
+	if len(c.Credentials) == 0 {
+		return ErrNoCredentials
+	}
+	ids := map[string]struct{}{}
+	tokens := map[string]struct{}{}
+	for _, cred := range c.Credentials {
+		if cred.ID == "" {
+			return fmt.Errorf("%w: missing id", ErrInvalidCredential)
+		}
+		if _, ok := ids[cred.ID]; ok {
+			return fmt.Errorf("%w: repeated id %s", ErrInvalidCredential, cred.ID)
+		}
+		ids[cred.ID] = struct{}{}
+		if len(cred.Token) < MinTokenSize {
+			return fmt.Errorf("%w: the token of %s is shorter than %d chars", ErrInvalidCredential, cred.ID, MinTokenSize)
+		}
+		if _, ok := tokens[cred.Token]; ok {
+			return fmt.Errorf("%w: the token of %s is repeated", ErrInvalidCredential, cred.ID)
+		}
+		tokens[cred.Token] = struct{}{}
+		for _, p := range cred.Permissions {
+			switch p {
+			case PermissionCheck, PermissionAdd, PermissionUnion, PermissionAdmin:
+			default:
+				return fmt.Errorf("%w: unknown permission %s of %s", ErrInvalidCredential, p, cred.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// AuditEntry describes a mutating call: the ID of the credential of the caller, empty when the auth is
+// disabled or the token is unknown, the called method, the name of the sliding bloomfilter set, the number
+// of added elements and the error of the call, if any
+type AuditEntry struct {
+	Caller string
+	Method string
+	Filter string
+	Count  int
+	Err    error
+}
+
+// Auditor records the mutating calls
+type Auditor func(AuditEntry)
+
+// LogAuditor records the mutating calls with the standard logger, when set with WithAuditor
+func LogAuditor(e AuditEntry) {
+	caller := e.Caller
+	if caller == "" {
+		caller = "anonymous"
+	}
+	if e.Err != nil {
+		log.Printf("[AUDIT] caller=%s method=%s filter=%s count=%d error=%q", caller, e.Method, e.Filter, e.Count, e.Err.Error())
+		return
+	}
+	log.Printf("[AUDIT] caller=%s method=%s filter=%s count=%d", caller, e.Method, e.Filter, e.Count)
+}
+
+// Option customizes the rpc layer
+type Option func(*options)
+
+type options struct {
+	auditor Auditor
+	onError func(error)
+}
+
+// WithAuditor sets the auditor of the mutating calls
+func WithAuditor(a Auditor) Option {
+	return func(o *options) {
+		o.auditor = a
+	}
+}
+
+// OnError sets the hook called with the errors New can not return: the ones of the named sets of the
+// config and the registry, which are skipped, and the ones restoring the sets
+func OnError(h func(error)) Option {
+	return func(o *options) {
+		o.onError = h
+	}
+}
+
+type credential struct {
+	id          string
+	hash        [sha256.Size]byte
+	permissions map[string]bool
+}
+
+// authenticator matches the tokens with the credentials, comparing their hashes in constant time
+type authenticator struct {
+	credentials []credential
+}
+
+func newAuthenticator(cfg *AuthConfig) *authenticator {
+	if cfg == nil {
+		return nil
+	}
+	a := &authenticator{credentials: make([]credential, len(cfg.Credentials))}
+	for i, c := range cfg.Credentials {
+		a.credentials[i] = credential{
+			id:          c.ID,
+			hash:        sha256.Sum256([]byte(c.Token)),
+			permissions: map[string]bool{},
+		}
+		for _, p := range c.Permissions {
+			a.credentials[i].permissions[p] = true
+		}
+	}
+	return a
+}
+
+// authorize returns the ID of the credential of the token when it is granted the permission. Every call
+// is allowed when there is no authenticator
+func (a *authenticator) authorize(token, permission string) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	var found *credential
+	for i := range a.credentials {
+		if subtle.ConstantTimeCompare(hash[:], a.credentials[i].hash[:]) == 1 {
+			found = &a.credentials[i]
+		}
+	}
+	if found == nil {
+		return "", ErrUnauthorized
+	}
+	if !found.permissions[permission] && !found.permissions[PermissionAdmin] {
+		return found.id, fmt.Errorf("%w: %s requires %s", ErrForbidden, found.id, permission)
+	}
+	return found.id, nil
+}
@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2/rotate"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+const (
+	checkToken = "check-token-0123456789"
+	addToken   = "add-token-0123456789"
+	adminToken = "admin-token-0123456789"
+)
+
+var testAuth = &AuthConfig{
+	Credentials: []Credential{
+		{ID: "gateway", Token: checkToken, Permissions: []string{PermissionCheck}},
+		{ID: "revoker", Token: addToken, Permissions: []string{PermissionCheck, PermissionAdd}},
+		{ID: "operator", Token: adminToken, Permissions: []string{PermissionAdmin}},
+	},
+}
+
+func TestAuthConfig_Validate(t *testing.T) {
+	if err := testAuth.Validate(); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	for name, cfg := range map[string]AuthConfig{
+		"empty":      {},
+		"no id":      {Credentials: []Credential{{Token: checkToken}}},
+		"short":      {Credentials: []Credential{{ID: "a", Token: "short"}}},
+		"repeated":   {Credentials: []Credential{{ID: "a", Token: checkToken}, {ID: "b", Token: checkToken}}},
+		"same id":    {Credentials: []Credential{{ID: "a", Token: checkToken}, {ID: "a", Token: addToken}}},
+		"permission": {Credentials: []Credential{{ID: "a", Token: checkToken, Permissions: []string{"write"}}}},
+	} {
+		if err := cfg.Validate(); !errors.Is(err, ErrInvalidCredential) && !errors.Is(err, ErrNoCredentials) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	cfg := Config{
+		Config: rotate.Config{Config: testutils.TestCfg, TTL: 5},
+		Auth:   &AuthConfig{},
+	}
+	if err := cfg.Validate(); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBF_auth(t *testing.T) {
+	var entries []AuditEntry
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Port: 1234,
+		Auth: testAuth,
+	}, WithAuditor(func(e AuditEntry) { entries = append(entries, e) }))
+	defer b.Close()
+
+	var (
+		addOutput    AddOutput
+		checkOutput  CheckOutput
+		createOutput CreateOutput
+		listOutput   ListOutput
+		elems1       = [][]byte{[]byte("elem1"), []byte("elem2")}
+	)
+
+	if err := b.Add(AddInput{Elems: elems1}, &addOutput); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := b.Add(AddInput{Elems: elems1, Token: "unknown-token-0123456789"}, &addOutput); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := b.Add(AddInput{Elems: elems1, Token: checkToken}, &addOutput); !errors.Is(err, ErrForbidden) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := b.Add(AddInput{Elems: elems1, Token: addToken}, &addOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	if err := b.Check(CheckInput{Elems: elems1}, &checkOutput); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := b.Check(CheckInput{Elems: elems1, Token: checkToken}, &checkOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if !checkOutput.Checks[0] || !checkOutput.Checks[1] {
+		t.Errorf("unexpected checks: %v", checkOutput.Checks)
+	}
+
+	cfg := rotate.Config{Config: testutils.TestCfg, TTL: 5}
+	if err := b.Create(CreateInput{Name: "tenant", Config: cfg, Token: addToken}, &createOutput); !errors.Is(err, ErrForbidden) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := b.Create(CreateInput{Name: "tenant", Config: cfg, Token: adminToken}, &createOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if err := b.List(ListInput{Token: adminToken}, &listOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	if _, err := b.Authorize(checkToken, PermissionUnion); !errors.Is(err, ErrForbidden) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if caller, err := b.Authorize(adminToken, PermissionUnion); err != nil || caller != "operator" {
+		t.Errorf("unexpected authorization: %s, %v", caller, err)
+	}
+
+	expected := []struct {
+		caller, method string
+		err            error
+	}{
+		{"", "Add", ErrUnauthorized},
+		{"", "Add", ErrUnauthorized},
+		{"gateway", "Add", ErrForbidden},
+		{"revoker", "Add", nil},
+		{"revoker", "Create", ErrForbidden},
+		{"operator", "Create", nil},
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("unexpected audit entries: %+v", entries)
+		return
+	}
+	for i, e := range expected {
+		if entries[i].Caller != e.caller || entries[i].Method != e.method || !errors.Is(entries[i].Err, e.err) {
+			t.Errorf("unexpected audit entry #%d: %+v", i, entries[i])
+		}
+	}
+	if entries[3].Filter != DefaultFilter || entries[3].Count != 2 {
+		t.Errorf("unexpected audit entry: %+v", entries[3])
+	}
+	if entries[5].Filter != "tenant" {
+		t.Errorf("unexpected audit entry: %+v", entries[5])
+	}
+}
+
+func TestBF_noAuth(t *testing.T) {
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Port: 1234,
+	})
+	defer b.Close()
+
+	var addOutput AddOutput
+	if err := b.Add(AddInput{Elems: [][]byte{[]byte("elem1")}, Token: "whatever"}, &addOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if b.set.auditor != nil {
+		t.Error("the calls are audited without auth")
+	}
+}
+
+func TestLogAuditor(t *testing.T) {
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	LogAuditor(AuditEntry{Method: "Add", Filter: DefaultFilter, Count: 2, Err: ErrUnauthorized})
+	if !strings.Contains(buf.String(), `caller=anonymous method=Add filter=default count=2 error="unauthorized"`) {
+		t.Errorf("unexpected log: %s", buf.String())
+	}
+}
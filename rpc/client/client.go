@@ -1,44 +1,124 @@
-// Package client implements an rpc client for the bloomfilter, along with Add and Check methods.
+// Package client implements an rpc client for the bloomfilter, along with Add and Check methods and the
+// management of the named sliding bloomfilter sets of the server.
 package client
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/rpc"
+	"net/rpc/jsonrpc"
 
 	"github.com/krakendio/bloomfilter/v2/rotate"
 	rpc_bf "github.com/krakendio/bloomfilter/v2/rpc"
 )
 
-// Bloomfilter rpc client type
+// Bloomfilter rpc client type, bound to a sliding bloomfilter set of the server
 type Bloomfilter struct {
 	client *rpc.Client
+	name   string
+	codec  string
+	token  string
 }
 
-// New creates a new bloomfilter rpc client with address
-func New(address string) (*Bloomfilter, error) {
-	client, err := rpc.Dial("tcp", address)
+// Option customizes the rpc client
+type Option func(*options)
+
+type options struct {
+	codec string
+	tls   *tls.Config
+	token string
+	err   error
+}
+
+// WithCodec sets the codec of the connection: rpc_bf.CodecGob, the default one, or rpc_bf.CodecJSONRPC
+func WithCodec(codec string) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithTLS secures the connection with the TLS config
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg
+	}
+}
+
+// WithTLSFiles secures the connection with the certs and the settings of the config. The errors loading
+// them are returned by New
+func WithTLSFiles(cfg rpc_bf.ClientTLSConfig) Option {
+	return func(o *options) {
+		o.tls, o.err = cfg.ClientConfig()
+	}
+}
+
+// WithToken sets the token sent along with every call, authorizing it when the server requires it
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// New creates a new bloomfilter rpc client with address, bound to the default sliding bloomfilter set
+func New(address string, opts ...Option) (*Bloomfilter, error) {
+	o := options{codec: rpc_bf.CodecGob}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	var newClient func(io.ReadWriteCloser) *rpc.Client
+	switch o.codec {
+	case "", rpc_bf.CodecGob:
+		newClient = rpc.NewClient
+	case rpc_bf.CodecJSONRPC:
+		newClient = jsonrpc.NewClient
+	default:
+		return nil, fmt.Errorf("%w: %s", rpc_bf.ErrUnknownCodec, o.codec)
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if o.tls != nil {
+		conn, err = tls.Dial("tcp", address, o.tls)
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &Bloomfilter{client}, nil
+	return &Bloomfilter{client: newClient(conn), codec: o.codec, token: o.token}, nil
+}
+
+// Named returns a client bound to the named sliding bloomfilter set, sharing the connection, so closing
+// any of them closes both
+func (b *Bloomfilter) Named(name string) *Bloomfilter {
+	return &Bloomfilter{client: b.client, name: name, codec: b.codec, token: b.token}
 }
 
 // Add element through bloomfilter rpc client
 func (b *Bloomfilter) Add(elem []byte) error {
 	var addOutput rpc_bf.AddOutput
-	return b.client.Call("BloomfilterRPC.Add", rpc_bf.AddInput{Elems: [][]byte{elem}}, &addOutput)
+	return b.client.Call("BloomfilterRPC.Add", rpc_bf.AddInput{Elems: [][]byte{elem}, Name: b.name, Token: b.token}, &addOutput)
 }
 
 // AddBatch adds a set of elements through bloomfilter rpc client
 func (b *Bloomfilter) AddBatch(batch [][]byte) error {
 	var addOutput rpc_bf.AddOutput
-	return b.client.Call("BloomfilterRPC.Add", rpc_bf.AddInput{Elems: batch}, &addOutput)
+	return b.client.Call("BloomfilterRPC.Add", rpc_bf.AddInput{Elems: batch, Name: b.name, Token: b.token}, &addOutput)
 }
 
 // Check present element through bloomfilter rpc client
 func (b *Bloomfilter) Check(elem []byte) (bool, error) {
 	var checkOutput rpc_bf.CheckOutput
-	if err := b.client.Call("BloomfilterRPC.Check", rpc_bf.CheckInput{Elems: [][]byte{elem}}, &checkOutput); err != nil {
+	if err := b.client.Call("BloomfilterRPC.Check", rpc_bf.CheckInput{Elems: [][]byte{elem}, Name: b.name, Token: b.token}, &checkOutput); err != nil {
 		return false, err
 	}
 	for _, v := range checkOutput.Checks {
@@ -55,14 +135,43 @@ func (b *Bloomfilter) Union(that interface{}) (float64, error) {
 	if !ok {
 		return -1.0, errors.New("invalide argument to Union, expected rotate.Bloomfilter")
 	}
+	in := rpc_bf.UnionInput{BF: v, Name: b.name, Token: b.token}
+	if b.codec == rpc_bf.CodecJSONRPC {
+		snapshot, err := v.MarshalBinary()
+		if err != nil {
+			return -1.0, err
+		}
+		in = rpc_bf.UnionInput{Name: b.name, Snapshot: snapshot, Token: b.token}
+	}
 	var unionOutput rpc_bf.UnionOutput
-	if err := b.client.Call("BloomfilterRPC.Union", rpc_bf.UnionInput{BF: v}, &unionOutput); err != nil {
+	if err := b.client.Call("BloomfilterRPC.Union", in, &unionOutput); err != nil {
 		return -1.0, err
 	}
 
 	return unionOutput.Capacity, nil
 }
 
+// Create a named sliding bloomfilter set in the server
+func (b *Bloomfilter) Create(name string, cfg rotate.Config) error {
+	var createOutput rpc_bf.CreateOutput
+	return b.client.Call("BloomfilterRPC.Create", rpc_bf.CreateInput{Name: name, Config: cfg, Token: b.token}, &createOutput)
+}
+
+// Drop a named sliding bloomfilter set of the server
+func (b *Bloomfilter) Drop(name string) error {
+	var dropOutput rpc_bf.DropOutput
+	return b.client.Call("BloomfilterRPC.Drop", rpc_bf.DropInput{Name: name, Token: b.token}, &dropOutput)
+}
+
+// List the names of the sliding bloomfilter sets of the server starting with the prefix
+func (b *Bloomfilter) List(prefix string) ([]string, error) {
+	var listOutput rpc_bf.ListOutput
+	if err := b.client.Call("BloomfilterRPC.List", rpc_bf.ListInput{Prefix: prefix, Token: b.token}, &listOutput); err != nil {
+		return nil, err
+	}
+	return listOutput.Names, nil
+}
+
 // Close bloomfilter rpc client
 func (b *Bloomfilter) Close() {
 	b.client.Close()
@@ -35,13 +35,13 @@ func Example_integration() {
 		}
 	)
 
-	err = client.Call("BloomfilterRPC.Add", AddInput{elems1}, &addOutput)
+	err = client.Call("BloomfilterRPC.Add", AddInput{Elems: elems1}, &addOutput)
 	if err != nil {
 		fmt.Printf("unexpected error: %s", err.Error())
 		return
 	}
 
-	err = client.Call("BloomfilterRPC.Check", CheckInput{elems1}, &checkOutput)
+	err = client.Call("BloomfilterRPC.Check", CheckInput{Elems: elems1}, &checkOutput)
 	if err != nil {
 		fmt.Printf("unexpected error: %s", err.Error())
 		return
@@ -62,14 +62,14 @@ func Example_integration() {
 	var bf2 = rotate.New(context.Background(), cfg)
 	bf2.Add([]byte("house"))
 
-	err = client.Call("BloomfilterRPC.Union", UnionInput{bf2}, &unionOutput)
+	err = client.Call("BloomfilterRPC.Union", UnionInput{BF: bf2}, &unionOutput)
 	if err != nil {
 		fmt.Printf("unexpected error: %s", err.Error())
 		return
 	}
 	fmt.Println(unionOutput.Capacity < 1e-6)
 
-	err = client.Call("BloomfilterRPC.Check", CheckInput{elems2}, &checkOutput)
+	err = client.Call("BloomfilterRPC.Check", CheckInput{Elems: elems2}, &checkOutput)
 	if err != nil {
 		fmt.Printf("unexpected error: %s", err.Error())
 		return
@@ -83,10 +83,10 @@ func Example_integration() {
 	var bf3 = rotate.New(context.Background(), cfg)
 	bf3.Add([]byte("mouse"))
 
-	divCall = client.Go("BloomfilterRPC.Union", UnionInput{bf3}, &unionOutput, nil)
+	divCall = client.Go("BloomfilterRPC.Union", UnionInput{BF: bf3}, &unionOutput, nil)
 	<-divCall.Done
 
-	err = client.Call("BloomfilterRPC.Check", CheckInput{elems3}, &checkOutput)
+	err = client.Call("BloomfilterRPC.Check", CheckInput{Elems: elems3}, &checkOutput)
 	if err != nil {
 		fmt.Printf("unexpected error: %s", err.Error())
 		return
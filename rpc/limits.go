@@ -0,0 +1,64 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/krakendio/bloomfilter/v2"
+	"github.com/krakendio/bloomfilter/v2/rotate"
+)
+
+// LimitsConfig bounds the configs of the sliding bloomfilter sets created at runtime, as they come from
+// the callers: MaxN is the max number of elements, MaxTTL the max TTL in seconds and MaxSize the max size in
+// bytes of the bit array of each bloomfilter of the set. The zero values select the defaults
+type LimitsConfig struct {
+	MaxN    uint `json:"max_n,omitempty"`
+	MaxTTL  uint `json:"max_ttl,omitempty"`
+	MaxSize uint `json:"max_size,omitempty"`
+}
+
+const (
+	// DefaultMaxN is the max number of elements of a created set when the limits do not define it
+	DefaultMaxN = 10000000
+	// DefaultMaxTTL is the max TTL in seconds of a created set when the limits do not define it
+	DefaultMaxTTL = 7 * 24 * 3600
+	// DefaultMaxSize is the max size in bytes of the bit arrays of a created set when the limits do not
+	// define it
+	DefaultMaxSize = 64 << 20
+)
+
+// ErrLimitExceeded is returned when creating a sliding bloomfilter set exceeding the limits of the config
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+func (l LimitsConfig) withDefaults() LimitsConfig {
+	if l.MaxN == 0 {
+		l.MaxN = DefaultMaxN
+	}
+	if l.MaxTTL == 0 {
+		l.MaxTTL = DefaultMaxTTL
+	}
+	if l.MaxSize == 0 {
+		l.MaxSize = DefaultMaxSize
+	}
+	return l
+}
+
+// check returns an error when the config of a created set exceeds the limits. The config must be valid
+func (l LimitsConfig) check(cfg rotate.Config) error {
+	l = l.withDefaults()
+	if cfg.N > l.MaxN {
+		return fmt.Errorf("%w: n (%d) above %d", ErrLimitExceeded, cfg.N, l.MaxN)
+	}
+	ttl := time.Duration(cfg.TTL) * time.Second
+	if cfg.TTLDuration > 0 {
+		ttl = cfg.TTLDuration
+	}
+	if maxTTL := time.Duration(l.MaxTTL) * time.Second; ttl > maxTTL {
+		return fmt.Errorf("%w: ttl (%s) above %s", ErrLimitExceeded, ttl, maxTTL)
+	}
+	if size := bloomfilter.M(cfg.N, cfg.P) / 8; size > l.MaxSize {
+		return fmt.Errorf("%w: size (%d bytes) above %d bytes", ErrLimitExceeded, size, l.MaxSize)
+	}
+	return nil
+}
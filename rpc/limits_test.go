@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krakendio/bloomfilter/v2"
+	"github.com/krakendio/bloomfilter/v2/rotate"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestBFCreate_limits(t *testing.T) {
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Port:   1234,
+		Limits: LimitsConfig{MaxN: 1000, MaxTTL: 60, MaxSize: 4096},
+	})
+	defer b.Close()
+
+	var createOutput CreateOutput
+	for name, cfg := range map[string]rotate.Config{
+		"n":            {Config: bloomfilter.Config{N: 1001, P: 0.01, HashName: "optimal"}, TTL: 5},
+		"ttl":          {Config: testutils.TestCfg, TTL: 61},
+		"ttl duration": {Config: testutils.TestCfg, TTL: 5, TTLDuration: 2 * time.Minute},
+		"size":         {Config: bloomfilter.Config{N: 1000, P: 1e-30, HashName: "optimal"}, TTL: 5},
+	} {
+		if err := b.Create(CreateInput{Name: "tenant", Config: cfg}, &createOutput); !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	if err := b.Create(CreateInput{Name: "tenant", Config: rotate.Config{Config: testutils.TestCfg, TTL: 60}}, &createOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestNew_invalidFilterNames(t *testing.T) {
+	dir := t.TempDir()
+	var reported []error
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config:     testutils.TestCfg,
+			TTL:        5,
+			Checkpoint: rotate.CheckpointConfig{Dir: filepath.Join(dir, "checkpoints")},
+		},
+		Port: 1234,
+		Filters: map[string]rotate.Config{
+			"../../escape": {Config: testutils.TestCfg, TTL: 5},
+			"tenant":       {Config: testutils.TestCfg, TTL: 5},
+		},
+	}, OnError(func(err error) { reported = append(reported, err) }))
+	b.Close()
+
+	if len(reported) != 1 || !errors.Is(reported[0], ErrInvalidFilterName) {
+		t.Errorf("unexpected reported errors: %v", reported)
+	}
+
+	if _, err := b.Filter("../../escape"); !errors.Is(err, ErrFilterNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := b.Filter("tenant"); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+		t.Errorf("the filter was written out of the checkpoint dir: %v", err)
+	}
+}
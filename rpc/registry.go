@@ -0,0 +1,100 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/krakendio/bloomfilter/v2/rotate"
+)
+
+// registryFile records the configs of the sliding bloomfilter sets created at runtime, so they are rebuilt
+// at startup. It is kept in the filters dir of the checkpoints of the default set, the names of the sets
+// having no dots
+const registryFile = "registry.json"
+
+// registryPath returns the path of the registry, empty when the default set has no checkpoint dir
+func (s *filterSet) registryPath() string {
+	if s.cfg.Checkpoint.Dir == "" {
+		return ""
+	}
+	return filepath.Join(s.cfg.Checkpoint.Dir, "filters", registryFile)
+}
+
+// loadRegistry rebuilds the sets created at runtime, unless the config declares a set with the same name.
+// The registry is only read at startup, so the errors are reported to the OnError hook
+func (s *filterSet) loadRegistry() {
+	path := s.registryPath()
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.failed(fmt.Errorf("unable to read the registry of the filters: %w", err))
+		}
+		return
+	}
+	var created map[string]rotate.Config
+	if err := json.Unmarshal(data, &created); err != nil {
+		s.failed(fmt.Errorf("unable to decode the registry of the filters: %w", err))
+		return
+	}
+
+	for name, cfg := range created {
+		if _, ok := s.filters[name]; ok {
+			continue
+		}
+		if err := validName(name); err != nil {
+			s.failed(fmt.Errorf("unable to restore a filter of the registry: %w", err))
+			continue
+		}
+		if err := cfg.Validate(); err != nil {
+			s.failed(fmt.Errorf("unable to restore the filter %s of the registry: %w", name, err))
+			continue
+		}
+		if err := s.limits.check(cfg); err != nil {
+			s.failed(fmt.Errorf("unable to restore the filter %s of the registry: %w", name, err))
+			continue
+		}
+		s.filters[name] = s.restore(name, s.local(name, cfg))
+		s.created[name] = cfg
+	}
+}
+
+// saveRegistry replaces the registry with the configs of the sets created at runtime. The caller must hold
+// the lock
+func (s *filterSet) saveRegistry() error {
+	path := s.registryPath()
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.created)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+registryFile+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,142 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2/rotate"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		Config: rotate.Config{
+			Config:     testutils.TestCfg,
+			TTL:        5,
+			Checkpoint: rotate.CheckpointConfig{Dir: dir},
+		},
+		Port: 1234,
+	}
+	b := New(context.Background(), cfg)
+
+	var (
+		createOutput CreateOutput
+		dropOutput   DropOutput
+		addOutput    AddOutput
+		checkOutput  CheckOutput
+		elems        = [][]byte{[]byte("elem1")}
+	)
+	for _, name := range []string{"tenant-1", "tenant-2"} {
+		if err := b.Create(CreateInput{Name: name, Config: rotate.Config{Config: testutils.TestCfg, TTL: 10}}, &createOutput); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+	}
+	if err := b.Add(AddInput{Elems: elems, Name: "tenant-1"}, &addOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if err := b.Drop(DropInput{Name: "tenant-2"}, &dropOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	b.Close()
+
+	b = New(context.Background(), cfg)
+	defer b.Close()
+
+	bf, err := b.Filter("tenant-1")
+	if err != nil {
+		t.Errorf("the created filter was not restored: %v", err)
+		return
+	}
+	if bf.Config.TTL != 10 || bf.Config.Checkpoint.Dir != filepath.Join(dir, "filters", "tenant-1") {
+		t.Errorf("unexpected config of the restored filter: %+v", bf.Config)
+	}
+	if err := b.Check(CheckInput{Elems: elems, Name: "tenant-1"}, &checkOutput); err != nil || !checkOutput.Checks[0] {
+		t.Errorf("the elements of the restored filter were lost: %v", err)
+	}
+	if _, err := b.Filter("tenant-2"); !errors.Is(err, ErrFilterNotFound) {
+		t.Errorf("the dropped filter was restored: %v", err)
+	}
+}
+
+func TestRegistry_corrupted(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "filters"), 0o700); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	registry := `{"../escape": {"n": 100, "p": 0.01, "hash_name": "optimal", "ttl": 5}, "no-ttl": {"n": 100, "p": 0.01, "hash_name": "optimal"}, "huge": {"n": 100000000000, "p": 0.01, "hash_name": "optimal", "ttl": 5}}`
+	if err := os.WriteFile(filepath.Join(dir, "filters", registryFile), []byte(registry), 0o600); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	var reported []error
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config:     testutils.TestCfg,
+			TTL:        5,
+			Checkpoint: rotate.CheckpointConfig{Dir: dir},
+		},
+		Port: 1234,
+	}, OnError(func(err error) { reported = append(reported, err) }))
+	defer b.Close()
+
+	if len(reported) != 3 {
+		t.Errorf("unexpected reported errors: %v", reported)
+	}
+	var listOutput ListOutput
+	if err := b.List(ListInput{}, &listOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if len(listOutput.Names) != 1 || listOutput.Names[0] != DefaultFilter {
+		t.Errorf("unexpected filters: %v", listOutput.Names)
+	}
+}
+
+func TestBFCreate_concurrent(t *testing.T) {
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config:     testutils.TestCfg,
+			TTL:        5,
+			Checkpoint: rotate.CheckpointConfig{Dir: t.TempDir()},
+		},
+		Port: 1234,
+	})
+	defer b.Close()
+
+	const creators = 8
+	errs := make(chan error, creators)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < creators; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out CreateOutput
+			errs <- b.Create(CreateInput{Name: "tenant", Config: rotate.Config{Config: testutils.TestCfg, TTL: 5}}, &out)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrFilterExists):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("the filter was created %d times", created)
+	}
+}
@@ -1,41 +1,221 @@
 // Package rpc implements the rpc layer for the bloomfilter, following the principles from https://golang.org/pkg/net/rpc
+//
+// A single server hosts many named sliding bloomfilter sets, each one with its own config. The inputs not
+// naming any set target the default one, built with the main config.
 package rpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/krakendio/bloomfilter/v2"
 	"github.com/krakendio/bloomfilter/v2/rotate"
 )
 
-// Config type containing a sliding bloomfilter set and a port
+// DefaultFilter is the name of the sliding bloomfilter set built with the main config
+const DefaultFilter = "default"
+
+// The codecs of the rpc connections. CodecGob is the default one and CodecAuto, only available to servers,
+// detects the codec of every connection: the JSON-RPC ones start with '{'. The JSON-RPC callers encode
+// the []byte values, as the elements, as base64 strings with padding (RFC 4648, section 4)
+const (
+	CodecGob     = "gob"
+	CodecJSONRPC = "jsonrpc"
+	CodecAuto    = "auto"
+)
+
+// Config type containing a sliding bloomfilter set, a port and the codec of the rpc server. Filters are the
+// named sliding bloomfilter sets created along with the default one and Limits bound the ones created at
+// runtime. The connections are secured with TLS and the calls authorized with the credentials of Auth,
+// when set
 type Config struct {
 	rotate.Config
-	Port int `json:"port"`
+	Port    int                      `json:"port"`
+	Codec   string                   `json:"codec,omitempty"`
+	TLS     *TLSConfig               `json:"tls,omitempty"`
+	Auth    *AuthConfig              `json:"auth,omitempty"`
+	Filters map[string]rotate.Config `json:"filters,omitempty"`
+	Limits  LimitsConfig             `json:"limits,omitempty"`
+}
+
+// Validate checks the config of the default sliding bloomfilter set and the named ones
+func (c Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	switch c.Codec {
+	case "", CodecGob, CodecJSONRPC, CodecAuto:
+	default:
+		return &bloomfilter.ConfigError{Field: "codec", Err: fmt.Errorf("%w: %s", ErrUnknownCodec, c.Codec)}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.Validate(); err != nil {
+			return &bloomfilter.ConfigError{Field: "tls", Err: err}
+		}
+	}
+	if c.Auth != nil {
+		if err := c.Auth.Validate(); err != nil {
+			return &bloomfilter.ConfigError{Field: "auth", Err: err}
+		}
+	}
+	for name, cfg := range c.Filters {
+		if err := validName(name); err != nil {
+			return &bloomfilter.ConfigError{Field: "filters", Err: err}
+		}
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("filter %s: %w", name, err)
+		}
+	}
+	return nil
 }
 
 // BloomfilterRPC type
-type BloomfilterRPC int
+type BloomfilterRPC struct {
+	set *filterSet
+}
 
 // Bloomfilter wrapper for BloomfilterRPC type
 type Bloomfilter struct {
 	BloomfilterRPC
 }
 
-// New rpc layer implementation of creating a sliding bloomfilter set
-func New(ctx context.Context, cfg Config) *Bloomfilter {
-	if bf != nil {
-		bf.Close()
+type filterSet struct {
+	ctx      context.Context
+	cfg      rotate.Config
+	mutex    *sync.RWMutex
+	filters  map[string]*rotate.Bloomfilter
+	limits   LimitsConfig
+	created  map[string]rotate.Config
+	creating map[string]bool
+	auth     *authenticator
+	auditor  Auditor
+	onError  func(error)
+}
+
+// New rpc layer implementation of creating the default sliding bloomfilter set and the named ones, along
+// with the ones created at runtime before the last shutdown. The mutating calls are audited with the
+// auditor option and the errors restoring the sets are reported to the OnError hook
+func New(ctx context.Context, cfg Config, opts ...Option) *Bloomfilter {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	bf = rotate.New(ctx, cfg.Config)
+	set := &filterSet{
+		ctx:      ctx,
+		cfg:      cfg.Config,
+		mutex:    new(sync.RWMutex),
+		filters:  map[string]*rotate.Bloomfilter{},
+		limits:   cfg.Limits,
+		created:  map[string]rotate.Config{},
+		creating: map[string]bool{},
+		auth:     newAuthenticator(cfg.Auth),
+		auditor:  o.auditor,
+		onError:  o.onError,
+	}
+	set.filters[DefaultFilter] = set.restore(DefaultFilter, cfg.Config)
+	for name, c := range cfg.Filters {
+		if err := validName(name); err != nil {
+			set.failed(fmt.Errorf("unable to create a filter of the config: %w", err))
+			continue
+		}
+		set.filters[name] = set.restore(name, set.local(name, c))
+	}
+	set.loadRegistry()
+
+	return &Bloomfilter{BloomfilterRPC{set}}
+}
+
+var filterName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+func validName(name string) error {
+	if !filterName.MatchString(name) || name == DefaultFilter {
+		return fmt.Errorf("%w: %q", ErrInvalidFilterName, name)
+	}
+	return nil
+}
 
-	return new(Bloomfilter)
+// restore creates a sliding bloomfilter set, reporting the errors restoring it
+func (s *filterSet) restore(name string, cfg rotate.Config) *rotate.Bloomfilter {
+	return rotate.New(s.ctx, cfg, rotate.OnError(func(err error) {
+		s.failed(fmt.Errorf("unable to restore the filter %s: %w", name, err))
+	}))
 }
 
-// AddInput type for an array of elements
+// failed reports an error New can not return
+func (s *filterSet) failed(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// local replaces the checkpoint and write-ahead log dirs of a named set with the ones of the default set,
+// so the clients creating sets can not write out of them
+func (s *filterSet) local(name string, cfg rotate.Config) rotate.Config {
+	cfg.Checkpoint = s.cfg.Checkpoint
+	if cfg.Checkpoint.Dir != "" {
+		cfg.Checkpoint.Dir = filepath.Join(cfg.Checkpoint.Dir, "filters", name)
+	}
+	cfg.WAL = s.cfg.WAL
+	if cfg.WAL.Dir != "" {
+		cfg.WAL.Dir = filepath.Join(cfg.WAL.Dir, "filters", name)
+	}
+	return cfg
+}
+
+// get returns the named sliding bloomfilter set, the default one when the name is empty
+func (r *BloomfilterRPC) get(name string) (*rotate.Bloomfilter, error) {
+	if r.set == nil {
+		return nil, ErrNoBloomfilterInitialized
+	}
+
+	r.set.mutex.RLock()
+	defer r.set.mutex.RUnlock()
+
+	bf, ok := r.set.filters[orDefault(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFilterNotFound, orDefault(name))
+	}
+	return bf, nil
+}
+
+func orDefault(name string) string {
+	if name == "" {
+		return DefaultFilter
+	}
+	return name
+}
+
+// authorize returns the ID of the credential of the token when it is granted the permission
+func (r *BloomfilterRPC) authorize(token, permission string) (string, error) {
+	if r.set == nil {
+		return "", ErrNoBloomfilterInitialized
+	}
+	return r.set.auth.authorize(token, permission)
+}
+
+// audit records a mutating call
+func (r *BloomfilterRPC) audit(e AuditEntry) {
+	if r.set == nil || r.set.auditor == nil {
+		return
+	}
+	e.Filter = orDefault(e.Filter)
+	r.set.auditor(e)
+}
+
+// AddInput type for an array of elements, the name of the sliding bloomfilter set and the token of the
+// caller. The JSON-RPC callers encode the elements as base64 strings
 type AddInput struct {
 	Elems [][]byte
+	Name  string
+	Token string
 }
 
 // AddOutput type for an array of elements to a sliding bloomfilter set
@@ -43,26 +223,36 @@ type AddOutput struct {
 	Count int
 }
 
-// Add rpc layer implementation of an array of elements to a sliding bloomfilter set
-func (BloomfilterRPC) Add(in AddInput, out *AddOutput) error {
-	if bf == nil {
+// Add rpc layer implementation of an array of elements to a sliding bloomfilter set. When the write-ahead
+// log is enabled, the elements are logged before being added and an error logging them is returned
+func (r *BloomfilterRPC) Add(in AddInput, out *AddOutput) (err error) {
+	caller, err := r.authorize(in.Token, PermissionAdd)
+	defer func() {
+		r.audit(AuditEntry{Caller: caller, Method: "Add", Filter: in.Name, Count: out.Count, Err: err})
+	}()
+	if err != nil {
 		out.Count = 0
-		return ErrNoBloomfilterInitialized
+		return err
 	}
 
-	k := 0
-	for _, elem := range in.Elems {
-		bf.Add(elem)
-		k++
+	bf, err := r.get(in.Name)
+	if err != nil {
+		out.Count = 0
+		return err
 	}
-	out.Count = k
 
-	return nil
+	err = bf.AddBatch(in.Elems)
+	out.Count = len(in.Elems)
+
+	return err
 }
 
-// CheckInput type for an array of elements
+// CheckInput type for an array of elements, the name of the sliding bloomfilter set and the token of the
+// caller
 type CheckInput struct {
 	Elems [][]byte
+	Name  string
+	Token string
 }
 
 // CheckOutput type for check result of an array of elements in a sliding bloomfilter set
@@ -71,12 +261,18 @@ type CheckOutput struct {
 }
 
 // Check rpc layer implementation of an array of elements in a sliding bloomfilter set
-func (BloomfilterRPC) Check(in CheckInput, out *CheckOutput) error {
+func (r *BloomfilterRPC) Check(in CheckInput, out *CheckOutput) error {
 	checkRes := make([]bool, len(in.Elems))
 
-	if bf == nil {
+	if _, err := r.authorize(in.Token, PermissionCheck); err != nil {
 		out.Checks = checkRes
-		return ErrNoBloomfilterInitialized
+		return err
+	}
+
+	bf, err := r.get(in.Name)
+	if err != nil {
+		out.Checks = checkRes
+		return err
 	}
 
 	for i, elem := range in.Elems {
@@ -87,9 +283,14 @@ func (BloomfilterRPC) Check(in CheckInput, out *CheckOutput) error {
 	return nil
 }
 
-// UnionInput type for sliding bloomfilter set
+// UnionInput type for sliding bloomfilter set, the name of the one to merge it into and the token of the
+// caller. The JSON-RPC callers, unable to encode the set, send its Snapshot instead, as written by
+// rotate.Bloomfilter.WriteTo. The set is closed by Union, once merged
 type UnionInput struct {
-	BF *rotate.Bloomfilter
+	BF       *rotate.Bloomfilter
+	Name     string
+	Snapshot []byte
+	Token    string
 }
 
 // UnionOutput type for sliding bloomfilter set fill degree
@@ -98,32 +299,236 @@ type UnionOutput struct {
 }
 
 // Union rpc layer implementation of two sliding bloomfilter sets
-func (BloomfilterRPC) Union(in UnionInput, out *UnionOutput) error {
-	if bf == nil {
+func (r *BloomfilterRPC) Union(in UnionInput, out *UnionOutput) (err error) {
+	if in.BF != nil {
+		defer in.BF.Close()
+	}
+	caller, err := r.authorize(in.Token, PermissionUnion)
+	defer func() {
+		r.audit(AuditEntry{Caller: caller, Method: "Union", Filter: in.Name, Err: err})
+	}()
+	if err != nil {
 		out.Capacity = 0
-		return ErrNoBloomfilterInitialized
+		return err
 	}
 
-	var err error
-	out.Capacity, err = bf.Union(in.BF)
+	bf, err := r.get(in.Name)
+	if err != nil {
+		out.Capacity = 0
+		return err
+	}
+
+	other := in.BF
+	if other == nil {
+		other = new(rotate.Bloomfilter)
+		if err := other.UnmarshalBinary(in.Snapshot); err != nil {
+			out.Capacity = 0
+			return err
+		}
+		defer other.Close()
+	}
+
+	out.Capacity, err = bf.Union(other)
 
 	return err
 }
 
-// Close sliding bloomfilter set
-func (Bloomfilter) Close() {
-	if bf != nil {
+// CreateInput type for the name and the config of a new sliding bloomfilter set and the token of the
+// caller. The checkpoint and write-ahead log dirs of the config are replaced by subdirs of the ones of the
+// default set, where the config is recorded to rebuild the set at startup
+type CreateInput struct {
+	Name   string
+	Config rotate.Config
+	Token  string
+}
+
+// CreateOutput type for the name of the created sliding bloomfilter set
+type CreateOutput struct {
+	Name string
+}
+
+// Create rpc layer implementation of a new named sliding bloomfilter set
+func (r *BloomfilterRPC) Create(in CreateInput, out *CreateOutput) (err error) {
+	caller, err := r.authorize(in.Token, PermissionAdmin)
+	defer func() {
+		r.audit(AuditEntry{Caller: caller, Method: "Create", Filter: in.Name, Err: err})
+	}()
+	if err != nil {
+		return err
+	}
+	if err := validName(in.Name); err != nil {
+		return err
+	}
+	if err := in.Config.Validate(); err != nil {
+		return err
+	}
+	if err := r.set.limits.check(in.Config); err != nil {
+		return err
+	}
+
+	// the name is reserved while the set is built, so the other calls are not blocked by its restore and
+	// a concurrent create of the same name fails instead of sharing its dirs
+	r.set.mutex.Lock()
+	if _, ok := r.set.filters[in.Name]; ok || r.set.creating[in.Name] {
+		r.set.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrFilterExists, in.Name)
+	}
+	r.set.creating[in.Name] = true
+	r.set.mutex.Unlock()
+
+	bf, err := rotate.Build(r.set.ctx, r.set.local(in.Name, in.Config))
+
+	r.set.mutex.Lock()
+	defer r.set.mutex.Unlock()
+
+	delete(r.set.creating, in.Name)
+	if err != nil {
+		return err
+	}
+	r.set.created[in.Name] = in.Config
+	if err := r.set.saveRegistry(); err != nil {
+		delete(r.set.created, in.Name)
+		bf.Close()
+		return err
+	}
+	r.set.filters[in.Name] = bf
+	out.Name = in.Name
+
+	return nil
+}
+
+// DropInput type for the name of the sliding bloomfilter set to drop and the token of the caller
+type DropInput struct {
+	Name  string
+	Token string
+}
+
+// DropOutput type for the name of the dropped sliding bloomfilter set
+type DropOutput struct {
+	Name string
+}
+
+// Drop rpc layer implementation of closing a named sliding bloomfilter set and removing its checkpoints
+// and write-ahead log. The default set can not be dropped
+func (r *BloomfilterRPC) Drop(in DropInput, out *DropOutput) (err error) {
+	caller, err := r.authorize(in.Token, PermissionAdmin)
+	defer func() {
+		r.audit(AuditEntry{Caller: caller, Method: "Drop", Filter: in.Name, Err: err})
+	}()
+	if err != nil {
+		return err
+	}
+	if in.Name == "" || in.Name == DefaultFilter {
+		return ErrDropDefaultFilter
+	}
+
+	r.set.mutex.Lock()
+	bf, ok := r.set.filters[in.Name]
+	if !ok {
+		r.set.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrFilterNotFound, in.Name)
+	}
+	if cfg, created := r.set.created[in.Name]; created {
+		delete(r.set.created, in.Name)
+		if err := r.set.saveRegistry(); err != nil {
+			r.set.created[in.Name] = cfg
+			r.set.mutex.Unlock()
+			return err
+		}
+	}
+	delete(r.set.filters, in.Name)
+	r.set.mutex.Unlock()
+
+	// Close waits for the goroutines of the set, so no checkpoint is written once its dirs are removed
+	bf.Close()
+	for _, dir := range []string{bf.Config.Checkpoint.Dir, bf.Config.WAL.Dir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	out.Name = in.Name
+
+	return nil
+}
+
+// ListInput type for listing the sliding bloomfilter sets, with the token of the caller
+type ListInput struct {
+	Prefix string
+	Token  string
+}
+
+// ListOutput type for the sorted names of the sliding bloomfilter sets
+type ListOutput struct {
+	Names []string
+}
+
+// List rpc layer implementation of the names of the sliding bloomfilter sets starting with the prefix
+func (r *BloomfilterRPC) List(in ListInput, out *ListOutput) error {
+	if _, err := r.authorize(in.Token, PermissionCheck); err != nil {
+		return err
+	}
+
+	r.set.mutex.RLock()
+	names := make([]string, 0, len(r.set.filters))
+	for name := range r.set.filters {
+		if strings.HasPrefix(name, in.Prefix) {
+			names = append(names, name)
+		}
+	}
+	r.set.mutex.RUnlock()
+
+	sort.Strings(names)
+	out.Names = names
+
+	return nil
+}
+
+// Close all the sliding bloomfilter sets
+func (b Bloomfilter) Close() {
+	if b.set == nil {
+		return
+	}
+
+	b.set.mutex.RLock()
+	defer b.set.mutex.RUnlock()
+
+	for _, bf := range b.set.filters {
 		bf.Close()
 	}
 }
 
-// Bloomfilter getter
-func (Bloomfilter) Bloomfilter() *rotate.Bloomfilter {
+// Bloomfilter getter of the default sliding bloomfilter set
+func (b Bloomfilter) Bloomfilter() *rotate.Bloomfilter {
+	bf, _ := b.get(DefaultFilter)
 	return bf
 }
 
-// ErrNoBloomfilterInitialized error
+// Filter getter of a named sliding bloomfilter set
+func (b Bloomfilter) Filter(name string) (*rotate.Bloomfilter, error) {
+	return b.get(name)
+}
+
+// Authorize returns the ID of the credential of the token when it is granted the permission, so other
+// transports can apply the auth of the rpc layer. Every token is allowed when the auth is disabled
+func (b Bloomfilter) Authorize(token, permission string) (string, error) {
+	return b.authorize(token, permission)
+}
+
 var (
+	// ErrNoBloomfilterInitialized error
 	ErrNoBloomfilterInitialized = fmt.Errorf("Bloomfilter not initialized")
-	bf                          *rotate.Bloomfilter
+	// ErrFilterNotFound is returned when there is no sliding bloomfilter set with the given name
+	ErrFilterNotFound = errors.New("filter not found")
+	// ErrFilterExists is returned when creating a sliding bloomfilter set with the name of an existing one
+	ErrFilterExists = errors.New("filter already exists")
+	// ErrInvalidFilterName is returned when the name has other chars than letters, digits, '-' and '_',
+	// more than 64 of them or it is the one of the default filter
+	ErrInvalidFilterName = errors.New("invalid filter name")
+	// ErrDropDefaultFilter is returned when dropping the default sliding bloomfilter set
+	ErrDropDefaultFilter = errors.New("the default filter can not be dropped")
+	// ErrUnknownCodec is returned when the codec is not gob, jsonrpc nor auto
+	ErrUnknownCodec = errors.New("unknown rpc codec")
 )
@@ -2,6 +2,11 @@ package rpc
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/krakendio/bloomfilter/v2/rotate"
@@ -22,7 +27,7 @@ func TestBFAdd_ok(t *testing.T) {
 		elems1    = [][]byte{[]byte("elem1"), []byte("elem2")}
 	)
 
-	err := b.Add(AddInput{elems1}, &addOutput)
+	err := b.Add(AddInput{Elems: elems1}, &addOutput)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err.Error())
 		return
@@ -31,6 +36,43 @@ func TestBFAdd_ok(t *testing.T) {
 	b.Close()
 }
 
+func TestBFAdd_wal(t *testing.T) {
+	cfg := Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+			WAL:    rotate.WALConfig{Dir: t.TempDir(), Sync: rotate.WALSyncAlways},
+		},
+		Port: 1234,
+	}
+	b := New(context.Background(), cfg)
+
+	var (
+		addOutput   AddOutput
+		checkOutput CheckOutput
+		elems1      = [][]byte{[]byte("elem1"), []byte("elem2")}
+	)
+
+	if err := b.Add(AddInput{Elems: elems1}, &addOutput); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if addOutput.Count != 2 {
+		t.Errorf("unexpected count: %d", addOutput.Count)
+	}
+
+	b = New(context.Background(), cfg)
+	defer b.Close()
+
+	if err := b.Check(CheckInput{Elems: elems1}, &checkOutput); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if len(checkOutput.Checks) != 2 || !checkOutput.Checks[0] || !checkOutput.Checks[1] {
+		t.Errorf("the logged elements were not replayed: %v", checkOutput.Checks)
+	}
+}
+
 func TestBFCheck_ok(t *testing.T) {
 	b := New(context.Background(), Config{
 		Config: rotate.Config{
@@ -46,13 +88,13 @@ func TestBFCheck_ok(t *testing.T) {
 		elems1      = [][]byte{[]byte("elem1"), []byte("elem2")}
 	)
 
-	err := b.Add(AddInput{elems1}, &addOutput)
+	err := b.Add(AddInput{Elems: elems1}, &addOutput)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err.Error())
 		return
 	}
 
-	err = b.Check(CheckInput{elems1}, &checkOutput)
+	err = b.Check(CheckInput{Elems: elems1}, &checkOutput)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err.Error())
 		return
@@ -83,7 +125,7 @@ func TestBFUnion_ok(t *testing.T) {
 		elems3      = [][]byte{[]byte("house"), []byte("mouse")}
 	)
 
-	err := b.Add(AddInput{elems1}, &addOutput)
+	err := b.Add(AddInput{Elems: elems1}, &addOutput)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err.Error())
 		return
@@ -92,13 +134,13 @@ func TestBFUnion_ok(t *testing.T) {
 	var bf2 = rotate.New(context.Background(), rotate.Config{Config: testutils.TestCfg, TTL: 5})
 	bf2.Add([]byte("house"))
 
-	err = b.Union(UnionInput{bf2}, &unionOutput)
+	err = b.Union(UnionInput{BF: bf2}, &unionOutput)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err.Error())
 		return
 	}
 
-	err = b.Check(CheckInput{elems2}, &checkOutput)
+	err = b.Check(CheckInput{Elems: elems2}, &checkOutput)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err.Error())
 		return
@@ -111,9 +153,9 @@ func TestBFUnion_ok(t *testing.T) {
 	var bf3 = rotate.New(context.Background(), rotate.Config{Config: testutils.TestCfg, TTL: 5})
 	bf3.Add([]byte("mouse"))
 
-	b.Union(UnionInput{bf3}, &unionOutput)
+	b.Union(UnionInput{BF: bf3}, &unionOutput)
 
-	err = b.Check(CheckInput{elems3}, &checkOutput)
+	err = b.Check(CheckInput{Elems: elems3}, &checkOutput)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err.Error())
 		return
@@ -123,18 +165,17 @@ func TestBFUnion_ok(t *testing.T) {
 		return
 	}
 
-	bf.Close()
+	b.Close()
 }
 
 func TestBFAdd_ko(t *testing.T) {
 	b := new(Bloomfilter)
-	bf = nil
 	var (
 		addOutput AddOutput
 		elems1    = [][]byte{[]byte("elem1"), []byte("elem2")}
 	)
 
-	err := b.Add(AddInput{elems1}, &addOutput)
+	err := b.Add(AddInput{Elems: elems1}, &addOutput)
 	if err != ErrNoBloomfilterInitialized {
 		t.Error("error, should have been no bloomfilter initialized")
 	}
@@ -142,13 +183,12 @@ func TestBFAdd_ko(t *testing.T) {
 
 func TestBFCheck_ko(t *testing.T) {
 	b := new(Bloomfilter)
-	bf = nil
 	var (
 		checkOutput CheckOutput
 		elems1      = [][]byte{[]byte("elem1"), []byte("elem2")}
 	)
 
-	err := b.Check(CheckInput{elems1}, &checkOutput)
+	err := b.Check(CheckInput{Elems: elems1}, &checkOutput)
 	if err != ErrNoBloomfilterInitialized {
 		t.Error("error, should have been no bloomfilter initialized")
 	}
@@ -156,7 +196,6 @@ func TestBFCheck_ko(t *testing.T) {
 
 func TestBFUnion_ko(t *testing.T) {
 	b := new(Bloomfilter)
-	bf = nil
 	var (
 		unionOutput UnionOutput
 	)
@@ -164,8 +203,223 @@ func TestBFUnion_ko(t *testing.T) {
 	var bf2 = rotate.New(context.Background(), rotate.Config{Config: testutils.TestCfg, TTL: 5})
 	bf2.Add([]byte("house"))
 
-	err := b.Union(UnionInput{bf2}, &unionOutput)
+	err := b.Union(UnionInput{BF: bf2}, &unionOutput)
 	if err != ErrNoBloomfilterInitialized {
 		t.Error("error, should have been no bloomfilter initialized")
 	}
 }
+
+func TestBFCreate_ok(t *testing.T) {
+	dir := t.TempDir()
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config:     testutils.TestCfg,
+			TTL:        5,
+			Checkpoint: rotate.CheckpointConfig{Dir: dir},
+		},
+		Port: 1234,
+	})
+	defer b.Close()
+
+	var (
+		createOutput CreateOutput
+		addOutput    AddOutput
+		checkOutput  CheckOutput
+		elems1       = [][]byte{[]byte("elem1"), []byte("elem2")}
+	)
+
+	cfg := rotate.Config{
+		Config:     testutils.TestCfg,
+		TTL:        5,
+		Checkpoint: rotate.CheckpointConfig{Dir: "/somewhere/else"},
+	}
+	if err := b.Create(CreateInput{Name: "tenant-1", Config: cfg}, &createOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if createOutput.Name != "tenant-1" {
+		t.Errorf("unexpected name: %s", createOutput.Name)
+	}
+
+	bf, err := b.Filter("tenant-1")
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if bf.Config.Checkpoint.Dir != filepath.Join(dir, "filters", "tenant-1") {
+		t.Errorf("unexpected checkpoint dir: %s", bf.Config.Checkpoint.Dir)
+	}
+
+	if err := b.Add(AddInput{Elems: elems1, Name: "tenant-1"}, &addOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	if err := b.Check(CheckInput{Elems: elems1, Name: "tenant-1"}, &checkOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !checkOutput.Checks[0] || !checkOutput.Checks[1] {
+		t.Errorf("the elements were not added to the named filter: %v", checkOutput.Checks)
+	}
+
+	if err := b.Check(CheckInput{Elems: elems1}, &checkOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if checkOutput.Checks[0] || checkOutput.Checks[1] {
+		t.Errorf("the elements were added to the default filter: %v", checkOutput.Checks)
+	}
+
+	if err := b.Create(CreateInput{Name: "tenant-1", Config: cfg}, &createOutput); !errors.Is(err, ErrFilterExists) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBFCreate_invalid(t *testing.T) {
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Port: 1234,
+	})
+	defer b.Close()
+
+	var createOutput CreateOutput
+	cfg := rotate.Config{Config: testutils.TestCfg, TTL: 5}
+
+	for _, name := range []string{"", DefaultFilter, "../tenant", "tenant 1", strings.Repeat("a", 65)} {
+		if err := b.Create(CreateInput{Name: name, Config: cfg}, &createOutput); !errors.Is(err, ErrInvalidFilterName) {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+
+	if err := b.Create(CreateInput{Name: "tenant", Config: rotate.Config{Config: testutils.TestCfg}}, &createOutput); !errors.Is(err, rotate.ErrInvalidTTL) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBFDrop(t *testing.T) {
+	dir := t.TempDir()
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config:     testutils.TestCfg,
+			TTL:        5,
+			Checkpoint: rotate.CheckpointConfig{Dir: dir},
+		},
+		Port: 1234,
+		Filters: map[string]rotate.Config{
+			"tenant": {Config: testutils.TestCfg, TTL: 5},
+		},
+	})
+	defer b.Close()
+
+	var (
+		dropOutput DropOutput
+		addOutput  AddOutput
+	)
+
+	if err := b.Drop(DropInput{Name: DefaultFilter}, &dropOutput); err != ErrDropDefaultFilter {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := b.Drop(DropInput{Name: "tenant"}, &dropOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if dropOutput.Name != "tenant" {
+		t.Errorf("unexpected name: %s", dropOutput.Name)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "filters", "tenant")); !os.IsNotExist(err) {
+		t.Errorf("the checkpoints of the dropped filter were not removed: %v", err)
+	}
+
+	if err := b.Add(AddInput{Elems: [][]byte{[]byte("elem1")}, Name: "tenant"}, &addOutput); !errors.Is(err, ErrFilterNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := b.Drop(DropInput{Name: "tenant"}, &dropOutput); !errors.Is(err, ErrFilterNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBFList(t *testing.T) {
+	b := New(context.Background(), Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Port: 1234,
+		Filters: map[string]rotate.Config{
+			"tenant-b": {Config: testutils.TestCfg, TTL: 5},
+			"tenant-a": {Config: testutils.TestCfg, TTL: 5},
+			"other":    {Config: testutils.TestCfg, TTL: 5},
+		},
+	})
+	defer b.Close()
+
+	var listOutput ListOutput
+
+	if err := b.List(ListInput{}, &listOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !reflect.DeepEqual(listOutput.Names, []string{DefaultFilter, "other", "tenant-a", "tenant-b"}) {
+		t.Errorf("unexpected names: %v", listOutput.Names)
+	}
+
+	if err := b.List(ListInput{Prefix: "tenant-"}, &listOutput); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if !reflect.DeepEqual(listOutput.Names, []string{"tenant-a", "tenant-b"}) {
+		t.Errorf("unexpected names: %v", listOutput.Names)
+	}
+}
+
+func TestConfig_Validate_filters(t *testing.T) {
+	cfg := Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Filters: map[string]rotate.Config{
+			"tenant": {Config: testutils.TestCfg, TTL: 5},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+
+	cfg.Filters["tenant"] = rotate.Config{Config: testutils.TestCfg}
+	if err := cfg.Validate(); !errors.Is(err, rotate.ErrInvalidTTL) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cfg.Filters = map[string]rotate.Config{
+		DefaultFilter: {Config: testutils.TestCfg, TTL: 5},
+	}
+	if err := cfg.Validate(); !errors.Is(err, ErrInvalidFilterName) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfig_Validate_codec(t *testing.T) {
+	cfg := Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+	}
+	for _, codec := range []string{"", CodecGob, CodecJSONRPC, CodecAuto} {
+		cfg.Codec = codec
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("%s: Unexpected error, %v", codec, err)
+		}
+	}
+
+	cfg.Codec = "xml"
+	if err := cfg.Validate(); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/krakendio/bloomfilter/v2/rotate"
+	rpc_bf "github.com/krakendio/bloomfilter/v2/rpc"
+)
+
+// The HTTP/JSON API exposes the same sliding bloomfilter sets as the rpc server. The set is selected with
+// the filter query param, the default one when missing:
+//
+//	POST /add          {"elems": ["a", "b"]} or a raw element  ->  {"count": 2}
+//	POST /check        {"elem": "a"} or a raw element           ->  {"check": true}
+//	POST /check/batch  {"elems": ["a", "b"]}                    ->  {"checks": [true, false]}
+//	POST /union        a snapshot, as served by /snapshot       ->  {"capacity": 0.1}
+//	GET  /snapshot     the serialized set, as written by rotate.Bloomfilter.WriteTo
+//	GET  /stats        the config and the saturation of the set
+//
+// The raw elements are sent with the application/octet-stream content type and the bodies are limited to
+// 32 MB. The token of the caller, when the auth is enabled, is sent in the Authorization header, as
+// "Bearer <token>". /snapshot requires the union permission, since the config of the set it serves
+// includes the seed of the hashes. The errors are responded as {"error": "..."}
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeBinary = "application/octet-stream"
+	bearerPrefix      = "Bearer "
+
+	maxBodySize = 32 << 20
+)
+
+// NewHTTP creates an rpc bloomfilter and launches a goroutine serving its HTTP/JSON API with the TLS
+// settings of the config, overridden by the options. The bloomfilter is closed when catching context done
+func NewHTTP(ctx context.Context, cfg rpc_bf.Config, opts ...Option) *rpc_bf.Bloomfilter {
+	opts = append(configOptions(cfg), opts...)
+	bf := newBloomfilter(ctx, cfg, opts)
+
+	go closeOnDone(ctx, bf)
+	go ServeHTTP(ctx, cfg.Port, bf, opts...)
+
+	return bf
+}
+
+// ServeHTTP serves the HTTP/JSON API of a bloomfilter on the port and shuts down when catching context done.
+// The bloomfilter is left open, so it can be shared with other servers. The codec option is ignored
+func ServeHTTP(ctx context.Context, port int, bf *rpc_bf.Bloomfilter, opts ...Option) error {
+	l, _, err := listen(port, opts)
+	if err != nil {
+		return err
+	}
+
+	s := &http.Server{
+		Handler:           Handler(bf),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(context.Background())
+	}()
+
+	if err := s.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Handler returns the http handler of the HTTP/JSON API of a bloomfilter
+func Handler(bf *rpc_bf.Bloomfilter) http.Handler {
+	h := httpHandler{bf}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/add", h.method(http.MethodPost, h.add))
+	mux.HandleFunc("/check", h.method(http.MethodPost, h.check))
+	mux.HandleFunc("/check/batch", h.method(http.MethodPost, h.checkBatch))
+	mux.HandleFunc("/union", h.method(http.MethodPost, h.union))
+	mux.HandleFunc("/snapshot", h.method(http.MethodGet, h.snapshot))
+	mux.HandleFunc("/stats", h.method(http.MethodGet, h.stats))
+	return mux
+}
+
+// AddRequest is the JSON body of the add endpoint
+type AddRequest struct {
+	Elems []string `json:"elems"`
+}
+
+// AddResponse is the JSON body responded by the add endpoint
+type AddResponse struct {
+	Count int `json:"count"`
+}
+
+// CheckRequest is the JSON body of the check endpoint
+type CheckRequest struct {
+	Elem string `json:"elem"`
+}
+
+// CheckResponse is the JSON body responded by the check endpoint
+type CheckResponse struct {
+	Check bool `json:"check"`
+}
+
+// CheckBatchRequest is the JSON body of the batch check endpoint
+type CheckBatchRequest struct {
+	Elems []string `json:"elems"`
+}
+
+// CheckBatchResponse is the JSON body responded by the batch check endpoint
+type CheckBatchResponse struct {
+	Checks []bool `json:"checks"`
+}
+
+// UnionResponse is the JSON body responded by the union endpoint
+type UnionResponse struct {
+	Capacity float64 `json:"capacity"`
+}
+
+// StatsResponse is the JSON body responded by the stats endpoint
+type StatsResponse struct {
+	Filter        string  `json:"filter"`
+	N             uint    `json:"n"`
+	P             float64 `json:"p"`
+	HashName      string  `json:"hash_name"`
+	TTL           float64 `json:"ttl"`
+	Count         uint64  `json:"count"`
+	Fill          float64 `json:"fill"`
+	FPRate        float64 `json:"fp_rate"`
+	EstimatedSize int     `json:"estimated_size"`
+}
+
+// ErrorResponse is the JSON body responded on errors
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// ErrUnsupportedContentType is responded when the body is neither JSON nor a raw element
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+type httpHandler struct {
+	bf *rpc_bf.Bloomfilter
+}
+
+func (h httpHandler) method(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h httpHandler) add(w http.ResponseWriter, r *http.Request) {
+	var elems [][]byte
+	if isBinary(r) {
+		elem, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		elems = [][]byte{elem}
+	} else {
+		var in AddRequest
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		elems = toBytes(in.Elems)
+	}
+
+	var out rpc_bf.AddOutput
+	if err := h.bf.Add(rpc_bf.AddInput{Elems: elems, Name: filterName(r), Token: token(r)}, &out); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, AddResponse{Count: out.Count})
+}
+
+func (h httpHandler) check(w http.ResponseWriter, r *http.Request) {
+	var elem []byte
+	if isBinary(r) {
+		var err error
+		if elem, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize)); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		var in CheckRequest
+		if !decodeJSON(w, r, &in) {
+			return
+		}
+		elem = []byte(in.Elem)
+	}
+
+	var out rpc_bf.CheckOutput
+	if err := h.bf.Check(rpc_bf.CheckInput{Elems: [][]byte{elem}, Name: filterName(r), Token: token(r)}, &out); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CheckResponse{Check: out.Checks[0]})
+}
+
+func (h httpHandler) checkBatch(w http.ResponseWriter, r *http.Request) {
+	var in CheckBatchRequest
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+
+	var out rpc_bf.CheckOutput
+	if err := h.bf.Check(rpc_bf.CheckInput{Elems: toBytes(in.Elems), Name: filterName(r), Token: token(r)}, &out); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CheckBatchResponse{Checks: out.Checks})
+}
+
+func (h httpHandler) union(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.bf.Authorize(token(r), rpc_bf.PermissionUnion); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+
+	other := new(rotate.Bloomfilter)
+	if _, err := other.ReadFrom(http.MaxBytesReader(w, r.Body, maxBodySize)); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var out rpc_bf.UnionOutput
+	if err := h.bf.Union(rpc_bf.UnionInput{BF: other, Name: filterName(r), Token: token(r)}, &out); err != nil {
+		code := statusCode(err)
+		if code == http.StatusInternalServerError {
+			code = http.StatusBadRequest
+		}
+		writeError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, UnionResponse{Capacity: out.Capacity})
+}
+
+// snapshot requires the union permission, as the serialized set holds the secret seed of its hashes
+func (h httpHandler) snapshot(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.bf.Authorize(token(r), rpc_bf.PermissionUnion); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+
+	bf, err := h.bf.Filter(filterName(r))
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeBinary)
+	w.WriteHeader(http.StatusOK)
+	bf.WriteTo(w)
+}
+
+func (h httpHandler) stats(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.bf.Authorize(token(r), rpc_bf.PermissionCheck); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+
+	name := filterName(r)
+	bf, err := h.bf.Filter(name)
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	if name == "" {
+		name = rpc_bf.DefaultFilter
+	}
+
+	s := bf.Saturation()
+	writeJSON(w, http.StatusOK, StatsResponse{
+		Filter:        name,
+		N:             bf.Config.N,
+		P:             bf.Config.P,
+		HashName:      bf.Config.HashName,
+		TTL:           ttl(bf.Config).Seconds(),
+		Count:         s.Count,
+		Fill:          s.Fill,
+		FPRate:        s.FPRate,
+		EstimatedSize: bf.EstimatedSize(),
+	})
+}
+
+// ttl returns the rotation period of the set, as TTLDuration takes precedence over TTL
+func ttl(cfg rotate.Config) time.Duration {
+	if cfg.TTLDuration > 0 {
+		return cfg.TTLDuration
+	}
+	return time.Duration(cfg.TTL) * time.Second
+}
+
+func filterName(r *http.Request) string {
+	return r.URL.Query().Get("filter")
+}
+
+// token returns the bearer token of the Authorization header
+func token(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(bearerPrefix) && strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		return auth[len(bearerPrefix):]
+	}
+	return ""
+}
+
+func isBinary(r *http.Request) bool {
+	return r.Header.Get("Content-Type") == contentTypeBinary
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if ct := r.Header.Get("Content-Type"); ct != "" && ct != contentTypeJSON {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", ErrUnsupportedContentType, ct))
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func toBytes(elems []string) [][]byte {
+	res := make([][]byte, len(elems))
+	for i, elem := range elems {
+		res[i] = []byte(elem)
+	}
+	return res
+}
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, rpc_bf.ErrFilterNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, rpc_bf.ErrNoBloomfilterInitialized):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, rpc_bf.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, rpc_bf.ErrForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeJSON(w, code, ErrorResponse{Error: err.Error()})
+}
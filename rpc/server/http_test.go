@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2/rotate"
+	rpc_bf "github.com/krakendio/bloomfilter/v2/rpc"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func newTestServer(t *testing.T) (*rpc_bf.Bloomfilter, *httptest.Server) {
+	bf := rpc_bf.New(context.Background(), rpc_bf.Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Filters: map[string]rotate.Config{
+			"tenant": {Config: testutils.TestCfg, TTL: 5},
+		},
+	})
+	s := httptest.NewServer(Handler(bf))
+	t.Cleanup(func() {
+		s.Close()
+		bf.Close()
+	})
+	return bf, s
+}
+
+func doJSON(t *testing.T, method, url string, in, out interface{}) int {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHTTP_addCheck(t *testing.T) {
+	_, s := newTestServer(t)
+
+	var addResp AddResponse
+	if code := doJSON(t, http.MethodPost, s.URL+"/add", AddRequest{Elems: []string{"elem1", "elem2"}}, &addResp); code != http.StatusOK {
+		t.Errorf("unexpected status code: %d", code)
+	}
+	if addResp.Count != 2 {
+		t.Errorf("unexpected count: %d", addResp.Count)
+	}
+
+	resp, err := http.Post(s.URL+"/add", contentTypeBinary, bytes.NewReader([]byte{0, 1, 2}))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var checkResp CheckResponse
+	if code := doJSON(t, http.MethodPost, s.URL+"/check", CheckRequest{Elem: "elem1"}, &checkResp); code != http.StatusOK {
+		t.Errorf("unexpected status code: %d", code)
+	}
+	if !checkResp.Check {
+		t.Error("elem1 not found")
+	}
+
+	resp, err = http.Post(s.URL+"/check", contentTypeBinary, bytes.NewReader([]byte{0, 1, 2}))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	checkResp = CheckResponse{}
+	json.NewDecoder(resp.Body).Decode(&checkResp)
+	resp.Body.Close()
+	if !checkResp.Check {
+		t.Error("the raw element was not found")
+	}
+
+	var batchResp CheckBatchResponse
+	if code := doJSON(t, http.MethodPost, s.URL+"/check/batch", CheckBatchRequest{Elems: []string{"elem1", "elem2", "elem3"}}, &batchResp); code != http.StatusOK {
+		t.Errorf("unexpected status code: %d", code)
+	}
+	if len(batchResp.Checks) != 3 || !batchResp.Checks[0] || !batchResp.Checks[1] || batchResp.Checks[2] {
+		t.Errorf("unexpected checks: %v", batchResp.Checks)
+	}
+
+	if code := doJSON(t, http.MethodPost, s.URL+"/check/batch?filter=tenant", CheckBatchRequest{Elems: []string{"elem1"}}, &batchResp); code != http.StatusOK {
+		t.Errorf("unexpected status code: %d", code)
+	}
+	if batchResp.Checks[0] {
+		t.Error("the element was added to the named filter")
+	}
+}
+
+func TestHTTP_errors(t *testing.T) {
+	_, s := newTestServer(t)
+
+	var errResp ErrorResponse
+	if code := doJSON(t, http.MethodPost, s.URL+"/add?filter=unknown", AddRequest{Elems: []string{"elem1"}}, &errResp); code != http.StatusNotFound {
+		t.Errorf("unexpected status code: %d", code)
+	}
+	if !strings.Contains(errResp.Error, rpc_bf.ErrFilterNotFound.Error()) {
+		t.Errorf("unexpected error: %s", errResp.Error)
+	}
+
+	if code := doJSON(t, http.MethodGet, s.URL+"/add", nil, &errResp); code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status code: %d", code)
+	}
+
+	resp, err := http.Post(s.URL+"/check", contentTypeJSON, strings.NewReader("{"))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(s.URL+"/check/batch", "text/plain", strings.NewReader("elem1"))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(s.URL+"/union", contentTypeBinary, strings.NewReader("garbage"))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+func TestHTTP_snapshotUnion(t *testing.T) {
+	bf, s := newTestServer(t)
+
+	other, err := bf.Filter("tenant")
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	other.Add([]byte("elem1"))
+
+	resp, err := http.Get(s.URL + "/snapshot?filter=tenant")
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	snapshot, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(s.URL+"/union", contentTypeBinary, bytes.NewReader(snapshot))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	var unionResp UnionResponse
+	json.NewDecoder(resp.Body).Decode(&unionResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if unionResp.Capacity <= 0 {
+		t.Errorf("unexpected capacity: %f", unionResp.Capacity)
+	}
+
+	if !bf.Bloomfilter().Check([]byte("elem1")) {
+		t.Error("the snapshot was not merged into the default filter")
+	}
+}
+
+func TestHTTP_stats(t *testing.T) {
+	_, s := newTestServer(t)
+
+	doJSON(t, http.MethodPost, s.URL+"/add", AddRequest{Elems: []string{"elem1", "elem2"}}, nil)
+
+	var stats StatsResponse
+	if code := doJSON(t, http.MethodGet, s.URL+"/stats", nil, &stats); code != http.StatusOK {
+		t.Errorf("unexpected status code: %d", code)
+	}
+	if stats.Filter != rpc_bf.DefaultFilter || stats.N != testutils.TestCfg.N || stats.TTL != 5 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.Count != 2 || stats.Fill <= 0 || stats.EstimatedSize <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestHTTP_auth(t *testing.T) {
+	bf := rpc_bf.New(context.Background(), rpc_bf.Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Auth: &rpc_bf.AuthConfig{
+			Credentials: []rpc_bf.Credential{
+				{ID: "gateway", Token: "check-token-0123456789", Permissions: []string{rpc_bf.PermissionCheck}},
+				{ID: "revoker", Token: "add-token-0123456789", Permissions: []string{rpc_bf.PermissionAdd}},
+				{ID: "replica", Token: "union-token-0123456789", Permissions: []string{rpc_bf.PermissionUnion}},
+			},
+		},
+	}, rpc_bf.WithAuditor(func(rpc_bf.AuditEntry) {}))
+	s := httptest.NewServer(Handler(bf))
+	defer func() {
+		s.Close()
+		bf.Close()
+	}()
+
+	for _, tc := range []struct {
+		path, token string
+		code        int
+	}{
+		{"/add", "", http.StatusUnauthorized},
+		{"/add", "check-token-0123456789", http.StatusForbidden},
+		{"/add", "add-token-0123456789", http.StatusOK},
+		{"/check", "add-token-0123456789", http.StatusForbidden},
+		{"/check", "check-token-0123456789", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, s.URL+tc.path, strings.NewReader(`{"elem": "elem1", "elems": ["elem1"]}`))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s with %q: unexpected status code: %d", tc.path, tc.token, resp.StatusCode)
+		}
+		if tc.code == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("unexpected WWW-Authenticate header: %q", resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+
+	for _, path := range []string{"/stats", "/snapshot"} {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: unexpected status code: %d", path, resp.StatusCode)
+		}
+	}
+
+	// the snapshot holds the seed of the hashes, so it is not served to the checkers
+	for token, code := range map[string]int{
+		"check-token-0123456789": http.StatusForbidden,
+		"union-token-0123456789": http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, s.URL+"/snapshot", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("/snapshot with %q: unexpected status code: %d", token, resp.StatusCode)
+		}
+	}
+}
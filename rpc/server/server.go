@@ -2,42 +2,216 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/rpc"
+	"net/rpc/jsonrpc"
 
 	rpc_bf "github.com/krakendio/bloomfilter/v2/rpc"
 )
 
-// New creates an rpc bloomfilter and launches a serving goroutine
-func New(ctx context.Context, cfg rpc_bf.Config) *rpc_bf.Bloomfilter {
-	bf := rpc_bf.New(ctx, cfg)
+// Option customizes the rpc server
+type Option func(*options)
 
-	go Serve(ctx, cfg.Port, bf)
+type options struct {
+	codec   string
+	tls     *tls.Config
+	auditor rpc_bf.Auditor
+	onError func(error)
+	err     error
+}
+
+// WithCodec sets the codec of the connections: rpc_bf.CodecGob, the default one, rpc_bf.CodecJSONRPC or
+// rpc_bf.CodecAuto, detecting it per connection
+func WithCodec(codec string) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithTLS secures the connections with the TLS config
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg
+	}
+}
+
+// WithTLSFiles secures the connections with the certs and the settings of the config. The certs are
+// loaded once, when creating the option, and the errors loading them are returned when serving
+func WithTLSFiles(cfg rpc_bf.TLSConfig) Option {
+	tlsCfg, err := cfg.ServerConfig()
+	return func(o *options) {
+		o.tls, o.err = tlsCfg, err
+	}
+}
+
+// WithAuditor sets the auditor of the mutating calls of the bloomfilters created by New, Build and NewHTTP
+func WithAuditor(a rpc_bf.Auditor) Option {
+	return func(o *options) {
+		o.auditor = a
+	}
+}
+
+// OnError sets the hook called with the errors restoring the bloomfilters created by New, Build and NewHTTP
+func OnError(h func(error)) Option {
+	return func(o *options) {
+		o.onError = h
+	}
+}
+
+// newBloomfilter creates the rpc bloomfilter with the auditor and the error hook of the options
+func newBloomfilter(ctx context.Context, cfg rpc_bf.Config, opts []Option) *rpc_bf.Bloomfilter {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return rpc_bf.New(ctx, cfg, rpc_bf.WithAuditor(o.auditor), rpc_bf.OnError(o.onError))
+}
+
+// configOptions returns the options set in the config, loading its certs once for all the servers
+func configOptions(cfg rpc_bf.Config) []Option {
+	opts := []Option{WithCodec(cfg.Codec)}
+	if cfg.TLS != nil {
+		opts = append(opts, WithTLSFiles(*cfg.TLS))
+	}
+	return opts
+}
+
+// New creates an rpc bloomfilter and launches a serving goroutine with the codec and the TLS settings of the
+// config, overridden by the options. Nothing is served when the certs can not be loaded. The bloomfilter
+// is closed when catching context done
+func New(ctx context.Context, cfg rpc_bf.Config, opts ...Option) *rpc_bf.Bloomfilter {
+	opts = append(configOptions(cfg), opts...)
+	bf := newBloomfilter(ctx, cfg, opts)
+
+	go closeOnDone(ctx, bf)
+	go Serve(ctx, cfg.Port, bf, opts...)
 
 	return bf
 }
 
-// Serve creates an rpc server, registers a bloomfilter, accepts a tcp listener and closes when catching context done
-func Serve(ctx context.Context, port int, bf *rpc_bf.Bloomfilter) error {
-	s := rpc.NewServer()
+// Build validates the config and creates an rpc bloomfilter, returning the errors loading the certs and
+// listening before launching the serving goroutine. The bloomfilter is closed when catching context done
+func Build(ctx context.Context, cfg rpc_bf.Config, opts ...Option) (*rpc_bf.Bloomfilter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	opts = append(configOptions(cfg), opts...)
+	l, serveConn, err := listen(cfg.Port, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := s.Register(&bf.BloomfilterRPC); err != nil {
+	bf := newBloomfilter(ctx, cfg, opts)
+	go closeOnDone(ctx, bf)
+	go serve(ctx, l, bf, serveConn)
+
+	return bf, nil
+}
+
+// closeOnDone closes the bloomfilter created by the server when catching context done
+func closeOnDone(ctx context.Context, bf *rpc_bf.Bloomfilter) {
+	<-ctx.Done()
+	bf.Close()
+}
+
+// Serve creates an rpc server, registers a bloomfilter, accepts a tcp listener and closes when catching
+// context done. The bloomfilter is left open, so it can be shared with other servers
+func Serve(ctx context.Context, port int, bf *rpc_bf.Bloomfilter, opts ...Option) error {
+	l, serveConn, err := listen(port, opts)
+	if err != nil {
 		return err
 	}
 
+	return serve(ctx, l, bf, serveConn)
+}
+
+// listen applies the options, returning the listener of the port, wrapped with TLS when set, and the
+// function serving its connections
+func listen(port int, opts []Option) (net.Listener, func(*rpc.Server, net.Conn), error) {
+	o := options{codec: rpc_bf.CodecGob}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return nil, nil, o.err
+	}
+	serveConn, err := connServer(o.codec)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
+		return nil, nil, err
+	}
+	if o.tls != nil {
+		l = tls.NewListener(l, o.tls)
+	}
+
+	return l, serveConn, nil
+}
+
+func serve(ctx context.Context, l net.Listener, bf *rpc_bf.Bloomfilter, serveConn func(*rpc.Server, net.Conn)) error {
+	s := rpc.NewServer()
+
+	if err := s.Register(&bf.BloomfilterRPC); err != nil {
+		l.Close()
 		return err
 	}
 
 	go func() {
 		<-ctx.Done()
 		l.Close()
-		bf.Close()
 	}()
 
-	s.Accept(l)
-	return nil
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveConn(s, conn)
+	}
+}
+
+// connServer returns the function serving a connection with the codec
+func connServer(codec string) (func(*rpc.Server, net.Conn), error) {
+	switch codec {
+	case "", rpc_bf.CodecGob:
+		return func(s *rpc.Server, conn net.Conn) { s.ServeConn(conn) }, nil
+	case rpc_bf.CodecJSONRPC:
+		return func(s *rpc.Server, conn net.Conn) { s.ServeCodec(jsonrpc.NewServerCodec(conn)) }, nil
+	case rpc_bf.CodecAuto:
+		return serveDetected, nil
+	}
+	return nil, fmt.Errorf("%w: %s", rpc_bf.ErrUnknownCodec, codec)
+}
+
+// serveDetected peeks the first byte of the connection, serving it with the JSON-RPC codec when it is '{'
+// and with the gob one otherwise
+func serveDetected(s *rpc.Server, conn net.Conn) {
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	rwc := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{br, conn, conn}
+	if b[0] == '{' {
+		s.ServeCodec(jsonrpc.NewServerCodec(rwc))
+		return
+	}
+	s.ServeConn(rwc)
 }
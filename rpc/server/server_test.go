@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2/rotate"
+	rpc_bf "github.com/krakendio/bloomfilter/v2/rpc"
+	"github.com/krakendio/bloomfilter/v2/rpc/client"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func newTestRPCServer(t *testing.T, codec string) (*rpc_bf.Bloomfilter, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bf := rpc_bf.New(ctx, rpc_bf.Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	serveConn, err := connServer(codec)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	go serve(ctx, l, bf, serveConn)
+	t.Cleanup(cancel)
+	return bf, l.Addr().String()
+}
+
+func TestServe_codecs(t *testing.T) {
+	for _, tc := range []struct {
+		server, client string
+	}{
+		{rpc_bf.CodecGob, rpc_bf.CodecGob},
+		{rpc_bf.CodecJSONRPC, rpc_bf.CodecJSONRPC},
+		{rpc_bf.CodecAuto, rpc_bf.CodecGob},
+		{rpc_bf.CodecAuto, rpc_bf.CodecJSONRPC},
+	} {
+		_, addr := newTestRPCServer(t, tc.server)
+
+		c, err := client.New(addr, client.WithCodec(tc.client))
+		if err != nil {
+			t.Errorf("%s/%s: Unexpected error, %v", tc.server, tc.client, err)
+			continue
+		}
+
+		if err := c.AddBatch([][]byte{[]byte("elem1"), {0, 255}}); err != nil {
+			t.Errorf("%s/%s: Unexpected error, %v", tc.server, tc.client, err)
+		}
+		for _, elem := range [][]byte{[]byte("elem1"), {0, 255}} {
+			if ok, err := c.Check(elem); err != nil || !ok {
+				t.Errorf("%s/%s: unexpected check of %v: %v, %v", tc.server, tc.client, elem, ok, err)
+			}
+		}
+
+		other := rotate.New(context.Background(), rotate.Config{Config: testutils.TestCfg, TTL: 5})
+		other.Add([]byte("elem2"))
+		if _, err := c.Union(other); err != nil {
+			t.Errorf("%s/%s: Unexpected error, %v", tc.server, tc.client, err)
+		}
+		other.Close()
+		if ok, err := c.Check([]byte("elem2")); err != nil || !ok {
+			t.Errorf("%s/%s: unexpected check after the union: %v, %v", tc.server, tc.client, ok, err)
+		}
+
+		c.Close()
+	}
+}
+
+func TestServe_jsonrpcBase64(t *testing.T) {
+	bf, addr := newTestRPCServer(t, rpc_bf.CodecAuto)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// "ZWxlbTE=" is the base64 encoding of "elem1"
+	if _, err := conn.Write([]byte(`{"method":"BloomfilterRPC.Add","params":[{"Elems":["ZWxlbTE="]}],"id":1}` + "\n")); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	var resp struct {
+		ID     int              `json:"id"`
+		Result rpc_bf.AddOutput `json:"result"`
+		Error  *string          `json:"error"`
+	}
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if resp.Error != nil || resp.ID != 1 || resp.Result.Count != 1 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if !bf.Bloomfilter().Check([]byte("elem1")) {
+		t.Error("the base64 encoded element was not added")
+	}
+}
+
+func TestServe_jsonrpcUnionBF(t *testing.T) {
+	bf, addr := newTestRPCServer(t, rpc_bf.CodecJSONRPC)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// the sets can not be decoded from JSON, so only their snapshot is accepted
+	calls := `{"method":"BloomfilterRPC.Union","params":[{"BF":{"Config":{"ttl":5}}}],"id":1}` + "\n" +
+		`{"method":"BloomfilterRPC.Add","params":[{"Elems":["ZWxlbTE="]}],"id":2}` + "\n"
+	if _, err := conn.Write([]byte(calls)); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for _, id := range []int{1, 2} {
+		var resp struct {
+			ID    int     `json:"id"`
+			Error *string `json:"error"`
+		}
+		if err := dec.Decode(&resp); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+			return
+		}
+		if resp.ID != id || (resp.Error != nil) != (id == 1) {
+			t.Errorf("unexpected response: %+v", resp)
+		}
+		if resp.Error != nil && !strings.Contains(*resp.Error, rotate.ErrJSONNotSupported.Error()) {
+			t.Errorf("unexpected error: %s", *resp.Error)
+		}
+	}
+	if !bf.Bloomfilter().Check([]byte("elem1")) {
+		t.Error("the connection was not served after the rejected union")
+	}
+}
+
+func TestServe_unknownCodec(t *testing.T) {
+	if err := Serve(context.Background(), 0, nil, WithCodec("xml")); !errors.Is(err, rpc_bf.ErrUnknownCodec) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := client.New("127.0.0.1:0", client.WithCodec(rpc_bf.CodecAuto)); !errors.Is(err, rpc_bf.ErrUnknownCodec) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestServe_mTLS(t *testing.T) {
+	certs, err := testutils.GenerateCerts(t.TempDir())
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	tlsCfg, err := rpc_bf.TLSConfig{
+		CertFile:     certs.ServerCert,
+		KeyFile:      certs.ServerKey,
+		ClientCAFile: certs.CA,
+		MinVersion:   "1.2",
+		AllowedNames: []string{"client"},
+	}.ServerConfig()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bf := rpc_bf.New(ctx, rpc_bf.Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	serveConn, _ := connServer(rpc_bf.CodecGob)
+	go serve(ctx, tls.NewListener(l, tlsCfg), bf, serveConn)
+	addr := l.Addr().String()
+
+	c, err := client.New(addr, client.WithTLSFiles(rpc_bf.ClientTLSConfig{
+		CAFile:   certs.CA,
+		CertFile: certs.ClientCert,
+		KeyFile:  certs.ClientKey,
+	}))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if err := c.Add([]byte("elem1")); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	c.Close()
+	if !bf.Bloomfilter().Check([]byte("elem1")) {
+		t.Error("the element was not added")
+	}
+
+	for name, cfg := range map[string]rpc_bf.ClientTLSConfig{
+		"no client cert": {CAFile: certs.CA},
+		"not allowed":    {CAFile: certs.CA, CertFile: certs.IntruderCert, KeyFile: certs.IntruderKey},
+	} {
+		c, err := client.New(addr, client.WithTLSFiles(cfg))
+		if err != nil {
+			continue
+		}
+		if err := c.Add([]byte("elem2")); err == nil {
+			t.Errorf("%s: the client was accepted", name)
+		}
+		c.Close()
+	}
+
+	if _, err := client.New(addr, client.WithTLSFiles(rpc_bf.ClientTLSConfig{
+		CertFile: certs.ClientCert,
+		KeyFile:  certs.ClientKey,
+	})); err == nil {
+		t.Error("the server cert was not verified")
+	}
+
+	c, err = client.New(addr)
+	if err == nil {
+		if err := c.Add([]byte("elem2")); err == nil {
+			t.Error("the plain client was accepted")
+		}
+		c.Close()
+	}
+
+	if bf.Bloomfilter().Check([]byte("elem2")) {
+		t.Error("a rejected client added an element")
+	}
+}
+
+func TestBuild_tls(t *testing.T) {
+	_, err := Build(context.Background(), rpc_bf.Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		TLS: &rpc_bf.TLSConfig{
+			CertFile: filepath.Join(t.TempDir(), "missing.pem"),
+			KeyFile:  filepath.Join(t.TempDir(), "missing-key.pem"),
+		},
+	})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigOptions_tlsLoadedOnce(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := testutils.GenerateCerts(dir)
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	opts := configOptions(rpc_bf.Config{TLS: &rpc_bf.TLSConfig{CertFile: certs.ServerCert, KeyFile: certs.ServerKey}})
+	// the certs were loaded with the options, so applying them does not read the files again
+	if err := os.RemoveAll(dir); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil || o.tls == nil || len(o.tls.Certificates) != 1 {
+		t.Errorf("unexpected tls options: %v, %v", o.tls, o.err)
+	}
+}
+
+func TestServe_token(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bf := rpc_bf.New(ctx, rpc_bf.Config{
+		Config: rotate.Config{
+			Config: testutils.TestCfg,
+			TTL:    5,
+		},
+		Auth: &rpc_bf.AuthConfig{
+			Credentials: []rpc_bf.Credential{
+				{ID: "revoker", Token: "add-token-0123456789", Permissions: []string{rpc_bf.PermissionCheck, rpc_bf.PermissionAdd}},
+			},
+		},
+	}, rpc_bf.WithAuditor(func(rpc_bf.AuditEntry) {}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	serveConn, _ := connServer(rpc_bf.CodecGob)
+	go serve(ctx, l, bf, serveConn)
+
+	c, err := client.New(l.Addr().String())
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer c.Close()
+
+	if err := c.Add([]byte("elem1")); err == nil || err.Error() != rpc_bf.ErrUnauthorized.Error() {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	named := c.Named(rpc_bf.DefaultFilter)
+	authorized, err := client.New(l.Addr().String(), client.WithToken("add-token-0123456789"))
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	defer authorized.Close()
+	if err := authorized.Named(rpc_bf.DefaultFilter).Add([]byte("elem1")); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if ok, err := named.Check([]byte("elem1")); err == nil || ok {
+		t.Errorf("unexpected check without token: %v, %v", ok, err)
+	}
+	if ok, err := authorized.Check([]byte("elem1")); err != nil || !ok {
+		t.Errorf("unexpected check: %v, %v", ok, err)
+	}
+}
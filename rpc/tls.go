@@ -0,0 +1,175 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSConfig secures the connections of the server with the cert and key in the PEM files. When ClientCAFile
+// is set, the clients must present a cert signed by one of its CAs (mutual TLS) and, when AllowedNames is
+// set too, with a common name or a subject alternative name in it. MinVersion is one of 1.0, 1.1, 1.2 (the
+// default) and 1.3
+type TLSConfig struct {
+	CertFile     string   `json:"cert_file"`
+	KeyFile      string   `json:"key_file"`
+	ClientCAFile string   `json:"client_ca_file,omitempty"`
+	MinVersion   string   `json:"min_version,omitempty"`
+	AllowedNames []string `json:"allowed_names,omitempty"`
+}
+
+// ClientTLSConfig secures the connections of the clients. The cert of the server is verified with the CAs
+// in CAFile, the system ones when empty, and ServerName, the host of the address when empty. The cert
+// and key in CertFile and KeyFile are presented to the servers requiring mutual TLS
+type ClientTLSConfig struct {
+	CAFile     string `json:"ca_file,omitempty"`
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	MinVersion string `json:"min_version,omitempty"`
+}
+
+var (
+	// ErrMissingCert is returned when the cert or the key of the server is not set
+	ErrMissingCert = errors.New("the cert and the key files are required")
+	// ErrInvalidTLSVersion is returned when the min TLS version is not one of 1.0, 1.1, 1.2 and 1.3
+	ErrInvalidTLSVersion = errors.New("invalid min tls version")
+	// ErrAllowedNamesWithoutCA is returned when allowing client names without requiring client certs
+	ErrAllowedNamesWithoutCA = errors.New("the allowed names require a client ca file")
+	// ErrNoCACerts is returned when a CA file has no PEM encoded certs
+	ErrNoCACerts = errors.New("no certs found in the ca file")
+	// ErrClientNotAllowed is returned when the cert of the client has no allowed name
+	ErrClientNotAllowed = errors.New("client cert not allowed")
+)
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Validate checks the TLS settings, without loading the files
+func (c TLSConfig) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return ErrMissingCert
+	}
+	if _, ok := tlsVersions[c.MinVersion]; !ok {
+		return fmt.Errorf("%w: %s", ErrInvalidTLSVersion, c.MinVersion)
+	}
+	if len(c.AllowedNames) > 0 && c.ClientCAFile == "" {
+		return ErrAllowedNamesWithoutCA
+	}
+	return nil
+}
+
+// ServerConfig loads the files, returning the config of a TLS server
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[c.MinVersion],
+	}
+	if c.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	if cfg.ClientCAs, err = loadCAs(c.ClientCAFile); err != nil {
+		return nil, err
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(c.AllowedNames) > 0 {
+		cfg.VerifyConnection = allowNames(c.AllowedNames)
+	}
+	return cfg, nil
+}
+
+// Validate checks the TLS settings of the client, without loading the files
+func (c ClientTLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return ErrMissingCert
+	}
+	if _, ok := tlsVersions[c.MinVersion]; !ok {
+		return fmt.Errorf("%w: %s", ErrInvalidTLSVersion, c.MinVersion)
+	}
+	return nil
+}
+
+// ClientConfig loads the files, returning the config of a TLS client
+func (c ClientTLSConfig) ClientConfig() (*tls.Config, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tlsVersions[c.MinVersion],
+	}
+	if c.CAFile != "" {
+		pool, err := loadCAs(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCAs(name string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%w: %s", ErrNoCACerts, name)
+	}
+	return pool, nil
+}
+
+// allowNames returns the check of the verified cert of the client, accepting it when its common name or
+// any of its DNS, email, URI or IP subject alternative names is allowed
+func allowNames(names []string) func(tls.ConnectionState) error {
+	allowed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		allowed[name] = struct{}{}
+	}
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrClientNotAllowed
+		}
+		cert := cs.PeerCertificates[0]
+
+		candidates := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+		candidates = append(candidates, cert.EmailAddresses...)
+		for _, u := range cert.URIs {
+			candidates = append(candidates, u.String())
+		}
+		for _, ip := range cert.IPAddresses {
+			candidates = append(candidates, ip.String())
+		}
+		for _, name := range candidates {
+			if _, ok := allowed[name]; ok && name != "" {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrClientNotAllowed, cert.Subject.CommonName)
+	}
+}
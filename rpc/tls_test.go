@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestTLSConfig_Validate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  TLSConfig
+		err  error
+	}{
+		{"ok", TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}, nil},
+		{"mtls", TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", ClientCAFile: "ca.pem", AllowedNames: []string{"client"}, MinVersion: "1.3"}, nil},
+		{"missing key", TLSConfig{CertFile: "cert.pem"}, ErrMissingCert},
+		{"version", TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.4"}, ErrInvalidTLSVersion},
+		{"names without ca", TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", AllowedNames: []string{"client"}}, ErrAllowedNamesWithoutCA},
+	} {
+		if err := tc.cfg.Validate(); !errors.Is(err, tc.err) {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+
+	if err := (ClientTLSConfig{CertFile: "cert.pem"}).Validate(); err != ErrMissingCert {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTLSConfig_ServerConfig(t *testing.T) {
+	certs, err := testutils.GenerateCerts(t.TempDir())
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	cfg, err := TLSConfig{CertFile: certs.ServerCert, KeyFile: certs.ServerKey}.ServerConfig()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if cfg.ClientAuth != tls.NoClientCert || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("unexpected config: %v %v", cfg.ClientAuth, cfg.MinVersion)
+	}
+
+	cfg, err = TLSConfig{CertFile: certs.ServerCert, KeyFile: certs.ServerKey, ClientCAFile: certs.CA}.ServerConfig()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert || cfg.ClientCAs == nil {
+		t.Errorf("mutual TLS not required: %v", cfg.ClientAuth)
+	}
+
+	if _, err := (TLSConfig{CertFile: certs.ServerCert, KeyFile: certs.ServerKey, ClientCAFile: certs.ServerKey}).ServerConfig(); !errors.Is(err, ErrNoCACerts) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAllowNames(t *testing.T) {
+	allow := allowNames([]string{"client", "spiffe://bloomfilter/writer", "writer.example.com"})
+
+	u, _ := url.Parse("spiffe://bloomfilter/writer")
+	for _, cert := range []*x509.Certificate{
+		{Subject: pkix.Name{CommonName: "client"}},
+		{DNSNames: []string{"other.example.com", "writer.example.com"}},
+		{URIs: []*url.URL{u}},
+	} {
+		if err := allow(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); err != nil {
+			t.Errorf("Unexpected error, %v", err)
+		}
+	}
+
+	if err := allow(tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "intruder"}}}}); !errors.Is(err, ErrClientNotAllowed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := allow(tls.ConnectionState{}); !errors.Is(err, ErrClientNotAllowed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+// Package scalable implements a scalable bloomfilter: a chain of bloomfilters growing as elements are added.
+//
+// When the last stage of the chain reaches its capacity, a new stage with a bigger capacity and a tighter
+// false positive probability is appended, so the overall false positive probability stays bounded by the
+// configured one no matter how many elements are added: http://gsd.di.uminho.pt/members/cbm/ps/dbloom.pdf
+package scalable
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+)
+
+const (
+	// DefaultGrowth is the capacity multiplier between stages when the config does not define it
+	DefaultGrowth = 2
+	// DefaultTightening is the false positive probability ratio between stages when the config does not define it
+	DefaultTightening = 0.8
+	// MaxGrowth is the max capacity multiplier between stages
+	MaxGrowth = 1 << 10
+)
+
+// ErrInvalidGrowth is returned when the growth is 1 or greater than MaxGrowth
+var ErrInvalidGrowth = fmt.Errorf("the growth must be greater than 1 and not greater than %d", MaxGrowth)
+
+// ErrInvalidStage is returned when a serialized stage does not match the config of the scalable bloomfilter
+var ErrInvalidStage = errors.New("invalid stage")
+
+// ErrInvalidTightening is returned when the tightening ratio is not in the (0, 1) interval
+var ErrInvalidTightening = errors.New("the tightening ratio must be greater than 0 and lower than 1")
+
+// Config contains a bloomfilter config, where N is the capacity of the first stage and P the overall
+// false positive probability, along with the growth of the capacity and the tightening of the false
+// positive probability between stages
+type Config struct {
+	bloomfilter.Config
+	Growth     uint    `json:"growth"`
+	Tightening float64 `json:"tightening"`
+}
+
+// Validate checks the config can be used to build a scalable bloomfilter
+func (c Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.Tightening != 0 && (math.IsNaN(c.Tightening) || c.Tightening <= 0 || c.Tightening >= 1) {
+		return &bloomfilter.ConfigError{Field: "tightening", Err: ErrInvalidTightening}
+	}
+	if c.Growth == 1 || c.Growth > MaxGrowth {
+		return &bloomfilter.ConfigError{Field: "growth", Err: ErrInvalidGrowth}
+	}
+	return nil
+}
+
+func (c Config) withDefaults() Config {
+	if c.Growth == 0 {
+		c.Growth = DefaultGrowth
+	}
+	if c.Tightening == 0 {
+		c.Tightening = DefaultTightening
+	}
+	return c
+}
+
+// stage returns the config of the i-th stage of the chain. Its capacity saturates at math.MaxUint
+func (c Config) stage(i int) bloomfilter.Config {
+	cfg := c.Config
+	for j := 0; j < i; j++ {
+		if cfg.N > math.MaxUint/c.Growth {
+			cfg.N = math.MaxUint
+			break
+		}
+		cfg.N *= c.Growth
+	}
+	cfg.P = c.P * (1 - c.Tightening) * math.Pow(c.Tightening, float64(i))
+	return cfg
+}
+
+// Bloomfilter is a scalable bloomfilter
+type Bloomfilter struct {
+	stages []*bbloomfilter.Bloomfilter
+	counts []uint
+	cfg    Config
+}
+
+// Build validates the config before creating a new scalable bloomfilter
+func Build(cfg Config) (*Bloomfilter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return New(cfg), nil
+}
+
+// New creates a new scalable bloomfilter with a single stage. It panics if the config has an unknown
+// hash name, use Build to get an error instead
+func New(cfg Config) *Bloomfilter {
+	cfg = cfg.withDefaults()
+	return &Bloomfilter{
+		stages: []*bbloomfilter.Bloomfilter{bbloomfilter.New(cfg.stage(0))},
+		counts: []uint{0},
+		cfg:    cfg,
+	}
+}
+
+// Add an element to the last stage of the scalable bloomfilter, appending a new stage if it is full.
+// Elements already present are not added again, so they do not consume capacity
+func (b *Bloomfilter) Add(elem []byte) {
+	if b.Check(elem) {
+		return
+	}
+
+	last := len(b.stages) - 1
+	if b.counts[last] >= b.cfg.stage(last).N {
+		b.stages = append(b.stages, bbloomfilter.New(b.cfg.stage(last+1)))
+		b.counts = append(b.counts, 0)
+		last++
+	}
+
+	b.stages[last].Add(elem)
+	b.counts[last]++
+}
+
+// Check if an element is in any stage of the scalable bloomfilter
+func (b *Bloomfilter) Check(elem []byte) bool {
+	for i := len(b.stages) - 1; i >= 0; i-- {
+		if b.stages[i].Check(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// Union of two scalable bloomfilters with the same config. The stages are merged one by one and the
+// extra stages of the other filter are copied
+func (b *Bloomfilter) Union(that interface{}) (float64, error) {
+	other, ok := that.(*Bloomfilter)
+	if !ok {
+		return b.Capacity(), bloomfilter.ErrImpossibleToTreat
+	}
+
+	if other.cfg.N != b.cfg.N {
+		return b.Capacity(), fmt.Errorf("different n values %d vs. %d", other.cfg.N, b.cfg.N)
+	}
+
+	if other.cfg.P != b.cfg.P {
+		return b.Capacity(), fmt.Errorf("different p values %.2f vs. %.2f", other.cfg.P, b.cfg.P)
+	}
+
+	if b.cfg.Growth != other.cfg.Growth {
+		return b.Capacity(), fmt.Errorf("different growth values %d vs. %d", other.cfg.Growth, b.cfg.Growth)
+	}
+
+	if b.cfg.Tightening != other.cfg.Tightening {
+		return b.Capacity(), fmt.Errorf("different tightening values %.2f vs. %.2f", other.cfg.Tightening, b.cfg.Tightening)
+	}
+
+	for i, stage := range other.stages {
+		if i == len(b.stages) {
+			b.stages = append(b.stages, bbloomfilter.New(b.cfg.stage(i)))
+			b.counts = append(b.counts, 0)
+		}
+		if _, err := b.stages[i].Union(stage); err != nil {
+			return b.Capacity(), err
+		}
+		b.counts[i] += other.counts[i]
+		if n := b.cfg.stage(i).N; b.counts[i] > n {
+			b.counts[i] = n
+		}
+	}
+
+	return b.Capacity(), nil
+}
+
+// Stages returns the number of stages of the scalable bloomfilter
+func (b *Bloomfilter) Stages() int {
+	return len(b.stages)
+}
+
+// Capacity returns the fill degree of the scalable bloomfilter, considering the bits of all the stages
+func (b *Bloomfilter) Capacity() float64 {
+	var set, total float64
+	for _, stage := range b.stages {
+		set += stage.Capacity() * float64(stage.M())
+		total += float64(stage.M())
+	}
+	return set / total
+}
+
+// SerializibleBloomfilter used when (de)serializing a scalable bloomfilter
+type SerializibleBloomfilter struct {
+	Stages []*bbloomfilter.Bloomfilter
+	Counts []uint
+	Config Config
+}
+
+// MarshalBinary serializes a scalable bloomfilter
+func (b *Bloomfilter) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(&SerializibleBloomfilter{
+		Stages: b.stages,
+		Counts: b.counts,
+		Config: b.cfg,
+	})
+
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary deserializes a scalable bloomfilter
+func (b *Bloomfilter) UnmarshalBinary(data []byte) error {
+	target := SerializibleBloomfilter{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&target); err != nil {
+		return err
+	}
+
+	if err := target.Config.Validate(); err != nil {
+		return err
+	}
+	if len(target.Stages) == 0 || len(target.Stages) != len(target.Counts) {
+		return fmt.Errorf("%d stages do not match %d counts", len(target.Stages), len(target.Counts))
+	}
+
+	cfg := target.Config.withDefaults()
+	for i, stage := range target.Stages {
+		want := cfg.stage(i)
+		if stage.Config() != want {
+			return fmt.Errorf("%w: the config of stage %d does not match the one of the scalable bloomfilter", ErrInvalidStage, i)
+		}
+		if m := bloomfilter.M(want.N, want.P); stage.M() != m {
+			return fmt.Errorf("%w: m of stage %d (%d) is not %d", ErrInvalidStage, i, stage.M(), m)
+		}
+	}
+
+	*b = Bloomfilter{
+		stages: target.Stages,
+		counts: target.Counts,
+		cfg:    cfg,
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package scalable
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/krakendio/bloomfilter/v2"
+	bbloomfilter "github.com/krakendio/bloomfilter/v2/bloomfilter"
+	"github.com/krakendio/bloomfilter/v2/testutils"
+)
+
+func TestBloomfilter(t *testing.T) {
+	testutils.CallSet(t, New(Config{Config: testutils.TestCfg}))
+}
+
+func TestBloomfilter_grow(t *testing.T) {
+	cfg := Config{Config: bloomfilter.Config{N: 100, P: 0.01, HashName: bloomfilter.HASHER_ENHANCED}}
+	bf := New(cfg)
+
+	n := 5000
+	for i := 0; i < n; i++ {
+		bf.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+	if bf.Stages() < 5 {
+		t.Errorf("unexpected number of stages: %d", bf.Stages())
+	}
+	for i := 0; i < n; i++ {
+		if elem := []byte(fmt.Sprintf("elem-%d", i)); !bf.Check(elem) {
+			t.Errorf("%s not found", elem)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if bf.Check([]byte(fmt.Sprintf("other-%d", i))) {
+			falsePositives++
+		}
+	}
+	if p := float64(falsePositives) / float64(n); p > 2*cfg.P {
+		t.Errorf("unexpected false positive rate: %f", p)
+	}
+}
+
+func TestConfig_stage_saturated(t *testing.T) {
+	cfg := Config{Config: bloomfilter.Config{N: 1000, P: 0.01, HashName: bloomfilter.HASHER_ENHANCED}, Growth: MaxGrowth}.withDefaults()
+	prev := uint(0)
+	for i := 0; i < 10; i++ {
+		n := cfg.stage(i).N
+		if n < prev {
+			t.Errorf("the capacity of the stage %d overflowed: %d < %d", i, n, prev)
+		}
+		prev = n
+	}
+	if prev != math.MaxUint {
+		t.Errorf("unexpected capacity of the last stage: %d", prev)
+	}
+}
+
+func TestBloomfilter_Union_ok(t *testing.T) {
+	set1 := New(Config{Config: testutils.TestCfg})
+	set2 := New(Config{Config: testutils.TestCfg})
+
+	testutils.CallSetUnion(t, set1, set2)
+
+	for i := 0; i < 1000; i++ {
+		set1.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+	if _, err := set2.Union(set1); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if set2.Stages() != set1.Stages() {
+		t.Errorf("unexpected number of stages: %d", set2.Stages())
+	}
+	for i := 0; i < 1000; i++ {
+		if elem := []byte(fmt.Sprintf("elem-%d", i)); !set2.Check(elem) {
+			t.Errorf("%s not found", elem)
+		}
+	}
+}
+
+func TestBloomfilter_Union_ko(t *testing.T) {
+	set1 := New(Config{Config: testutils.TestCfg})
+
+	if _, err := set1.Union(24); err != bloomfilter.ErrImpossibleToTreat {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(Config{Config: testutils.TestCfg, Growth: 4})); err == nil || !strings.Contains(err.Error(), "different growth") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(Config{Config: testutils.TestCfg2})); err == nil || !strings.Contains(err.Error(), "different p") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	if _, err := set1.Union(New(Config{Config: testutils.TestCfg3})); err == nil || !strings.Contains(err.Error(), "different hashers") {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
+
+func TestBloomfilter_binary(t *testing.T) {
+	bf1 := New(Config{Config: testutils.TestCfg})
+	for i := 0; i < 500; i++ {
+		bf1.Add([]byte(fmt.Sprintf("elem-%d", i)))
+	}
+
+	data, err := bf1.MarshalBinary()
+	if err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+
+	bf2 := new(Bloomfilter)
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+		return
+	}
+	if bf2.Stages() != bf1.Stages() {
+		t.Errorf("unexpected number of stages: %d", bf2.Stages())
+	}
+	for i := 0; i < 500; i++ {
+		if elem := []byte(fmt.Sprintf("elem-%d", i)); !bf2.Check(elem) {
+			t.Errorf("%s not found", elem)
+		}
+	}
+
+	if err := bf2.UnmarshalBinary([]byte{}); err == nil {
+		t.Error("should have given error")
+	}
+}
+
+func TestBloomfilter_UnmarshalBinary_invalidStages(t *testing.T) {
+	cfg := Config{Config: testutils.TestCfg}.withDefaults()
+	other := testutils.TestCfg
+	other.N *= 10
+
+	for name, target := range map[string]SerializibleBloomfilter{
+		"wrong stage":    {Stages: []*bbloomfilter.Bloomfilter{bbloomfilter.New(other)}, Counts: []uint{0}, Config: cfg},
+		"unordered":      {Stages: []*bbloomfilter.Bloomfilter{bbloomfilter.New(cfg.stage(1)), bbloomfilter.New(cfg.stage(0))}, Counts: []uint{0, 0}, Config: cfg},
+		"invalid growth": {Stages: []*bbloomfilter.Bloomfilter{bbloomfilter.New(cfg.stage(0))}, Counts: []uint{0}, Config: Config{Config: testutils.TestCfg, Growth: 1}},
+	} {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&target); err != nil {
+			t.Errorf("%s: unexpected error, %v", name, err)
+			continue
+		}
+		if err := new(Bloomfilter).UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("%s: should have given error", name)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	if _, err := Build(Config{Config: testutils.TestCfg, Tightening: 1.5}); !errors.Is(err, ErrInvalidTightening) {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	for _, growth := range []uint{1, MaxGrowth + 1} {
+		if _, err := Build(Config{Config: testutils.TestCfg, Growth: growth}); !errors.Is(err, ErrInvalidGrowth) {
+			t.Errorf("Unexpected error, %v", err)
+		}
+	}
+	if _, err := Build(Config{Config: testutils.TestCfg}); err != nil {
+		t.Errorf("Unexpected error, %v", err)
+	}
+}
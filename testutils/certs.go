@@ -0,0 +1,107 @@
+package testutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Certs contains the paths of the PEM files of a self-signed CA, of a server cert for localhost and
+// 127.0.0.1 and of two client certs, with the common names client and intruder, all of them signed by the CA
+type Certs struct {
+	CA                        string
+	ServerCert, ServerKey     string
+	ClientCert, ClientKey     string
+	IntruderCert, IntruderKey string
+}
+
+// GenerateCerts writes a new set of self-signed certs and keys into dir
+func GenerateCerts(dir string) (Certs, error) {
+	certs := Certs{
+		CA:           filepath.Join(dir, "ca.pem"),
+		ServerCert:   filepath.Join(dir, "server.pem"),
+		ServerKey:    filepath.Join(dir, "server-key.pem"),
+		ClientCert:   filepath.Join(dir, "client.pem"),
+		ClientKey:    filepath.Join(dir, "client-key.pem"),
+		IntruderCert: filepath.Join(dir, "intruder.pem"),
+		IntruderKey:  filepath.Join(dir, "intruder-key.pem"),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return certs, err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bloomfilter test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return certs, err
+	}
+	if err := writePEM(certs.CA, "CERTIFICATE", caDER); err != nil {
+		return certs, err
+	}
+
+	for i, leaf := range []struct {
+		cert, key string
+		tmpl      x509.Certificate
+	}{
+		{certs.ServerCert, certs.ServerKey, x509.Certificate{
+			Subject:     pkix.Name{CommonName: "localhost"},
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}},
+		{certs.ClientCert, certs.ClientKey, x509.Certificate{
+			Subject:     pkix.Name{CommonName: "client"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}},
+		{certs.IntruderCert, certs.IntruderKey, x509.Certificate{
+			Subject:     pkix.Name{CommonName: "intruder"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}},
+	} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return certs, err
+		}
+		tmpl := leaf.tmpl
+		tmpl.SerialNumber = big.NewInt(int64(i + 2))
+		tmpl.NotBefore = ca.NotBefore
+		tmpl.NotAfter = ca.NotAfter
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return certs, err
+		}
+		if err := writePEM(leaf.cert, "CERTIFICATE", der); err != nil {
+			return certs, err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return certs, err
+		}
+		if err := writePEM(leaf.key, "EC PRIVATE KEY", keyDER); err != nil {
+			return certs, err
+		}
+	}
+	return certs, nil
+}
+
+func writePEM(name, blockType string, der []byte) error {
+	return os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600)
+}
@@ -2,6 +2,8 @@
 package testutils
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/krakendio/bloomfilter/v2"
@@ -61,3 +63,55 @@ func CallSetUnion(t *testing.T, set1, set2 bloomfilter.Bloomfilter) {
 		return
 	}
 }
+
+// CallConcurrentCheck adds a set of elements to the set and then checks them from several goroutines
+func CallConcurrentCheck(t *testing.T, set bloomfilter.Bloomfilter) {
+	elems := make([][]byte, 100)
+	for i := range elems {
+		elems[i] = []byte(fmt.Sprintf("elem-%d", i))
+		set.Add(elems[i])
+	}
+
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if elem := elems[i%len(elems)]; !set.Check(elem) {
+					t.Errorf("failed concurrent check of %s", elem)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// CallConcurrentAdd adds a set of elements to the set from several goroutines and then checks them all
+func CallConcurrentAdd(t *testing.T, set bloomfilter.Bloomfilter) {
+	elems := make([][]byte, 1600)
+	for i := range elems {
+		elems[i] = []byte(fmt.Sprintf("elem-%d", i))
+	}
+
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < len(elems); i += 16 {
+				set.Add(elems[i])
+				set.Check(elems[(i+1)%len(elems)])
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, elem := range elems {
+		if !set.Check(elem) {
+			t.Errorf("failed check of %s after concurrent adds", elem)
+			return
+		}
+	}
+}